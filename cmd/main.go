@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"qvalet/pkg"
 	"qvalet/pkg/utils"
 
-	"github.com/davecgh/go-spew/spew"
 	"github.com/gin-gonic/gin"
 	"github.com/jessevdk/go-flags"
 	"github.com/joho/godotenv"
@@ -17,20 +22,29 @@ import (
 )
 
 var opts struct {
-	ConfigFilenames  []string `short:"c" long:"config" description:"Configuration file path"`
-	DotEnvFilenames  []string `short:"e" long:"dotenv" description:"dotenv file path"`
-	DefaultsFilename string   `short:"f" long:"defaults" description:"Defaults configuration file path"`
-	Debug            bool     `short:"d" long:"debug" description:"Enable the debug flag on all configs by default"`
+	ConfigFilenames  []string      `short:"c" long:"config" description:"Configuration file path"`
+	DotEnvFilenames  []string      `short:"e" long:"dotenv" description:"dotenv file path"`
+	DefaultsFilename string        `short:"f" long:"defaults" description:"Defaults configuration file path"`
+	Debug            bool          `short:"d" long:"debug" description:"Enable the debug flag on all configs by default"`
+	EncryptSecret    bool          `long:"encrypt-secret" description:"Encrypt a secret read from stdin with the QV_SECRETS_KEY key, print it and exit"`
+	NoWatch          bool          `long:"no-watch" description:"Do not reload the configuration when the config or defaults files change"`
+	DrainTimeout     time.Duration `long:"drain-timeout" default:"30s" description:"On shutdown, how long to wait for running executions before signaling their commands"`
 }
 
-func main() {
-	// Set some defaults for logging
-	logrus.StandardLogger().Formatter.(*logrus.TextFormatter).RenderFunc = func(value interface{}) string {
-		return spew.Sprintf("%#v", value)
-	}
-	logrus.SetOutput(os.Stdout)
+// After forwarding the shutdown signal to running commands, how long to
+// wait for them to exit before killing them
+const shutdownKillTimeout = 5 * time.Second
 
-	_, err := flags.Parse(&opts)
+func main() {
+	parser := flags.NewParser(&opts, flags.Default)
+	// Without a command, qValet starts the server
+	parser.SubcommandsOptional = true
+	addValidateCommand(parser)
+	addRunCommand(parser)
+	addTestCommand(parser)
+	addSchemaCommand(parser)
+
+	_, err := parser.Parse()
 	if err != nil {
 		logrus.WithError(err).Fatalf("failed to parse flags")
 	}
@@ -41,6 +55,11 @@ func main() {
 		}
 	}
 
+	if opts.EncryptSecret {
+		encryptSecretFromStdin()
+		return
+	}
+
 	// Internal debug logging
 	if os.Getenv("QV_VERBOSE") == "true" {
 		logrus.SetLevel(logrus.DebugLevel)
@@ -52,84 +71,171 @@ func main() {
 		logrus.WithField("env", os.Environ()).Debug("env")
 	}
 
-	var defaults *pkg.ListenerConfig
-	if opts.DefaultsFilename != "" {
-		_defaults, err := pkg.LoadDefaults(opts.DefaultsFilename)
-		if err != nil {
-			logrus.WithField("file", opts.DefaultsFilename).WithError(err).Fatal("failed to load defaults from file")
-		}
-		defaults = _defaults
-	}
-
-	configsByPort := pkg.MustLoadConfigs(opts.ConfigFilenames...)
-
 	// Unless there is a particular reason, gin should always be in release mode
 	if os.Getenv(gin.EnvGinMode) != gin.DebugMode {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	var mountResults []*pkg.MountRoutesResult
+	if parser.Active != nil {
+		switch parser.Active.Name {
+		case validateCommandName:
+			os.Exit(runValidate())
+		case runCommandName:
+			os.Exit(runRun())
+		case testCommandName:
+			os.Exit(runTest())
+		case schemaCommandName:
+			os.Exit(runSchema())
+		}
+	}
 
-	wg := sync.WaitGroup{}
-	for port, configs := range configsByPort {
-		port := port
-
-		router := gin.New()
-		router.Use(gin.Recovery())
-		router.Use(utils.GetGinLoggerHandler())
-		router.Use(gin.ErrorLogger())
-
-		router.GET("/healthz", func(context *gin.Context) {
-			context.Set(utils.GinContextDoNotLogEntry, true)
-			context.AbortWithStatus(http.StatusOK)
-		})
-
-		for _, config := range configs {
-			if opts.Debug {
-				config.Debug = true
-			}
+	server, err := pkg.NewServer(pkg.ServerOptions{
+		ConfigFilenames:  opts.ConfigFilenames,
+		DefaultsFilename: opts.DefaultsFilename,
+		Debug:            opts.Debug,
+	})
+	if err != nil {
+		logrus.WithError(err).Fatalf("failed to initialize server")
+	}
 
-			if defaults != nil {
-				newDefaults, err := pkg.MergeListenerConfig(defaults, &config.Defaults)
-				if err != nil {
-					logrus.WithError(err).Fatalf("failed to merge defaults config")
-				}
-				config.Defaults = *newDefaults
-			}
+	var servers []*http.Server
 
-			if err := utils.Validate.Struct(config); err != nil {
-				logrus.WithError(err).Fatalf("failed to validate config")
-			}
+	wg := sync.WaitGroup{}
+	for _, address := range server.Addresses() {
+		log := logrus.WithField("address", address)
+
+		httpServer := &http.Server{
+			Handler: server.Handler(address),
+		}
 
-			mountResult, err := pkg.MountRoutes(router, config, fmt.Sprintf("%d_", port))
+		if tlsConfig := server.TLSConfig(address); tlsConfig != nil {
+			serverTLSConfig, err := tlsConfig.NewServerTLSConfig()
 			if err != nil {
-				logrus.WithError(err).Fatalf("failed to mount routes")
+				log.WithError(err).Fatalf("failed to load TLS config")
 			}
-
-			mountResults = append(mountResults, mountResult)
+			httpServer.TLSConfig = serverTLSConfig
 		}
 
-		for _, r := range mountResults {
-			if err := r.PluginsStart(); err != nil {
-				logrus.WithError(err).Fatalf("failed to start plugins")
-			}
+		listener, err := server.Listen(address)
+		if err != nil {
+			log.WithError(err).Fatalf("failed to listen")
 		}
 
-		logrus.WithField("port", port).Info("server listening")
+		log.WithField("tls", httpServer.TLSConfig != nil).Info("server listening")
 		wg.Add(1)
 		go func() {
-			if err := http.ListenAndServe(fmt.Sprintf(":%d", port), router); err != nil {
+			var err error
+			if httpServer.TLSConfig != nil {
+				// Certificates are provided by the TLS config
+				err = httpServer.ServeTLS(listener, "", "")
+			} else {
+				err = httpServer.Serve(listener)
+			}
+			if err != nil && err != http.ErrServerClosed {
 				logrus.WithError(err).Fatalf("failed to start server")
 			}
 			wg.Done()
 		}()
+		servers = append(servers, httpServer)
+	}
+
+	if !opts.NoWatch {
+		if err := server.Watch(); err != nil {
+			logrus.WithError(err).Fatalf("failed to watch config files")
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			logrus.Info("received SIGHUP, reloading config")
+			_ = server.Reload()
+			continue
+		}
+
+		shutdown(sig, server, servers)
+		break
+	}
+	wg.Wait()
+}
+
+// shutdown stops accepting new requests, drains the running executions, and then
+// releases all resources, making sure the database is closed last
+func shutdown(sig os.Signal, server *pkg.Server, servers []*http.Server) {
+	// No more reloads from now on
+	server.Close()
+	mountResults := server.MountResults()
+
+	logrus.WithField("signal", sig.String()).WithField("drainTimeout", opts.DrainTimeout.String()).Info("shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.DrainTimeout)
+	defer cancel()
+
+	// Stop accepting requests, waiting for the in-flight ones
+	serversWg := sync.WaitGroup{}
+	for _, server := range servers {
+		server := server
+		serversWg.Add(1)
+		go func() {
+			defer serversWg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				logrus.WithField("addr", server.Addr).WithError(err).Warn("failed to gracefully shutdown server")
+			}
+		}()
 	}
-	defer func() {
+
+	// Stop plugins, e.g. schedule plugins will stop picking up new tasks, and
+	// debounce and batch plugins will flush their pending executions. This happens
+	// before draining, so that flushed executions are drained and signaled too.
+	pluginsStopped := make(chan struct{})
+	go func() {
+		serversWg.Wait()
 		for _, r := range mountResults {
 			r.PluginsStop()
 		}
+		close(pluginsStopped)
 	}()
-	defer pkg.CloseAllDBConnections()
 
-	wg.Wait()
+	select {
+	case <-pluginsStopped:
+	case <-ctx.Done():
+	}
+
+	if !pkg.WaitForExecutions(ctx) {
+		logrus.WithField("running", pkg.RunningExecutionsCount()).Warn("drain timeout expired, signaling running commands")
+		pkg.SignalRunningCommands(sig)
+
+		killCtx, killCancel := context.WithTimeout(context.Background(), shutdownKillTimeout)
+		defer killCancel()
+		if !pkg.WaitForExecutions(killCtx) {
+			logrus.WithField("running", pkg.RunningExecutionsCount()).Warn("killing running commands")
+			pkg.SignalRunningCommands(syscall.SIGKILL)
+		}
+	}
+
+	// Plugins may still be waiting for the commands which have just been signaled
+	select {
+	case <-pluginsStopped:
+	case <-time.After(shutdownKillTimeout):
+		logrus.Warn("timed out waiting for plugins to stop")
+	}
+
+	pkg.CloseAllDBConnections()
+
+	logrus.Info("shutdown complete")
+}
+
+func encryptSecretFromStdin() {
+	value, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to read secret from stdin")
+	}
+
+	encrypted, err := utils.EncryptSecretWithEnvKey(strings.TrimRight(string(value), "\r\n"))
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to encrypt secret")
+	}
+
+	fmt.Println(encrypted)
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"qvalet/pkg"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jessevdk/go-flags"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const runCommandName = "run"
+
+var runOpts struct {
+	Method  string   `short:"X" long:"method" description:"HTTP method of the request, defaults to POST if data is provided, GET otherwise"`
+	Data    string   `long:"data" description:"Request body, or @file to read it from a file, or @- to read it from stdin"`
+	Headers []string `short:"H" long:"header" description:"Request header, as key=value"`
+	DryRun  bool     `long:"dry-run" description:"Only prepare the command, and print it without executing it"`
+
+	Args struct {
+		Path string `positional-arg-name:"path" description:"Path of the request, e.g. /hello/world?key=value" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+func addRunCommand(parser *flags.Parser) {
+	if _, err := parser.AddCommand(
+		runCommandName,
+		"Execute a listener locally and exit",
+		"Executes the listener matching the request, without starting the server, and prints its response. Auth is not checked.",
+		&runOpts,
+	); err != nil {
+		logrus.WithError(err).Fatal("failed to add run command")
+	}
+}
+
+func readRunData() ([]byte, error) {
+	switch {
+	case runOpts.Data == "@-":
+		return io.ReadAll(os.Stdin)
+	case strings.HasPrefix(runOpts.Data, "@"):
+		return os.ReadFile(strings.TrimPrefix(runOpts.Data, "@"))
+	}
+	return []byte(runOpts.Data), nil
+}
+
+// runRun executes the listener, and returns the process exit code
+func runRun() int {
+	// Keep stdout for the results
+	if err := pkg.ConfigureLogging(&pkg.LoggingConfig{Output: pkg.LoggingOutputStderr}); err != nil {
+		logrus.WithError(err).Fatal("failed to configure logging")
+	}
+	defer pkg.CloseAllDBConnections()
+
+	body, err := readRunData()
+	if err != nil {
+		logrus.WithError(err).Error("failed to read data")
+		return 1
+	}
+
+	headers := http.Header{}
+	for _, header := range runOpts.Headers {
+		key, value, found := strings.Cut(header, "=")
+		if !found {
+			logrus.WithError(errors.Errorf("invalid header %s", header)).Error("failed to parse headers")
+			return 1
+		}
+		headers.Add(strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+	if len(body) > 0 && headers.Get("Content-Type") == "" {
+		headers.Set("Content-Type", gin.MIMEJSON)
+	}
+
+	method := strings.ToUpper(runOpts.Method)
+	if method == "" {
+		method = http.MethodGet
+		if len(body) > 0 {
+			method = http.MethodPost
+		}
+	}
+
+	result, err := pkg.RunListener(pkg.RunOptions{
+		ServerOptions: pkg.ServerOptions{
+			ConfigFilenames:  opts.ConfigFilenames,
+			DefaultsFilename: opts.DefaultsFilename,
+			Debug:            opts.Debug,
+		},
+		Method:  method,
+		Path:    runOpts.Args.Path,
+		Headers: headers,
+		Body:    body,
+		DryRun:  runOpts.DryRun,
+	})
+	if err != nil {
+		logrus.WithError(err).Error("failed to run listener")
+		return 1
+	}
+
+	var toPrint interface{} = result.Response
+	if runOpts.DryRun {
+		toPrint = result.Preview
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(toPrint); err != nil {
+		logrus.WithError(err).Error("failed to encode result")
+		return 1
+	}
+
+	if result.Failed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"qvalet/pkg"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/sirupsen/logrus"
+)
+
+const schemaCommandName = "schema"
+
+var schemaOpts struct {
+	Defaults bool   `long:"defaults" description:"Print the schema of defaults files, instead of config files"`
+	Output   string `short:"o" long:"output" description:"Write the schema to this file, instead of stdout"`
+}
+
+func addSchemaCommand(parser *flags.Parser) {
+	if _, err := parser.AddCommand(
+		schemaCommandName,
+		"Print the JSON Schema of the configuration and exit",
+		"Prints the JSON Schema of config files, e.g. to get completion and validation in editors via the YAML language server.",
+		&schemaOpts,
+	); err != nil {
+		logrus.WithError(err).Fatal("failed to add schema command")
+	}
+}
+
+// runSchema prints the JSON Schema, and returns the process exit code
+func runSchema() int {
+	generate := pkg.GenerateConfigJSONSchema
+	if schemaOpts.Defaults {
+		generate = pkg.GenerateDefaultsJSONSchema
+	}
+
+	schema, err := generate()
+	if err != nil {
+		logrus.WithError(err).Error("failed to generate schema")
+		return 1
+	}
+
+	out := os.Stdout
+	if schemaOpts.Output != "" {
+		file, err := os.Create(schemaOpts.Output)
+		if err != nil {
+			logrus.WithError(err).Error("failed to create schema file")
+			return 1
+		}
+		defer file.Close()
+		out = file
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(schema); err != nil {
+		logrus.WithError(err).Error("failed to encode schema")
+		return 1
+	}
+	return 0
+}
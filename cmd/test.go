@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"qvalet/pkg"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/sirupsen/logrus"
+)
+
+const testCommandName = "test"
+
+var testOpts struct {
+	JUnit string `long:"junit" description:"Also write the results to this file, in the JUnit XML format"`
+}
+
+func addTestCommand(parser *flags.Parser) {
+	if _, err := parser.AddCommand(
+		testCommandName,
+		"Run the listeners test cases and exit",
+		"Runs the test cases defined in the tests entry of every listener, without starting the server, and exits with a non-zero code if any test fails.",
+		&testOpts,
+	); err != nil {
+		logrus.WithError(err).Fatal("failed to add test command")
+	}
+}
+
+// runTest runs the listeners test cases, and returns the process exit code
+func runTest() int {
+	if len(opts.ConfigFilenames) == 0 {
+		logrus.Error("no config file provided, use -c")
+		return 1
+	}
+
+	// Keep stdout for the results
+	if err := pkg.ConfigureLogging(&pkg.LoggingConfig{Output: pkg.LoggingOutputStderr}); err != nil {
+		logrus.WithError(err).Fatal("failed to configure logging")
+	}
+
+	report, err := pkg.RunListenerTests(pkg.ServerOptions{
+		ConfigFilenames:  opts.ConfigFilenames,
+		DefaultsFilename: opts.DefaultsFilename,
+		Debug:            opts.Debug,
+	})
+	if err != nil {
+		logrus.WithError(err).Error("failed to run tests")
+		return 1
+	}
+
+	failed := 0
+	for _, result := range report.Results {
+		fmt.Println(result.String())
+		if result.Error != nil {
+			fmt.Printf("    error: %s\n", result.Error)
+		}
+		for _, failure := range result.Failures {
+			fmt.Printf("    %s\n", failure)
+		}
+		if !result.Passed() {
+			failed++
+		}
+	}
+	fmt.Printf("%d test(s), %d failed\n", len(report.Results), failed)
+
+	if testOpts.JUnit != "" {
+		file, err := os.Create(testOpts.JUnit)
+		if err != nil {
+			logrus.WithError(err).Error("failed to create JUnit report")
+			return 1
+		}
+		defer file.Close()
+		if err := report.WriteJUnit(file); err != nil {
+			logrus.WithError(err).Error("failed to write JUnit report")
+			return 1
+		}
+	}
+
+	if !report.Passed() {
+		return 1
+	}
+	return 0
+}
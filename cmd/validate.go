@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"qvalet/pkg"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/sirupsen/logrus"
+)
+
+const validateCommandName = "validate"
+
+var validateOpts struct {
+	JSON    bool `long:"json" description:"Print the problems as JSON, e.g. to annotate CI results"`
+	Connect bool `long:"connect" description:"Also check that storage backends are writable, and databases reachable"`
+}
+
+type validateResult struct {
+	Valid    bool                     `json:"valid"`
+	Problems []*pkg.ValidationProblem `json:"problems"`
+}
+
+func addValidateCommand(parser *flags.Parser) {
+	if _, err := parser.AddCommand(
+		validateCommandName,
+		"Validate the configuration and exit",
+		"Validates the config and defaults files, without starting the server, and exits with a non-zero code if any error is found. Warnings, e.g. route collisions, are reported without failing.",
+		&validateOpts,
+	); err != nil {
+		logrus.WithError(err).Fatal("failed to add validate command")
+	}
+}
+
+// runValidate validates the configuration, and returns the process exit code
+func runValidate() int {
+	if len(opts.ConfigFilenames) == 0 {
+		logrus.Error("no config file provided, use -c")
+		return 1
+	}
+
+	// Keep stdout for the results
+	if err := pkg.ConfigureLogging(&pkg.LoggingConfig{Output: pkg.LoggingOutputStderr}); err != nil {
+		logrus.WithError(err).Fatal("failed to configure logging")
+	}
+
+	problems := pkg.ValidateConfigs(pkg.ValidateOptions{
+		ConfigFilenames:  opts.ConfigFilenames,
+		DefaultsFilename: opts.DefaultsFilename,
+		Connect:          validateOpts.Connect,
+	})
+
+	errorsCount := pkg.CountValidationErrors(problems)
+
+	if validateOpts.JSON {
+		result := validateResult{
+			Valid:    errorsCount == 0,
+			Problems: problems,
+		}
+		if result.Problems == nil {
+			result.Problems = []*pkg.ValidationProblem{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			logrus.WithError(err).Fatal("failed to encode results")
+		}
+	} else {
+		for _, problem := range problems {
+			fmt.Println(problem.String())
+		}
+		warningsCount := len(problems) - errorsCount
+		if errorsCount == 0 {
+			fmt.Printf("configuration is valid, with %d warning(s)\n", warningsCount)
+		} else {
+			fmt.Printf("found %d error(s) and %d warning(s)\n", errorsCount, warningsCount)
+		}
+	}
+
+	// Warnings alone do not fail the validation
+	if errorsCount > 0 {
+		return 1
+	}
+	return 0
+}
@@ -16,6 +16,7 @@ require (
 	github.com/beyondstorage/go-service-s3/v2 v2.5.0
 	github.com/beyondstorage/go-storage/v4 v4.8.0
 	github.com/davecgh/go-spew v1.1.1
+	github.com/fsnotify/fsnotify v1.5.1
 	github.com/gin-gonic/gin v1.8.1
 	github.com/go-playground/validator/v10 v10.11.0
 	github.com/goccy/go-yaml v1.9.5
@@ -52,7 +53,6 @@ require (
 	github.com/dave/dst v0.26.2 // indirect
 	github.com/dropbox/dropbox-sdk-go-unofficial/v6 v6.0.2 // indirect
 	github.com/fatih/color v1.13.0 // indirect
-	github.com/fsnotify/fsnotify v1.5.1 // indirect
 	github.com/gin-contrib/sse v0.1.0 // indirect
 	github.com/go-playground/locales v0.14.0 // indirect
 	github.com/go-playground/universal-translator v0.18.0 // indirect
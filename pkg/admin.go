@@ -0,0 +1,275 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"qvalet/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// @formatter:off
+/// [admin-docs]
+const adminRouteDefault = "/admin"
+
+type AdminConfig struct {
+	// Route prefix of the admin API, defaults to [adminRouteDefault]
+	Route *string `mapstructure:"route"`
+
+	// List of allowed authentication methods, at least one is required, as
+	// the admin API exposes details about the running server, and can
+	// control it
+	Auth []*AuthConfig `mapstructure:"auth" validate:"required,min=1,dive"`
+}
+
+/// [admin-docs]
+// @formatter:on
+
+func (config *AdminConfig) route() string {
+	if config.Route != nil {
+		return *config.Route
+	}
+	return adminRouteDefault
+}
+
+const adminDatabasePingTimeout = 5 * time.Second
+
+type adminListenerInfo struct {
+	Id       string             `json:"id"`
+	Route    string             `json:"route"`
+	Methods  []string           `json:"methods"`
+	Plugins  []*adminPluginInfo `json:"plugins"`
+	Trigger  string             `json:"trigger,omitempty"`
+	Disabled bool               `json:"disabled"`
+	Config   interface{}        `json:"config"`
+}
+
+type adminPluginInfo struct {
+	Id   string `json:"id"`
+	Type string `json:"type"`
+	// Only set for plugins with a lifecycle, e.g. schedule
+	State     string   `json:"state,omitempty"`
+	Listeners []string `json:"listeners,omitempty"`
+}
+
+type adminStorageInfo struct {
+	Conn      string              `json:"conn"`
+	Listeners []string            `json:"listeners"`
+	LastWrite *StorageWriteStatus `json:"lastWrite"`
+}
+
+func mountAdminRoutes(engine *gin.Engine, config *Config, server *Server) {
+	group := engine.Group(config.Admin.route(), getAuthMiddleware(config.Admin.route(), config.AuthBruteForce, config.Admin.Auth))
+
+	group.GET("/reload", func(c *gin.Context) {
+		c.JSON(http.StatusOK, server.LastReload())
+	})
+
+	group.GET("/listeners", func(c *gin.Context) {
+		var infos []*adminListenerInfo
+		for id, listener := range adminListeners(server) {
+			infos = append(infos, newAdminListenerInfo(id, listener))
+		}
+		sort.Slice(infos, func(i, j int) bool {
+			return infos[i].Id < infos[j].Id
+		})
+		c.JSON(http.StatusOK, infos)
+	})
+
+	group.POST("/listeners/enable", func(c *gin.Context) {
+		adminSetListenerDisabled(c, server, false)
+	})
+
+	group.POST("/listeners/disable", func(c *gin.Context) {
+		adminSetListenerDisabled(c, server, true)
+	})
+
+	group.GET("/plugins", func(c *gin.Context) {
+		c.JSON(http.StatusOK, adminPlugins(server))
+	})
+
+	group.GET("/databases", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), adminDatabasePingTimeout)
+		defer cancel()
+		c.JSON(http.StatusOK, PingAllDBConnections(ctx))
+	})
+
+	group.GET("/storage", func(c *gin.Context) {
+		c.JSON(http.StatusOK, adminStorage(server))
+	})
+
+	logrus.Infof("mounted admin API at %s", config.Admin.route())
+}
+
+// Maps listener id -> listener, for all the listeners of the running config
+func adminListeners(server *Server) map[string]*CompiledListener {
+	listeners := make(map[string]*CompiledListener)
+	for _, r := range server.MountResults() {
+		for id, listener := range r.listenersMap {
+			listeners[id] = listener
+		}
+	}
+	return listeners
+}
+
+func newAdminListenerInfo(id string, listener *CompiledListener) *adminListenerInfo {
+	info := &adminListenerInfo{
+		Id:       id,
+		Route:    listener.route,
+		Methods:  listener.config.methods(),
+		Plugins:  []*adminPluginInfo{},
+		Disabled: listener.Disabled(),
+		Config:   adminRedactedConfig(listener),
+	}
+
+	if listener.config.Trigger != nil {
+		info.Trigger = listener.config.Trigger.String()
+	}
+
+	for _, plugin := range listener.plugins {
+		info.Plugins = append(info.Plugins, newAdminPluginInfo(plugin))
+	}
+
+	return info
+}
+
+func newAdminPluginInfo(plugin PluginInterface) *adminPluginInfo {
+	info := &adminPluginInfo{
+		Id:   plugin.Id(),
+		Type: reflect.TypeOf(plugin).Elem().Name(),
+	}
+	if plugin, ok := plugin.(PluginLifecycle); ok {
+		info.State = GetPluginLifecycleState(plugin)
+	}
+	return info
+}
+
+// The listener config, without any secret
+func adminRedactedConfig(listener *CompiledListener) interface{} {
+	data, err := json.Marshal(listener.config)
+	if err != nil {
+		return nil
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil
+	}
+
+	adminRedactConfigValue(listener.redactor, config)
+
+	return listener.redactor.Value(config)
+}
+
+// adminRedactConfigValue masks secrets in the marshalled config, recursively, so that
+// nested configs like the error handler or the plugins are covered too
+func adminRedactConfigValue(r *redactor, value interface{}) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			switch {
+			case key == "Env":
+				if env, ok := item.(map[string]interface{}); ok {
+					for name := range env {
+						if redactMatchesAny(r.envPatterns(), name) {
+							env[name] = redactedValue
+						}
+					}
+				}
+			case key == "Conn":
+				if conn, ok := item.(string); ok {
+					value[key] = storageLogSafeConn(conn)
+				}
+			case item != nil && redactMatchesAny(redactDefaultEnv, strings.ToUpper(key)):
+				// E.g. database passwords, or their connection options
+				value[key] = redactedValue
+			default:
+				adminRedactConfigValue(r, item)
+			}
+		}
+	case []interface{}:
+		for _, item := range value {
+			adminRedactConfigValue(r, item)
+		}
+	}
+}
+
+func adminSetListenerDisabled(c *gin.Context, server *Server, disabled bool) {
+	id := c.Query("id")
+	listener, found := adminListeners(server)[id]
+	if !found {
+		c.AbortWithError(http.StatusNotFound, errors.Errorf("listener %s not found", id))
+		return
+	}
+
+	// Listeners mounted on multiple methods share the same state
+	listener.SetDisabled(disabled)
+	logrus.WithField(logFieldListener, listener.route).WithField("disabled", disabled).Info("listener state changed via admin API")
+
+	c.JSON(http.StatusOK, newAdminListenerInfo(id, listener))
+}
+
+func adminPlugins(server *Server) []*adminPluginInfo {
+	infos := make(map[PluginInterface]*adminPluginInfo)
+	for id, listener := range adminListeners(server) {
+		for _, plugin := range listener.plugins {
+			info, found := infos[plugin]
+			if !found {
+				info = newAdminPluginInfo(plugin)
+				infos[plugin] = info
+			}
+			info.Listeners = append(info.Listeners, id)
+		}
+	}
+
+	ret := []*adminPluginInfo{}
+	for _, info := range infos {
+		sort.Strings(info.Listeners)
+		ret = append(ret, info)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Id < ret[j].Id
+	})
+	return ret
+}
+
+func adminStorage(server *Server) []*adminStorageInfo {
+	infos := make(map[string]*adminStorageInfo)
+	for id, listener := range adminListeners(server) {
+		for _, l := range []*CompiledListener{listener, listener.errorHandler} {
+			if l == nil || l.storager == nil {
+				continue
+			}
+
+			conn := l.config.Storage.Conn
+			info, found := infos[conn]
+			if !found {
+				info = &adminStorageInfo{
+					Conn:      storageLogSafeConn(conn),
+					LastWrite: GetStorageWriteStatus(conn),
+				}
+				infos[conn] = info
+			}
+			if !utils.StringSliceContains(info.Listeners, id) {
+				info.Listeners = append(info.Listeners, id)
+			}
+		}
+	}
+
+	ret := []*adminStorageInfo{}
+	for _, info := range infos {
+		sort.Strings(info.Listeners)
+		ret = append(ret, info)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Conn < ret[j].Conn
+	})
+	return ret
+}
@@ -4,8 +4,14 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
+	"fmt"
 	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
 
 	"qvalet/pkg/utils"
 
@@ -18,13 +24,17 @@ import (
 
 type AuthConfig struct {
 	// Api keys for this auth type.
-	// Each api key can also be loaded from the environment variables, by
-	// using the syntax `ENV{ENV_VAR_NAME}`, e.g.
+	// Each api key can also be loaded from a secret source, e.g.:
 	//
 	// apiKeys:
+	//   # From the environment variables
 	// 	 - ENV{MY_PASSWORD}
+	//   # From a file, which is re-read every time it changes
+	// 	 - FILE{/run/secrets/my-password}
+	//   # From the encrypted secrets file
+	// 	 - SECRET{myPassword}
 	//
-	ApiKeys []*utils.StringFromEnvVar `mapstructure:"apiKeys" validate:"required"`
+	ApiKeys []*utils.StringFromEnvVar `mapstructure:"apiKeys" validate:"required_without_all=Condition OAuth2Introspection"`
 
 	// If true, allows basic HTTP authentication
 	BasicAuth bool `mapstructure:"basicAuth"`
@@ -43,6 +53,23 @@ type AuthConfig struct {
 	// If provided, apiKeys will be searched for in these headers
 	// E.g. GitLab hooks can authenticate via X-Gitlab-Token
 	AuthHeaders []*AuthHeader `mapstructure:"authHeaders" validate:"dive"`
+
+	// If provided, the request will be authenticated if this condition is true.
+	// The condition is evaluated against the request args (including `__qvRequest`),
+	// and the list of api keys can be accessed via the `__qvApiKeys` key, e.g.
+	//
+	// condition: has .token .__qvApiKeys
+	//
+	Condition *ListenerIfTemplate `mapstructure:"condition"`
+
+	// If provided, requests bearing an OAuth2 access token (`Authorization: Bearer <token>`)
+	// will be authenticated by validating the token against an introspection endpoint
+	OAuth2Introspection *AuthOAuth2IntrospectionConfig `mapstructure:"oauth2Introspection"`
+
+	// If provided, clients failing authentication too many times will be
+	// temporarily locked out, and will receive a 429 status code.
+	// Overrides the config-wide `authBruteForce` setting.
+	BruteForce *AuthBruteForceConfig `mapstructure:"bruteForce"`
 }
 
 type AuthHeader struct {
@@ -73,16 +100,193 @@ const (
 /// [auth-docs]
 // @formatter:on
 
-func verifyAuth(c *gin.Context, authConfigs []*AuthConfig) error {
+// @formatter:off
+/// [auth-info]
+// Details about the authenticated request are available in every
+// template under the [keyArgsAuth] key.
+const keyArgsAuth = "__qvAuth"
+
+type AuthInfo struct {
+	// The auth method which accepted the request, e.g. `basic` or `oauth2Introspection`
+	Method string `json:"method"`
+
+	// The basic auth username, or the token username (OAuth2 introspection only)
+	Username string `json:"username,omitempty"`
+
+	// The subject of the token (OAuth2 introspection only)
+	Subject string `json:"subject,omitempty"`
+
+	// The scopes granted to the token (OAuth2 introspection only)
+	Scopes []string `json:"scopes,omitempty"`
+
+	// The client the token has been issued to (OAuth2 introspection only)
+	ClientId string `json:"clientId,omitempty"`
+}
+
+/// [auth-info]
+// @formatter:on
+
+const (
+	authMethodBasic     = "basic"
+	authMethodQuery     = "query"
+	authMethodHeader    = "header"
+	authMethodCondition = "condition"
+	authMethodOAuth2    = "oauth2Introspection"
+)
+
+// The list of api keys is available to auth conditions under this key
+const authConditionKeyApiKeys = "__qvApiKeys"
+
+// authError is returned when no auth method accepted the request, and
+// keeps track of which methods the client tried to use
+type authError struct {
+	methods []string
+}
+
+func (e *authError) Error() string {
+	return "bad auth"
+}
+
+func (e *authError) addMethod(method string) {
+	for _, m := range e.methods {
+		if m == method {
+			return
+		}
+	}
+	e.methods = append(e.methods, method)
+}
+
+// authenticateRequest verifies the request auth, and takes care of
+// rejecting the request, if needed. Returns true if the request can proceed,
+// together with the auth details, if any.
+func authenticateRequest(c *gin.Context, listener *CompiledListener, authConfigs []*AuthConfig) (bool, *AuthInfo) {
 	if len(authConfigs) == 0 {
-		return nil
+		return true, nil
+	}
+
+	clientIP := c.ClientIP()
+	log := listener.Logger().WithField("clientIP", clientIP)
+	guards := getAuthBruteForceGuardsFor(listener, authConfigs)
+	now := time.Now()
+
+	var lockedFor time.Duration
+	for _, guard := range guards {
+		if d := guard.lockedFor(clientIP, now); d > lockedFor {
+			lockedFor = d
+		}
+	}
+	if lockedFor > 0 {
+		log.WithField("retryAfter", lockedFor.String()).Warn("rejected locked out client")
+		abortAuthLockedOut(c, lockedFor)
+		return false, nil
+	}
+
+	info, err := verifyAuth(c, authConfigs)
+	if err == nil {
+		for _, guard := range guards {
+			guard.reset(clientIP)
+		}
+		return true, info
+	}
+
+	// NOTE: never log the provided keys, only the methods that have been tried
+	var badAuthErr *authError
+	if errors.As(err, &badAuthErr) {
+		log = log.WithField("authMethods", badAuthErr.methods)
+
+		var lockout time.Duration
+		for _, guard := range guards {
+			if d := guard.recordFailure(clientIP, now); d > lockout {
+				lockout = d
+			}
+		}
+		if lockout > 0 {
+			log.WithField("lockout", lockout.String()).Warn("client locked out after too many authentication failures")
+		}
+	}
+
+	log.WithError(err).Warn("authentication failed")
+	c.AbortWithError(http.StatusUnauthorized, err)
+	return false, nil
+}
+
+// getAuthMiddleware protects routes which are not listeners, e.g. the admin API,
+// with the same auth handling used for listeners
+func getAuthMiddleware(route string, bruteForce *AuthBruteForceConfig, authConfigs []*AuthConfig) gin.HandlerFunc {
+	pseudoListener := &CompiledListener{
+		route:          route,
+		authBruteForce: bruteForce,
+	}
+
+	return func(c *gin.Context) {
+		if authenticated, _ := authenticateRequest(c, pseudoListener, authConfigs); !authenticated {
+			c.Abort()
+		}
+	}
+}
+
+func getAuthBruteForceGuardsFor(listener *CompiledListener, authConfigs []*AuthConfig) []*authBruteForceGuard {
+	var guards []*authBruteForceGuard
+	for _, auth := range authConfigs {
+		if auth.BruteForce != nil {
+			guards = append(guards, getAuthBruteForceGuard(auth.BruteForce))
+		}
+	}
+
+	if len(guards) == 0 && listener.authBruteForce != nil {
+		guards = append(guards, getAuthBruteForceGuard(listener.authBruteForce))
+	}
+
+	return guards
+}
+
+// authUsesBruteForce returns true if requests protected by the auth configs
+// go through a brute force guard, see [getAuthBruteForceGuardsFor]
+func authUsesBruteForce(bruteForce *AuthBruteForceConfig, authConfigs []*AuthConfig) bool {
+	if len(authConfigs) == 0 {
+		return false
+	}
+	for _, auth := range authConfigs {
+		if auth.BruteForce != nil {
+			return true
+		}
+	}
+	return bruteForce != nil
+}
+
+func abortAuthLockedOut(c *gin.Context, lockedFor time.Duration) {
+	retryAfter := int(math.Ceil(lockedFor.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.AbortWithError(http.StatusTooManyRequests, errors.New(fmt.Sprintf("too many failed authentication attempts, retry in %ds", retryAfter)))
+}
+
+func verifyAuth(c *gin.Context, authConfigs []*AuthConfig) (*AuthInfo, error) {
+	if len(authConfigs) == 0 {
+		return nil, nil
 	}
 
 	// Auth check
-	found := false
+	var info *AuthInfo
+	badAuthErr := &authError{}
 
 	// Cache the body data, if needed
 	var bodyData []byte
+	readBodyData := func() error {
+		if bodyData != nil {
+			return nil
+		}
+		data, err := c.GetRawData()
+		if err != nil {
+			return errors.WithMessage(err, "failed to read body data")
+		}
+		bodyData = data
+		// Put the data back for later usage
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(data))
+		return nil
+	}
+
+	// Cache the request args, if needed by any condition
+	var conditionArgs map[string]interface{}
 
 	for _, auth := range authConfigs {
 
@@ -95,10 +299,11 @@ func verifyAuth(c *gin.Context, authConfigs []*AuthConfig) error {
 			}
 			// Check if there is any basic auth
 			if username, password, ok := c.Request.BasicAuth(); ok {
-				if username == authUser {
+				badAuthErr.addMethod(authMethodBasic)
+				if authSecureCompare(username, authUser) {
 					for _, apiKey := range auth.ApiKeys {
-						if password == apiKey.Value() {
-							found = true
+						if authSecureCompare(password, apiKey.Value()) {
+							info = &AuthInfo{Method: authMethodBasic, Username: username}
 							goto afterAuth
 						}
 					}
@@ -112,10 +317,13 @@ func verifyAuth(c *gin.Context, authConfigs []*AuthConfig) error {
 			if queryKey == "" {
 				queryKey = keyAuthApiKeyQuery
 			}
-			apiKeyQuery := c.Query(queryKey)
+			apiKeyQuery, ok := c.GetQuery(queryKey)
+			if ok {
+				badAuthErr.addMethod(authMethodQuery)
+			}
 			for _, apiKey := range auth.ApiKeys {
-				if apiKeyQuery == apiKey.Value() {
-					found = true
+				if authSecureCompare(apiKeyQuery, apiKey.Value()) {
+					info = &AuthInfo{Method: authMethodQuery}
 					goto afterAuth
 				}
 			}
@@ -125,53 +333,122 @@ func verifyAuth(c *gin.Context, authConfigs []*AuthConfig) error {
 		if len(auth.AuthHeaders) > 0 {
 			for _, authHeader := range auth.AuthHeaders {
 				headerValue := c.GetHeader(authHeader.Header)
+				if headerValue != "" {
+					badAuthErr.addMethod(fmt.Sprintf("%s:%s", authMethodHeader, authHeader.Header))
+				}
 				for _, apiKey := range auth.ApiKeys {
 					isValid := false
 
 					if authHeader.Transform != nil {
 						_headerValue, err := authHeader.Transform.Execute(headerValue)
 						if err != nil {
-							return errors.WithMessage(err, "failed to execute header template")
+							return nil, errors.WithMessage(err, "failed to execute header template")
 						}
 						headerValue = _headerValue
 					}
 
 					switch authHeader.Method {
 					case AuthHeaderMethodNone:
-						isValid = headerValue == apiKey.Value()
+						isValid = authSecureCompare(headerValue, apiKey.Value())
 					case AuthHeaderMethodHMACSHA256:
-						if bodyData == nil {
-							data, err := c.GetRawData()
-							if err != nil {
-								return errors.WithMessage(err, "failed to read body data")
-							}
-							bodyData = data
-							// Put the data back for later usage
-							c.Request.Body = ioutil.NopCloser(bytes.NewReader(data))
+						if err := readBodyData(); err != nil {
+							return nil, err
 						}
 
 						hmacValue := authHMACSHA256(bodyData, apiKey.Value())
-						isValid = headerValue == hmacValue
+						isValid = authSecureCompare(headerValue, hmacValue)
 					default:
-						return errors.New("bad header auth method")
+						return nil, errors.New("bad header auth method")
 					}
 
 					if isValid {
-						found = true
+						info = &AuthInfo{Method: authMethodHeader}
 						goto afterAuth
 					}
 				}
 			}
 		}
+
+		// OAuth2 token introspection
+		if auth.OAuth2Introspection != nil {
+			if token, ok := getBearerToken(c); ok {
+				badAuthErr.addMethod(authMethodOAuth2)
+
+				tokenInfo, err := getOAuth2Introspector(auth.OAuth2Introspection).Introspect(token)
+				if err != nil {
+					return nil, errors.WithMessage(err, "failed to introspect oauth2 token")
+				}
+
+				if tokenInfo != nil {
+					info = tokenInfo
+					goto afterAuth
+				}
+			}
+		}
+
+		// Custom condition authentication
+		if auth.Condition != nil {
+			badAuthErr.addMethod(authMethodCondition)
+
+			if conditionArgs == nil {
+				if err := readBodyData(); err != nil {
+					return nil, err
+				}
+				args, err := utils.ExtractArgsFromGinContext(c)
+				if err != nil {
+					return nil, errors.WithMessage(err, "failed to extract args for auth condition")
+				}
+				// Put the data back again, args will be extracted once more later
+				c.Request.Body = ioutil.NopCloser(bytes.NewReader(bodyData))
+				conditionArgs = args
+			}
+
+			var apiKeys []string
+			for _, apiKey := range auth.ApiKeys {
+				if value := apiKey.Value(); value != "" {
+					apiKeys = append(apiKeys, value)
+				}
+			}
+
+			args := make(map[string]interface{})
+			for key, val := range conditionArgs {
+				args[key] = val
+			}
+			args[authConditionKeyApiKeys] = apiKeys
+
+			isTrue, err := auth.Condition.IsTrue(args)
+			if err != nil {
+				return nil, errors.WithMessage(err, "failed to evaluate auth condition")
+			}
+
+			if isTrue {
+				info = &AuthInfo{Method: authMethodCondition}
+				goto afterAuth
+			}
+		}
 	}
 
 afterAuth:
 
-	if !found {
-		return errors.New("bad auth")
+	if info == nil {
+		return nil, badAuthErr
+	}
+
+	return info, nil
+}
+
+// authSecureCompare compares the provided value with the expected one in
+// constant time. Empty expected values never match, so that e.g. a missing
+// env var cannot end up accepting requests without any key.
+func authSecureCompare(provided string, expected string) bool {
+	if expected == "" {
+		return false
 	}
 
-	return nil
+	// Hashing both values makes the comparison independent of their lengths
+	providedHash := sha256.Sum256([]byte(provided))
+	expectedHash := sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare(providedHash[:], expectedHash[:]) == 1
 }
 
 func authHMACSHA256(data []byte, secret string) string {
@@ -0,0 +1,163 @@
+package pkg
+
+import (
+	"math"
+	"time"
+
+	"qvalet/pkg/utils"
+)
+
+const (
+	authBruteForceDefaultMaxFailures = 5
+	authBruteForceDefaultLockout     = 1 * time.Minute
+	authBruteForceDefaultMaxLockout  = 1 * time.Hour
+)
+
+// @formatter:off
+/// [auth-brute-force-docs]
+
+type AuthBruteForceConfig struct {
+	// How many consecutive failed authentication attempts are allowed
+	// for a single client IP, before the client gets locked out.
+	// Defaults to [authBruteForceDefaultMaxFailures].
+	MaxFailures int `mapstructure:"maxFailures" validate:"min=0"`
+
+	// How long the first lockout lasts. Every following lockout of the
+	// same client doubles this duration.
+	// Defaults to [authBruteForceDefaultLockout].
+	Lockout time.Duration `mapstructure:"lockout" validate:"min=0"`
+
+	// The maximum duration of a lockout. A client which stays quiet for this
+	// long is forgotten, and starts again from a clean state.
+	// Defaults to [authBruteForceDefaultMaxLockout].
+	MaxLockout time.Duration `mapstructure:"maxLockout" validate:"min=0"`
+}
+
+/// [auth-brute-force-docs]
+// @formatter:on
+
+func (config *AuthBruteForceConfig) maxFailures() int {
+	if config.MaxFailures > 0 {
+		return config.MaxFailures
+	}
+	return authBruteForceDefaultMaxFailures
+}
+
+func (config *AuthBruteForceConfig) lockout() time.Duration {
+	if config.Lockout > 0 {
+		return config.Lockout
+	}
+	return authBruteForceDefaultLockout
+}
+
+func (config *AuthBruteForceConfig) maxLockout() time.Duration {
+	if config.MaxLockout > 0 {
+		return config.MaxLockout
+	}
+	return authBruteForceDefaultMaxLockout
+}
+
+// Maximum number of client states kept by every guard, so that many spoofed or
+// rotating client IPs cannot exhaust the memory
+const authBruteForceMaxClients = 100000
+
+// We keep a global guards cache, keyed by config fingerprint, so that failure
+// counters survive config reloads. Guards which are not used for longer than
+// any lockout are forgotten.
+var authBruteForceGuards = utils.NewCache()
+
+func getAuthBruteForceGuard(config *AuthBruteForceConfig) *authBruteForceGuard {
+	key, err := configFingerprint(config)
+	if err != nil {
+		// Configs are plain values, so this can never happen
+		panic(err)
+	}
+
+	authBruteForceGuards.Lock()
+	defer authBruteForceGuards.Unlock()
+
+	guard, _ := authBruteForceGuards.Get(key).(*authBruteForceGuard)
+	if guard == nil {
+		guard = &authBruteForceGuard{
+			config: config,
+			state:  utils.NewCacheWithMaxEntries(authBruteForceMaxClients),
+		}
+	}
+
+	// Client states expire at most after a lockout plus the max lockout
+	authBruteForceGuards.SetWithDuration(key, guard, 2*config.maxLockout())
+	return guard
+}
+
+type authBruteForceState struct {
+	// Failures since the last lockout
+	failures int
+
+	// How many times this client has been locked out
+	lockouts int
+
+	lockedUntil time.Time
+}
+
+type authBruteForceGuard struct {
+	config *AuthBruteForceConfig
+
+	// Maps client IP -> *authBruteForceState
+	state *utils.Cache
+}
+
+// lockedFor returns how long the client still needs to wait before being
+// allowed to authenticate again, or zero if the client is not locked out
+func (guard *authBruteForceGuard) lockedFor(clientIP string, now time.Time) time.Duration {
+	guard.state.Lock()
+	defer guard.state.Unlock()
+
+	stateIntf := guard.state.Get(clientIP)
+	if stateIntf == nil {
+		return 0
+	}
+
+	state := stateIntf.(*authBruteForceState)
+	if now.Before(state.lockedUntil) {
+		return state.lockedUntil.Sub(now)
+	}
+
+	return 0
+}
+
+// recordFailure registers a failed authentication attempt, and returns the
+// lockout duration if this failure caused the client to be locked out
+func (guard *authBruteForceGuard) recordFailure(clientIP string, now time.Time) time.Duration {
+	guard.state.Lock()
+	defer guard.state.Unlock()
+
+	state := &authBruteForceState{}
+	if stateIntf := guard.state.Get(clientIP); stateIntf != nil {
+		state = stateIntf.(*authBruteForceState)
+	}
+
+	state.failures++
+
+	var lockout time.Duration
+	if state.failures >= guard.config.maxFailures() {
+		// Exponential lockout: every lockout doubles the previous one
+		multiplier := math.Pow(2, float64(state.lockouts))
+		lockout = time.Duration(math.Min(
+			float64(guard.config.lockout())*multiplier,
+			float64(guard.config.maxLockout()),
+		))
+
+		state.failures = 0
+		state.lockouts++
+		state.lockedUntil = now.Add(lockout)
+	}
+
+	// Forget about quiet clients after a while
+	guard.state.SetWithExpiry(clientIP, state, now.Add(lockout+guard.config.maxLockout()))
+
+	return lockout
+}
+
+func (guard *authBruteForceGuard) reset(clientIP string) {
+	guard.state.Delete(clientIP)
+}
@@ -0,0 +1,208 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"qvalet/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+const (
+	authOAuth2DefaultCacheTTL = 5 * time.Minute
+	authOAuth2DefaultTimeout  = 10 * time.Second
+)
+
+// @formatter:off
+/// [auth-oauth2-docs]
+
+type AuthOAuth2IntrospectionConfig struct {
+	// The RFC 7662 token introspection endpoint, e.g.
+	// https://auth.example.com/oauth2/introspect
+	Endpoint string `mapstructure:"endpoint" validate:"required,url"`
+
+	// If provided, qValet will authenticate against the introspection
+	// endpoint with HTTP basic auth, using these client credentials.
+	// The client secret supports the same syntax as api keys, e.g. `ENV{MY_SECRET}`
+	ClientId     string                  `mapstructure:"clientId"`
+	ClientSecret *utils.StringFromEnvVar `mapstructure:"clientSecret"`
+
+	// If provided, the token needs to have been granted ALL these scopes
+	RequiredScopes []string `mapstructure:"requiredScopes"`
+
+	// How long to cache valid tokens for. Tokens are never cached past
+	// their expiry. Defaults to [authOAuth2DefaultCacheTTL]
+	CacheTTL *time.Duration `mapstructure:"cacheTTL"`
+
+	// Timeout for the requests to the introspection endpoint.
+	// Defaults to [authOAuth2DefaultTimeout]
+	Timeout *time.Duration `mapstructure:"timeout"`
+}
+
+/// [auth-oauth2-docs]
+// @formatter:on
+
+func (config *AuthOAuth2IntrospectionConfig) cacheTTL() time.Duration {
+	if config.CacheTTL != nil {
+		return *config.CacheTTL
+	}
+	return authOAuth2DefaultCacheTTL
+}
+
+// RFC 7662, section 2.2
+type oauth2IntrospectionResponse struct {
+	Active   bool   `json:"active"`
+	Scope    string `json:"scope"`
+	ClientId string `json:"client_id"`
+	Username string `json:"username"`
+	Subject  string `json:"sub"`
+	Expiry   int64  `json:"exp"`
+}
+
+// Maximum number of valid tokens cached by every introspection config
+const authOAuth2MaxCachedTokens = 10000
+
+// We keep a global introspectors cache, keyed by config fingerprint, so that
+// every introspection config keeps its own tokens cache across config reloads.
+// Introspectors which are not used for longer than the cache TTL are forgotten.
+var authOAuth2Introspectors = utils.NewCache()
+
+func getOAuth2Introspector(config *AuthOAuth2IntrospectionConfig) *oauth2Introspector {
+	key, err := configFingerprint(config)
+	if err != nil {
+		// Configs are plain values, so this can never happen
+		panic(err)
+	}
+
+	authOAuth2Introspectors.Lock()
+	defer authOAuth2Introspectors.Unlock()
+
+	introspector, _ := authOAuth2Introspectors.Get(key).(*oauth2Introspector)
+	if introspector == nil {
+		timeout := authOAuth2DefaultTimeout
+		if config.Timeout != nil {
+			timeout = *config.Timeout
+		}
+
+		introspector = &oauth2Introspector{
+			config: config,
+			client: &http.Client{Timeout: timeout},
+			cache:  utils.NewCacheWithMaxEntries(authOAuth2MaxCachedTokens),
+		}
+	}
+
+	authOAuth2Introspectors.SetWithDuration(key, introspector, config.cacheTTL())
+	return introspector
+}
+
+type oauth2Introspector struct {
+	config *AuthOAuth2IntrospectionConfig
+	client *http.Client
+
+	// Maps token hash -> *AuthInfo, for positive results only
+	cache *utils.Cache
+}
+
+// Introspect validates the token, and returns nil if the token is
+// not active or does not have the required scopes
+func (i *oauth2Introspector) Introspect(token string) (*AuthInfo, error) {
+	// Do not keep raw tokens in memory
+	tokenHash := sha256.Sum256([]byte(token))
+	cacheKey := hex.EncodeToString(tokenHash[:])
+
+	if cached := i.cache.Get(cacheKey); cached != nil {
+		return cached.(*AuthInfo), nil
+	}
+
+	response, err := i.request(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if !response.Active {
+		return nil, nil
+	}
+
+	now := time.Now()
+	if response.Expiry > 0 && !time.Unix(response.Expiry, 0).After(now) {
+		return nil, nil
+	}
+
+	scopes := strings.Fields(response.Scope)
+	for _, required := range i.config.RequiredScopes {
+		if !utils.StringSliceContains(scopes, required) {
+			return nil, nil
+		}
+	}
+
+	info := &AuthInfo{
+		Method:   authMethodOAuth2,
+		Username: response.Username,
+		Subject:  response.Subject,
+		Scopes:   scopes,
+		ClientId: response.ClientId,
+	}
+
+	expiry := now.Add(i.config.cacheTTL())
+	if response.Expiry > 0 && time.Unix(response.Expiry, 0).Before(expiry) {
+		expiry = time.Unix(response.Expiry, 0)
+	}
+	i.cache.SetWithExpiry(cacheKey, info, expiry)
+
+	return info, nil
+}
+
+func (i *oauth2Introspector) request(token string) (*oauth2IntrospectionResponse, error) {
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+
+	req, err := http.NewRequest(http.MethodPost, i.config.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to create introspection request")
+	}
+	req.Header.Set("Content-Type", gin.MIMEPOSTForm)
+	req.Header.Set("Accept", gin.MIMEJSON)
+
+	if i.config.ClientId != "" {
+		clientSecret := ""
+		if i.config.ClientSecret != nil {
+			clientSecret = i.config.ClientSecret.Value()
+		}
+		req.SetBasicAuth(url.QueryEscape(i.config.ClientId), url.QueryEscape(clientSecret))
+	}
+
+	res, err := i.client.Do(req)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to call introspection endpoint")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("introspection endpoint returned status %d", res.StatusCode)
+	}
+
+	response := &oauth2IntrospectionResponse{}
+	if err := json.NewDecoder(res.Body).Decode(response); err != nil {
+		return nil, errors.WithMessage(err, "failed to decode introspection response")
+	}
+
+	return response, nil
+}
+
+func getBearerToken(c *gin.Context) (string, bool) {
+	header := c.GetHeader("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return "", false
+	}
+
+	token := strings.TrimSpace(header[7:])
+	return token, token != ""
+}
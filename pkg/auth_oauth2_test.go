@@ -0,0 +1,97 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"qvalet/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOAuth2Introspection(t *testing.T) {
+	var calls int32
+
+	// Local stand-in for the introspection endpoint
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+
+		clientId, clientSecret, ok := r.BasicAuth()
+		if !ok || clientId != "qv" || clientSecret != "clientSecret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		response := map[string]interface{}{"active": false}
+		switch r.PostFormValue("token") {
+		case "validToken":
+			response = map[string]interface{}{
+				"active":    true,
+				"scope":     "hooks:write hooks:read",
+				"sub":       "user-1",
+				"client_id": "platform",
+				"exp":       time.Now().Add(time.Hour).Unix(),
+			}
+		case "readOnlyToken":
+			response = map[string]interface{}{
+				"active": true,
+				"scope":  "hooks:read",
+				"sub":    "user-2",
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	authConfigs := []*AuthConfig{
+		{
+			OAuth2Introspection: &AuthOAuth2IntrospectionConfig{
+				Endpoint:       server.URL,
+				ClientId:       "qv",
+				ClientSecret:   utils.NewStringFromEnvVar("clientSecret"),
+				RequiredScopes: []string{"hooks:write"},
+			},
+		},
+	}
+	require.NoError(t, utils.Validate.Struct(authConfigs[0]))
+
+	verify := func(token string) (*AuthInfo, error) {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/hello", nil)
+		c.Request.Header.Set("Authorization", "Bearer "+token)
+		return verifyAuth(c, authConfigs)
+	}
+
+	info, err := verify("validToken")
+	require.NoError(t, err)
+	require.Equal(t, &AuthInfo{
+		Method:   authMethodOAuth2,
+		Subject:  "user-1",
+		Scopes:   []string{"hooks:write", "hooks:read"},
+		ClientId: "platform",
+	}, info)
+
+	// Positive results are cached
+	_, err = verify("validToken")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, atomic.LoadInt32(&calls))
+
+	// The cache survives config reloads
+	reloadedConfig := *authConfigs[0].OAuth2Introspection
+	require.Same(t, getOAuth2Introspector(authConfigs[0].OAuth2Introspection), getOAuth2Introspector(&reloadedConfig))
+
+	// Missing scopes
+	_, err = verify("readOnlyToken")
+	require.Error(t, err)
+
+	// Inactive token
+	_, err = verify("unknownToken")
+	require.Error(t, err)
+}
@@ -0,0 +1,159 @@
+package pkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"qvalet/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthBruteForceGuard(t *testing.T) {
+	guard := getAuthBruteForceGuard(&AuthBruteForceConfig{
+		MaxFailures: 2,
+		Lockout:     10 * time.Second,
+		MaxLockout:  30 * time.Second,
+	})
+
+	const ip = "10.0.0.1"
+	now := time.Now()
+
+	require.Zero(t, guard.recordFailure(ip, now))
+	require.Zero(t, guard.lockedFor(ip, now))
+
+	// Second failure locks the client out
+	require.Equal(t, 10*time.Second, guard.recordFailure(ip, now))
+	require.Equal(t, 10*time.Second, guard.lockedFor(ip, now))
+	require.Equal(t, 5*time.Second, guard.lockedFor(ip, now.Add(5*time.Second)))
+
+	// Other clients are not affected
+	require.Zero(t, guard.lockedFor("10.0.0.2", now))
+
+	// Lockouts grow exponentially, up to the max lockout
+	now = now.Add(10 * time.Second)
+	require.Zero(t, guard.lockedFor(ip, now))
+	require.Zero(t, guard.recordFailure(ip, now))
+	require.Equal(t, 20*time.Second, guard.recordFailure(ip, now))
+
+	now = now.Add(20 * time.Second)
+	require.Zero(t, guard.recordFailure(ip, now))
+	require.Equal(t, 30*time.Second, guard.recordFailure(ip, now))
+
+	// A successful authentication resets the client state
+	guard.reset(ip)
+	require.Zero(t, guard.lockedFor(ip, now))
+	require.Zero(t, guard.recordFailure(ip, now))
+}
+
+func TestAuthBruteForceGuardSurvivesReload(t *testing.T) {
+	guard := getAuthBruteForceGuard(&AuthBruteForceConfig{MaxFailures: 7})
+	require.Zero(t, guard.recordFailure("10.0.0.1", time.Now()))
+
+	// Reloaded configs are new instances, but with the same content
+	reloaded := getAuthBruteForceGuard(&AuthBruteForceConfig{MaxFailures: 7})
+	require.Same(t, guard, reloaded)
+	require.NotSame(t, guard, getAuthBruteForceGuard(&AuthBruteForceConfig{MaxFailures: 8}))
+}
+
+func TestAuthSecureCompare(t *testing.T) {
+	require.True(t, authSecureCompare("hello", "hello"))
+	require.False(t, authSecureCompare("hello", "hello2"))
+	require.False(t, authSecureCompare("", "hello"))
+
+	// Empty keys, e.g. coming from unset env vars, must never match
+	require.False(t, authSecureCompare("", ""))
+}
+
+func TestVerifyAuthCondition(t *testing.T) {
+	authConfigs := []*AuthConfig{
+		{
+			ApiKeys:   []*utils.StringFromEnvVar{utils.NewStringFromEnvVar("helloCondition")},
+			Condition: MustParseListenerIfTemplate("test", `has .token .__qvApiKeys`),
+		},
+	}
+
+	newContext := func(body string) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/auth/condition", strings.NewReader(body))
+		c.Request.Header.Set("Content-Type", gin.MIMEJSON)
+		return c
+	}
+
+	t.Run("valid token", func(t *testing.T) {
+		c := newContext(`{"token":"helloCondition"}`)
+		info, err := verifyAuth(c, authConfigs)
+		require.NoError(t, err)
+		require.Equal(t, authMethodCondition, info.Method)
+
+		// The body must still be readable after the auth check
+		args, err := utils.ExtractArgsFromGinContext(c)
+		require.NoError(t, err)
+		require.Equal(t, "helloCondition", args["token"])
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		c := newContext(`{"token":"helloConditionWrong"}`)
+		_, err := verifyAuth(c, authConfigs)
+		require.Error(t, err)
+
+		var badAuthErr *authError
+		require.ErrorAs(t, err, &badAuthErr)
+		require.Equal(t, []string{authMethodCondition}, badAuthErr.methods)
+	})
+}
+
+func TestAuthBruteForceTrustedProxies(t *testing.T) {
+	dir := t.TempDir()
+	direct := filepath.Join(dir, "direct.yaml")
+	writeTestServerConfig(t, direct, `
+port: 17065
+authBruteForce:
+  maxFailures: 1
+  lockout: 1h
+listeners:
+  /hello:
+    command: "true"
+    auth:
+      - apiKeys: [ mySecret ]
+`)
+	proxied := filepath.Join(dir, "proxied.yaml")
+	writeTestServerConfig(t, proxied, `
+port: 17066
+trustedProxies: [ 192.0.2.0/24 ]
+authBruteForce:
+  maxFailures: 1
+  lockout: 1h
+listeners:
+  /hello:
+    command: "true"
+    auth:
+      - apiKeys: [ mySecret ]
+`)
+
+	s, err := NewServer(ServerOptions{ConfigFilenames: []string{direct, proxied}})
+	require.NoError(t, err)
+
+	serve := func(address string, forwardedFor string) int {
+		w := httptest.NewRecorder()
+		// httptest requests come from 192.0.2.1
+		req := httptest.NewRequest(http.MethodGet, "/hello?__qvApiKey=wrong", nil)
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		s.Handler(address).ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Without trusted proxies, the forwarded IP cannot be used to skip the lockout
+	require.Equal(t, http.StatusUnauthorized, serve(":17065", "10.0.0.1"))
+	require.Equal(t, http.StatusTooManyRequests, serve(":17065", "10.0.0.2"))
+
+	// Trusted proxies forward the real client IP
+	require.Equal(t, http.StatusUnauthorized, serve(":17066", "10.0.0.1"))
+	require.Equal(t, http.StatusUnauthorized, serve(":17066", "10.0.0.2"))
+	require.Equal(t, http.StatusTooManyRequests, serve(":17066", "10.0.0.1"))
+}
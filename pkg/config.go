@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"reflect"
 	"strings"
 
 	"qvalet/pkg/utils"
@@ -29,15 +30,82 @@ type Config struct {
 	// will be spawn, each on the defined port.
 	Port int `mapstructure:"port" validate:"min=0,max=65535"`
 
+	// If defined, qValet listens on this Unix socket instead of a TCP port,
+	// e.g. when only exposed to a local reverse proxy.
+	UnixSocket *UnixSocketConfig `mapstructure:"unixSocket" validate:"excluded_with=SystemdSocket"`
+
+	// If defined, qValet uses the socket passed by systemd socket activation
+	// with this name (see `FileDescriptorName=`), instead of a TCP port.
+	// Sockets without a name are called `unknown`.
+	SystemdSocket string `mapstructure:"systemdSocket"`
+
 	// Map of route -> listener
 	Listeners map[string]*ListenerConfig `mapstructure:"listeners" validate:"-"`
 
+	// Glob patterns of files to include, relative to this file, e.g. `hooks/*.yaml`.
+	// Included files can only define `listeners`, `bases` and other `include` entries.
+	Include []string `mapstructure:"include"`
+
+	// Map of name -> reusable listener config, which listeners can inherit via `extends`
+	Bases map[string]*ListenerConfig `mapstructure:"bases" validate:"-"`
+
+	// Map of route prefix -> group of listeners, which share the prefix and the group defaults
+	Groups map[string]*ListenerGroupConfig `mapstructure:"groups" validate:"-"`
+
+	// If defined, prefixes the routes of all the listeners of this config, including the
+	// included and grouped ones, e.g. `/team-a`
+	BasePath string `mapstructure:"basePath" validate:"omitempty,startswith=/"`
+
 	// Holds default configs valid for all listeners in this config.
 	// Values defined in each listener will overwrite the default ones.
 	Defaults ListenerConfig `mapstructure:"defaults" validate:"-"`
+
+	// If defined, enables brute-force protection for all auth configs of
+	// this config's listeners, unless they define their own `bruteForce` entry.
+	AuthBruteForce *AuthBruteForceConfig `mapstructure:"authBruteForce"`
+
+	// IPs or CIDRs of the reverse proxies in front of qValet, e.g. `10.0.0.0/8`.
+	// Only requests coming from these proxies can set the client IP via the
+	// `X-Forwarded-For` and `X-Real-IP` headers, which is used e.g. by the auth
+	// brute-force protection. Defaults to no proxies, so the client IP is always
+	// the address of the connection.
+	//
+	// NOTE: if multiple config files share the same port or socket, they all need
+	// to either omit this entry, or define the same one.
+	TrustedProxies []string `mapstructure:"trustedProxies" validate:"dive,ip|cidr"`
+
+	// If defined, qValet will serve HTTPS on this config's port or socket.
+	//
+	// NOTE: if multiple config files share the same port or socket, they all need
+	// to either omit this entry, or define the same one.
+	TLS *TLSConfig `mapstructure:"tls"`
+
+	// If defined, mounts the admin API on this config's port
+	Admin *AdminConfig `mapstructure:"admin"`
+
+	// If defined, exposes Prometheus metrics
+	Metrics *MetricsConfig `mapstructure:"metrics"`
+
+	// Format and destination of the logs.
+	//
+	// NOTE: logging is process-wide, so if multiple config files define
+	// this entry, they all need to define the same one.
+	Logging *LoggingConfig `mapstructure:"logging"`
+
+	// Absolute include patterns, also of nested includes, used to watch the included files
+	includePatterns []string
+
+	// File this config was loaded from, and files which defined the included or grouped
+	// listeners, to report route conflicts
+	filename      string
+	listenerFiles map[string]string
 }
 
 type ListenerConfig struct {
+	// Names of the bases to inherit from, merged in order. The listener entries override
+	// the bases ones, which override the defaults ones.
+	Extends []string `mapstructure:"extends"`
+
 	// Command to run
 	Command *ListenerTemplate `mapstructure:"command" validate:"required"`
 
@@ -69,6 +137,10 @@ type ListenerConfig struct {
 	// - storage: log every stored entry details
 	Log []LogKey `mapstructure:"log" validate:"dive,listenerLogKey"`
 
+	// If defined, overrides the global log level for this listener only, e.g. to
+	// debug a single listener. One of: trace, debug, info, warn, error
+	LogLevel string `mapstructure:"logLevel" validate:"omitempty,oneof=trace debug info warn error"`
+
 	// What to return in the HTTP response? Can be a comma-separated mix of:
 	// - all: return everything
 	// - args: return the request's args
@@ -90,6 +162,13 @@ type ListenerConfig struct {
 
 	// Database connection configuration, to be used by any plugins that require one
 	Database *DatabaseConfig `mapstructure:"database"`
+
+	// Which sensitive values to mask in logs, responses and stored payloads.
+	// Values equal to any of the listener api keys are always masked.
+	Redact *RedactConfig `mapstructure:"redact"`
+
+	// Test cases run by `qvalet test`. Not inherited from the defaults.
+	Tests []*ListenerTestConfig `mapstructure:"tests" validate:"dive,required" json:"-"`
 }
 
 /// [config-docs]
@@ -202,14 +281,19 @@ func init() {
 }
 
 func MergeListenerConfig(defaults *ListenerConfig, listenerConfig *ListenerConfig) (*ListenerConfig, error) {
-	// Merge with the defaults
+	// Merge with the defaults, which must not be altered, as they are shared by many listeners
+	defaultsCopy := *defaults
+	mergoCopyPointedStructs(reflect.ValueOf(&defaultsCopy).Elem())
+
 	mergedConfig := &ListenerConfig{}
-	if err := mergo.Merge(mergedConfig, defaults, mergo.WithOverride, mergo.WithTransformers(MergoTransformerCustomInstance)); err != nil {
+	if err := mergo.Merge(mergedConfig, &defaultsCopy, mergo.WithOverride, mergo.WithTransformers(MergoTransformerCustomInstance)); err != nil {
 		return nil, errors.WithMessage(err, "failed to merge defaults config")
 	}
 	if err := mergo.Merge(mergedConfig, listenerConfig, mergo.WithOverride, mergo.WithTransformers(MergoTransformerCustomInstance)); err != nil {
 		return nil, errors.WithMessage(err, "failed to merge overriding listener config")
 	}
+	// Tests belong only to the listener defining them
+	mergedConfig.Tests = listenerConfig.Tests
 	return mergedConfig, nil
 }
 
@@ -233,7 +317,7 @@ func init() {
 	spew.Config.DisableCapacities = true
 }
 
-func MustLoadConfigs(filenames ...string) map[int][]*Config {
+func MustLoadConfigs(filenames ...string) map[string][]*Config {
 	var toMerge []*Config
 
 	for _, filename := range filenames {
@@ -244,29 +328,48 @@ func MustLoadConfigs(filenames ...string) map[int][]*Config {
 		toMerge = append(toMerge, subConfig)
 	}
 
-	configsByPort, err := groupConfigsByPort(toMerge...)
+	configsByAddress, err := groupConfigsByAddress(toMerge...)
 	if err != nil {
 		logrus.WithError(err).Fatalf("failed to merge configs")
 	}
 
-	return configsByPort
+	return configsByAddress
 }
 
-func groupConfigsByPort(configs ...*Config) (map[int][]*Config, error) {
-	ret := make(map[int][]*Config)
+func groupConfigsByAddress(configs ...*Config) (map[string][]*Config, error) {
+	ret := make(map[string][]*Config)
 
-	// We want to merge configs by port
+	// We want to merge configs by listen address
 	for _, config := range configs {
-		ret[config.Port] = append(ret[config.Port], config)
+		address := config.ListenAddress()
+		ret[address] = append(ret[address], config)
+	}
+
+	for address, addressConfigs := range ret {
+		for _, config := range addressConfigs[1:] {
+			// An address can be served either via plain HTTP or via TLS, never both
+			if !reflect.DeepEqual(config.TLS, addressConfigs[0].TLS) {
+				return nil, errors.Errorf("all configs using address %s must share the same TLS config", address)
+			}
+			if !reflect.DeepEqual(config.UnixSocket, addressConfigs[0].UnixSocket) {
+				return nil, errors.Errorf("all configs using socket %s must share the same socket config", address)
+			}
+			if !reflect.DeepEqual(config.TrustedProxies, addressConfigs[0].TrustedProxies) {
+				return nil, errors.Errorf("all configs using address %s must share the same trusted proxies", address)
+			}
+		}
 	}
 
 	return ret, nil
 }
 
 func LoadConfig(filename string) (*Config, error) {
-	myViper := readConfigToViper("QV", filename, "config")
+	myViper, err := readConfigToViper("QV", filename, "config")
+	if err != nil {
+		return nil, err
+	}
 
-	config := new(Config)
+	config := &Config{filename: filename}
 
 	if err := myViper.Unmarshal(config,
 		// Lets us decode custom configuration types
@@ -275,6 +378,20 @@ func LoadConfig(filename string) (*Config, error) {
 		return nil, errors.WithMessage(err, "failed to unmarshal config")
 	}
 
+	if err := config.loadIncludes(filename); err != nil {
+		return nil, err
+	}
+
+	if err := config.resolveBases(); err != nil {
+		return nil, err
+	}
+
+	if err := config.flattenGroups(); err != nil {
+		return nil, err
+	}
+
+	config.applyBasePath()
+
 	// Apply defaults
 	if config.Port == 0 {
 		config.Port = 7055
@@ -295,7 +412,10 @@ func LoadConfig(filename string) (*Config, error) {
 }
 
 func LoadDefaults(filename string) (*ListenerConfig, error) {
-	myViper := readConfigToViper("QV_DEFAULTS", filename, "defaults")
+	myViper, err := readConfigToViper("QV_DEFAULTS", filename, "defaults")
+	if err != nil {
+		return nil, err
+	}
 
 	config := new(ListenerConfig)
 
@@ -309,40 +429,50 @@ func LoadDefaults(filename string) (*ListenerConfig, error) {
 	return config, nil
 }
 
-func readConfigToViper(envPrefix string, filename string, defaultFilename string) *viper.Viper {
+func readConfigToViper(envPrefix string, filename string, defaultFilename string) (*viper.Viper, error) {
 	// If we got a stdin config, store it in a tmp file and then use
 	// the tmp file as source
 	if filename == "-" {
-		tmp, err := os.CreateTemp("", fmt.Sprintf("qv-%s-*.yaml", defaultFilename))
+		tmpFilename, err := StdinConfigToTempFile(defaultFilename)
 		if err != nil {
-			logrus.WithError(err).Fatalf("failed to create temporary file")
+			return nil, err
 		}
+		filename = tmpFilename
+	}
 
-		content, err := readStdin()
-		if err != nil {
-			logrus.WithError(err).Fatalf("failed to read stdin for config")
-		}
+	myViper := getViper(envPrefix, filename, defaultFilename)
 
-		if err := os.WriteFile(tmp.Name(), []byte(content), 0444); err != nil {
-			logrus.WithError(err).Fatalf("failed to store stdin config to temporary file")
-		}
+	if err := myViper.ReadInConfig(); err != nil {
+		return nil, errors.WithMessage(err, "failed to load config")
+	}
+	return myViper, nil
+}
 
-		if logrus.IsLevelEnabled(logrus.DebugLevel) {
-			logrus.WithField("content", content).Debug("using config from stdin")
-		} else {
-			logrus.Info("using config from stdin")
-		}
+// StdinConfigToTempFile stores the config provided via stdin in a temporary
+// file, so that it can be read multiple times, e.g. on reload
+func StdinConfigToTempFile(defaultFilename string) (string, error) {
+	tmp, err := os.CreateTemp("", fmt.Sprintf("qv-%s-*.yaml", defaultFilename))
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to create temporary file")
+	}
+	defer tmp.Close()
 
-		filename = tmp.Name()
+	content, err := readStdin()
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to read stdin for config")
 	}
 
-	myViper := getViper(envPrefix, filename, defaultFilename)
+	if err := os.WriteFile(tmp.Name(), []byte(content), 0444); err != nil {
+		return "", errors.WithMessage(err, "failed to store stdin config to temporary file")
+	}
 
-	err := myViper.ReadInConfig()
-	if err != nil {
-		logrus.WithError(err).Fatalf("failed to load config")
+	if logrus.IsLevelEnabled(logrus.DebugLevel) {
+		logrus.WithField("content", content).Debug("using config from stdin")
+	} else {
+		logrus.Info("using config from stdin")
 	}
-	return myViper
+
+	return tmp.Name(), nil
 }
 
 func getViper(envPrefix string, filename string, defaultName string) *viper.Viper {
@@ -0,0 +1,153 @@
+package pkg
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// @formatter:off
+/// [group-docs]
+type ListenerGroupConfig struct {
+	// Default configs of the group listeners, which override the config
+	// defaults and the ones of the parent groups
+	Defaults ListenerConfig `mapstructure:"defaults" validate:"-"`
+
+	// Map of route -> listener, where routes are relative to the group prefix
+	Listeners map[string]*ListenerConfig `mapstructure:"listeners" validate:"-"`
+
+	// Nested groups, as route prefix -> group
+	Groups map[string]*ListenerGroupConfig `mapstructure:"groups" validate:"-"`
+
+	// Set for groups defined in included files
+	filename string
+}
+
+/// [group-docs]
+// @formatter:on
+
+// listenerFile returns the file which defined the listener
+func (config *Config) listenerFile(route string) string {
+	if file, found := config.listenerFiles[route]; found {
+		return file
+	}
+	return config.filename
+}
+
+func (config *Config) setListenerFile(route string, file string) {
+	if config.listenerFiles == nil {
+		config.listenerFiles = make(map[string]string)
+	}
+	config.listenerFiles[route] = file
+}
+
+// joinRoutes appends the route to the prefix, e.g. `/api` + `/users` = `/api/users`
+func joinRoutes(prefix string, route string) string {
+	if !strings.HasPrefix(route, "/") {
+		route = "/" + route
+	}
+	return strings.TrimSuffix(prefix, "/") + route
+}
+
+// flattenGroups moves the listeners of all groups into the config listeners, with
+// their full routes, merged with the groups defaults
+func (config *Config) flattenGroups() error {
+	var prefixes []string
+	for prefix := range config.Groups {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	for _, prefix := range prefixes {
+		group := config.Groups[prefix]
+		file := config.filename
+		if group != nil && group.filename != "" {
+			file = group.filename
+		}
+		if err := config.flattenGroup(prefix, group, nil, file); err != nil {
+			return errors.WithMessagef(err, "failed to load group %s", prefix)
+		}
+	}
+
+	return nil
+}
+
+func (config *Config) flattenGroup(prefix string, group *ListenerGroupConfig, parentDefaults *ListenerConfig, file string) error {
+	if !strings.HasPrefix(prefix, "/") {
+		return errors.Errorf("group prefix %s must start with /", prefix)
+	}
+	if group == nil {
+		return nil
+	}
+
+	// Group defaults can extend bases too
+	defaults, err := config.resolveListenerBases(&group.Defaults, nil)
+	if err != nil {
+		return errors.WithMessage(err, "failed to resolve bases of group defaults")
+	}
+	if parentDefaults != nil {
+		defaults, err = MergeListenerConfig(parentDefaults, defaults)
+		if err != nil {
+			return errors.WithMessage(err, "failed to merge group defaults with the parent ones")
+		}
+	}
+
+	if config.Listeners == nil {
+		config.Listeners = make(map[string]*ListenerConfig)
+	}
+
+	for route, listenerConfig := range group.Listeners {
+		fullRoute := joinRoutes(prefix, route)
+		if _, found := config.Listeners[fullRoute]; found {
+			return errors.Errorf("listener %s is defined in both %s and %s", fullRoute, config.listenerFile(fullRoute), file)
+		}
+
+		resolved, err := config.resolveListenerBases(listenerConfig, nil)
+		if err != nil {
+			return errors.WithMessagef(err, "failed to resolve bases of listener %s", fullRoute)
+		}
+		if resolved == nil {
+			resolved = &ListenerConfig{}
+		}
+
+		merged, err := MergeListenerConfig(defaults, resolved)
+		if err != nil {
+			return errors.WithMessagef(err, "failed to merge listener %s with the group defaults", fullRoute)
+		}
+
+		config.Listeners[fullRoute] = merged
+		config.setListenerFile(fullRoute, file)
+	}
+
+	var childPrefixes []string
+	for childPrefix := range group.Groups {
+		childPrefixes = append(childPrefixes, childPrefix)
+	}
+	sort.Strings(childPrefixes)
+
+	for _, childPrefix := range childPrefixes {
+		if err := config.flattenGroup(joinRoutes(prefix, childPrefix), group.Groups[childPrefix], defaults, file); err != nil {
+			return errors.WithMessagef(err, "failed to load group %s", childPrefix)
+		}
+	}
+
+	return nil
+}
+
+// applyBasePath prefixes all the listener routes with the base path
+func (config *Config) applyBasePath() {
+	if config.BasePath == "" {
+		return
+	}
+
+	listeners := make(map[string]*ListenerConfig)
+	listenerFiles := make(map[string]string)
+	for route, listenerConfig := range config.Listeners {
+		fullRoute := joinRoutes(config.BasePath, route)
+		listeners[fullRoute] = listenerConfig
+		listenerFiles[fullRoute] = config.listenerFile(route)
+	}
+	config.Listeners = listeners
+	config.listenerFiles = listenerFiles
+}
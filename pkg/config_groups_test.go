@@ -0,0 +1,115 @@
+package pkg
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfigGroups(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestServerConfig(t, filename, `
+basePath: /team-a
+defaults:
+  methods: [ GET ]
+bases:
+  secret:
+    auth:
+      - apiKeys: [ secret ]
+listeners:
+  /root:
+    command: "true"
+groups:
+  /github:
+    defaults:
+      extends: secret
+      methods: [ POST ]
+      command: echo
+    listeners:
+      /deploy:
+        args: [ deploy ]
+    groups:
+      /v2:
+        defaults:
+          args: [ v2 ]
+        listeners:
+          /:
+            command: "true"
+          /docs:
+            log: [ output ]
+`)
+
+	config, err := LoadConfig(filename)
+	require.NoError(t, err)
+
+	var routes []string
+	for route := range config.Listeners {
+		routes = append(routes, route)
+	}
+	require.ElementsMatch(t, []string{"/team-a/root", "/team-a/github/deploy", "/team-a/github/v2/", "/team-a/github/v2/docs"}, routes)
+
+	deploy := config.Listeners["/team-a/github/deploy"]
+	require.Equal(t, "echo", deploy.Command.originalText)
+	require.Equal(t, "deploy", deploy.Args[0].originalText)
+	require.Equal(t, []string{http.MethodPost}, deploy.Methods)
+	require.Len(t, deploy.Auth, 1)
+
+	// Nested groups inherit the parent defaults
+	docs := config.Listeners["/team-a/github/v2/docs"]
+	require.Equal(t, "echo", docs.Command.originalText)
+	require.Equal(t, "v2", docs.Args[0].originalText)
+	require.Len(t, docs.Auth, 1)
+	require.Equal(t, "true", config.Listeners["/team-a/github/v2/"].Command.originalText)
+
+	// The config defaults are still merged last
+	require.Nil(t, config.Listeners["/team-a/root"].Methods)
+
+	writeTestServerConfig(t, filename, `
+listeners:
+  /github/deploy:
+    command: "true"
+groups:
+  /github:
+    listeners:
+      /deploy:
+        command: "true"
+`)
+	_, err = LoadConfig(filename)
+	require.ErrorContains(t, err, "listener /github/deploy is defined in both")
+}
+
+func TestServerRouteConflicts(t *testing.T) {
+	dir := t.TempDir()
+
+	first := filepath.Join(dir, "first.yaml")
+	writeTestServerConfig(t, first, `
+port: 17060
+listeners:
+  /users/:id:
+    command: "true"
+`)
+	second := filepath.Join(dir, "second.yaml")
+	writeTestServerConfig(t, second, `
+port: 17060
+groups:
+  /users:
+    listeners:
+      /:name:
+        command: "true"
+`)
+
+	_, err := NewServer(ServerOptions{ConfigFilenames: []string{first, second}})
+	require.EqualError(t, err, "route conflict on :17060: GET /users/:name in "+second+" conflicts with /users/:id in "+first)
+
+	writeTestServerConfig(t, second, `
+port: 17060
+basePath: /users
+listeners:
+  /:id:
+    command: "true"
+`)
+	_, err = NewServer(ServerOptions{ConfigFilenames: []string{first, second}})
+	require.EqualError(t, err, "route conflict on :17060: GET /users/:id is defined in both "+first+" and "+second)
+}
@@ -0,0 +1,237 @@
+package pkg
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Entries which can be defined in included files
+var configIncludeAllowedKeys = map[string]bool{
+	"include":   true,
+	"listeners": true,
+	"bases":     true,
+	"groups":    true,
+}
+
+type configIncluder struct {
+	config *Config
+
+	// Absolute paths of the files already loaded, to include every file only once
+	visited map[string]bool
+
+	// Maps route, base name or group prefix -> file which defined it, to report conflicts
+	listenerFiles map[string]string
+	baseFiles     map[string]string
+	groupFiles    map[string]string
+}
+
+// loadIncludes merges the listeners, bases and groups of the included files, recursively
+func (config *Config) loadIncludes(filename string) error {
+	if len(config.Include) == 0 {
+		return nil
+	}
+
+	includer := &configIncluder{
+		config:        config,
+		visited:       make(map[string]bool),
+		listenerFiles: make(map[string]string),
+		baseFiles:     make(map[string]string),
+		groupFiles:    make(map[string]string),
+	}
+
+	// Configs read from stdin include files relative to the working directory
+	if filename == "" || filename == "-" {
+		filename = "config.yaml"
+	}
+	if abs, err := filepath.Abs(filename); err == nil {
+		includer.visited[abs] = true
+	}
+
+	for route := range config.Listeners {
+		includer.listenerFiles[route] = filename
+	}
+	for name := range config.Bases {
+		includer.baseFiles[name] = filename
+	}
+	for prefix := range config.Groups {
+		includer.groupFiles[prefix] = filename
+	}
+
+	if err := includer.include(filename, config.Include); err != nil {
+		return err
+	}
+
+	config.listenerFiles = includer.listenerFiles
+	for prefix, file := range includer.groupFiles {
+		if group := config.Groups[prefix]; group != nil {
+			group.filename = file
+		}
+	}
+	return nil
+}
+
+func (i *configIncluder) include(filename string, patterns []string) error {
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(filename), pattern)
+		}
+		if abs, err := filepath.Abs(pattern); err == nil {
+			pattern = abs
+		}
+		i.config.includePatterns = append(i.config.includePatterns, pattern)
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return errors.WithMessagef(err, "invalid include pattern %s", pattern)
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return errors.Errorf("included file %s not found", pattern)
+		}
+
+		for _, match := range matches {
+			if i.visited[match] {
+				continue
+			}
+			i.visited[match] = true
+
+			fragment, err := loadConfigFragment(match)
+			if err != nil {
+				return errors.WithMessagef(err, "failed to load included file %s", match)
+			}
+
+			if i.config.Listeners == nil {
+				i.config.Listeners = make(map[string]*ListenerConfig)
+			}
+			for route, listenerConfig := range fragment.Listeners {
+				if other, found := i.listenerFiles[route]; found {
+					return errors.Errorf("listener %s is defined in both %s and %s", route, other, match)
+				}
+				i.config.Listeners[route] = listenerConfig
+				i.listenerFiles[route] = match
+			}
+
+			if i.config.Bases == nil {
+				i.config.Bases = make(map[string]*ListenerConfig)
+			}
+			for name, base := range fragment.Bases {
+				if other, found := i.baseFiles[name]; found {
+					return errors.Errorf("base %s is defined in both %s and %s", name, other, match)
+				}
+				i.config.Bases[name] = base
+				i.baseFiles[name] = match
+			}
+
+			if i.config.Groups == nil {
+				i.config.Groups = make(map[string]*ListenerGroupConfig)
+			}
+			for prefix, group := range fragment.Groups {
+				if other, found := i.groupFiles[prefix]; found {
+					return errors.Errorf("group %s is defined in both %s and %s", prefix, other, match)
+				}
+				i.config.Groups[prefix] = group
+				i.groupFiles[prefix] = match
+			}
+
+			if err := i.include(match, fragment.Include); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func loadConfigFragment(filename string) (*Config, error) {
+	myViper, err := readConfigToViper("QV", filename, "config")
+	if err != nil {
+		return nil, err
+	}
+
+	for key := range myViper.AllSettings() {
+		if !configIncludeAllowedKeys[key] {
+			return nil, errors.Errorf("entry %s is not supported in included files, only include, listeners, bases and groups are", key)
+		}
+	}
+
+	fragment := new(Config)
+	if err := myViper.Unmarshal(fragment,
+		// Lets us decode custom configuration types
+		viper.DecodeHook(defaultDecodeHook),
+	); err != nil {
+		return nil, errors.WithMessage(err, "failed to unmarshal config")
+	}
+	return fragment, nil
+}
+
+// resolveBases merges into every listener the bases it extends
+func (config *Config) resolveBases() error {
+	for route, listenerConfig := range config.Listeners {
+		resolved, err := config.resolveListenerBases(listenerConfig, nil)
+		if err != nil {
+			return errors.WithMessagef(err, "failed to resolve bases of listener %s", route)
+		}
+		config.Listeners[route] = resolved
+	}
+	return nil
+}
+
+// Returns the listener config merged with its bases, without altering it. The chain
+// holds the bases being resolved, to detect cycles.
+func (config *Config) resolveListenerBases(listenerConfig *ListenerConfig, chain []string) (*ListenerConfig, error) {
+	if listenerConfig == nil {
+		return nil, nil
+	}
+
+	resolved := listenerConfig
+	if len(listenerConfig.Extends) > 0 {
+		merged := &ListenerConfig{}
+		for _, name := range listenerConfig.Extends {
+			baseChain := append(append([]string{}, chain...), name)
+			for _, previous := range chain {
+				if previous == name {
+					return nil, errors.Errorf("bases cycle: %s", strings.Join(baseChain, " -> "))
+				}
+			}
+
+			base, found := config.Bases[name]
+			if !found {
+				return nil, errors.Errorf("base %s not found", name)
+			}
+
+			resolvedBase, err := config.resolveListenerBases(base, baseChain)
+			if err != nil {
+				return nil, err
+			}
+
+			merged, err = MergeListenerConfig(merged, resolvedBase)
+			if err != nil {
+				return nil, errors.WithMessagef(err, "failed to merge base %s", name)
+			}
+		}
+
+		var err error
+		resolved, err = MergeListenerConfig(merged, listenerConfig)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to merge listener config with its bases")
+		}
+		resolved.Extends = nil
+	}
+
+	// Error handlers can extend bases too
+	if resolved.ErrorHandler != nil && len(resolved.ErrorHandler.Extends) > 0 {
+		errorHandler, err := config.resolveListenerBases(resolved.ErrorHandler, nil)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to resolve bases of error handler")
+		}
+		if resolved == listenerConfig {
+			resolvedCopy := *resolved
+			resolved = &resolvedCopy
+		}
+		resolved.ErrorHandler = errorHandler
+	}
+
+	return resolved, nil
+}
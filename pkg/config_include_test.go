@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfigIncludes(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "hooks"), 0700))
+
+	filename := filepath.Join(dir, "config.yaml")
+	writeTestServerConfig(t, filename, `
+include: [ hooks/*.yaml ]
+listeners:
+  /main:
+    command: "true"
+`)
+	writeTestServerConfig(t, filepath.Join(dir, "hooks", "a.yaml"), `
+include: [ ../shared.yaml ]
+listeners:
+  /a:
+    extends: [ hook ]
+`)
+	writeTestServerConfig(t, filepath.Join(dir, "hooks", "b.yaml"), `
+listeners:
+  /b:
+    extends: hook
+    args: [ b ]
+`)
+	writeTestServerConfig(t, filepath.Join(dir, "shared.yaml"), `
+bases:
+  hook:
+    command: echo
+    args: [ shared ]
+    methods: [ POST ]
+`)
+
+	config, err := LoadConfig(filename)
+	require.NoError(t, err)
+	require.Len(t, config.Listeners, 3)
+	require.Equal(t, "echo", config.Listeners["/a"].Command.originalText)
+	require.Equal(t, "shared", config.Listeners["/a"].Args[0].originalText)
+	require.Equal(t, "b", config.Listeners["/b"].Args[0].originalText)
+	require.Equal(t, []string{"POST"}, config.Listeners["/b"].Methods)
+	require.Nil(t, config.Listeners["/b"].Extends)
+	require.Len(t, config.includePatterns, 2)
+
+	// Conflicts report both files
+	writeTestServerConfig(t, filepath.Join(dir, "hooks", "c.yaml"), `
+listeners:
+  /main:
+    command: "true"
+`)
+	_, err = LoadConfig(filename)
+	require.ErrorContains(t, err, "listener /main is defined in both "+filename+" and "+filepath.Join(dir, "hooks", "c.yaml"))
+
+	// Included files cannot define anything else
+	writeTestServerConfig(t, filepath.Join(dir, "hooks", "c.yaml"), `
+port: 8080
+`)
+	_, err = LoadConfig(filename)
+	require.ErrorContains(t, err, "entry port is not supported in included files")
+	require.NoError(t, os.Remove(filepath.Join(dir, "hooks", "c.yaml")))
+
+	// Missing files are reported, unless matched by globs
+	writeTestServerConfig(t, filename, `
+include: [ missing.yaml, hooks/*.missing ]
+`)
+	_, err = LoadConfig(filename)
+	require.ErrorContains(t, err, "included file "+filepath.Join(dir, "missing.yaml")+" not found")
+}
+
+func TestLoadConfigBases(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestServerConfig(t, filename, `
+defaults:
+  return: [ output ]
+bases:
+  github:
+    auth:
+      - apiKeys: [ secret ]
+    storage:
+      conn: fs:///tmp/
+      store: [ all ]
+    errorHandler:
+      extends: notify
+  notify:
+    command: notify
+  deploy:
+    extends: github
+    command: deploy
+listeners:
+  /deploy:
+    extends: deploy
+    storage:
+      store: [ output ]
+  /other:
+    extends: github
+    command: other
+`)
+
+	config, err := LoadConfig(filename)
+	require.NoError(t, err)
+
+	deploy := config.Listeners["/deploy"]
+	require.Equal(t, "deploy", deploy.Command.originalText)
+	require.Equal(t, "notify", deploy.ErrorHandler.Command.originalText)
+	require.Equal(t, "fs:///tmp/", deploy.Storage.Conn)
+	require.Equal(t, []StoreKey{StoreKeyOutput}, deploy.Storage.Store)
+	require.Len(t, deploy.Auth, 1)
+
+	// Bases are not altered by the listeners extending them
+	other := config.Listeners["/other"]
+	require.Equal(t, []StoreKey{StoreKeyAll}, other.Storage.Store)
+	require.Equal(t, []StoreKey{StoreKeyAll}, config.Bases["github"].Storage.Store)
+
+	// Defaults are still applied
+	merged, err := MergeListenerConfig(&config.Defaults, deploy)
+	require.NoError(t, err)
+	require.Equal(t, []ReturnKey{ReturnKeyOutput}, merged.Return)
+
+	writeTestServerConfig(t, filename, `
+bases:
+  a:
+    extends: b
+  b:
+    extends: a
+listeners:
+  /hello:
+    extends: a
+`)
+	_, err = LoadConfig(filename)
+	require.ErrorContains(t, err, "bases cycle: a -> b -> a")
+
+	writeTestServerConfig(t, filename, `
+listeners:
+  /hello:
+    extends: missing
+`)
+	_, err = LoadConfig(filename)
+	require.ErrorContains(t, err, "base missing not found")
+}
@@ -35,6 +35,8 @@ func TestMergeListenerConfig(t *testing.T) {
 		// Log key overwrite
 		{ListenerConfig{Log: []LogKey{LogKeyArgs, LogKeyOutput}}, ListenerConfig{Log: []LogKey{LogKeyArgs, LogKeyOutput}}, ListenerConfig{}},
 		{ListenerConfig{Log: []LogKey{LogKeyAll}}, ListenerConfig{Log: []LogKey{LogKeyArgs, LogKeyOutput}}, ListenerConfig{Log: []LogKey{LogKeyAll}}},
+		// Tests are never inherited
+		{ListenerConfig{}, ListenerConfig{Tests: []*ListenerTestConfig{{Name: "a"}}}, ListenerConfig{}},
 	}
 
 	for idx, test := range tests {
@@ -42,4 +44,49 @@ func TestMergeListenerConfig(t *testing.T) {
 		require.NoError(t, err)
 		require.EqualValuesf(t, test.exp, *merged, "test %d", idx)
 	}
+
+	// Nested structs of the defaults are not altered
+	defaults := &ListenerConfig{Storage: &StorageConfig{Conn: "fs:///tmp/"}}
+	merged, err := MergeListenerConfig(defaults, &ListenerConfig{Storage: &StorageConfig{Store: []StoreKey{StoreKeyAll}}})
+	require.NoError(t, err)
+	require.Equal(t, &StorageConfig{Conn: "fs:///tmp/", Store: []StoreKey{StoreKeyAll}}, merged.Storage)
+	require.Equal(t, &StorageConfig{Conn: "fs:///tmp/"}, defaults.Storage)
+}
+
+func TestGroupConfigsByAddressTLS(t *testing.T) {
+	tlsA := &TLSConfig{CertFile: "a.crt", KeyFile: "a.key"}
+	tlsB := &TLSConfig{CertFile: "b.crt", KeyFile: "b.key"}
+
+	// Plain and TLS configs can coexist on different ports
+	grouped, err := groupConfigsByAddress(&Config{Port: 80}, &Config{Port: 443, TLS: tlsA}, &Config{Port: 443, TLS: tlsA})
+	require.NoError(t, err)
+	require.Len(t, grouped[":80"], 1)
+	require.Len(t, grouped[":443"], 2)
+	require.Equal(t, tlsA, GetTLSConfig(grouped[":443"]))
+	require.Nil(t, GetTLSConfig(grouped[":80"]))
+
+	_, err = groupConfigsByAddress(&Config{Port: 443}, &Config{Port: 443, TLS: tlsA})
+	require.Error(t, err)
+
+	_, err = groupConfigsByAddress(&Config{Port: 443, TLS: tlsA}, &Config{Port: 443, TLS: tlsB})
+	require.Error(t, err)
+}
+
+func TestGroupConfigsByAddressUnixSocket(t *testing.T) {
+	socketA := &UnixSocketConfig{Path: "/run/qvalet.sock"}
+	socketB := &UnixSocketConfig{Path: "/run/qvalet.sock", Mode: "0600"}
+
+	grouped, err := groupConfigsByAddress(
+		&Config{Port: 7055},
+		&Config{Port: 7055, UnixSocket: socketA},
+		&Config{Port: 7055, UnixSocket: socketA},
+		&Config{Port: 7055, SystemdSocket: "http"},
+	)
+	require.NoError(t, err)
+	require.Len(t, grouped[":7055"], 1)
+	require.Len(t, grouped["unix:/run/qvalet.sock"], 2)
+	require.Len(t, grouped["systemd:http"], 1)
+
+	_, err = groupConfigsByAddress(&Config{UnixSocket: socketA}, &Config{UnixSocket: socketB})
+	require.Error(t, err)
 }
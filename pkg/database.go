@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -124,6 +126,27 @@ func CloseAllDBConnections() {
 	})
 }
 
+type DatabaseStatus struct {
+	DSN     string  `json:"dsn"`
+	Healthy bool    `json:"healthy"`
+	Latency float64 `json:"latency"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// PingAllDBConnections checks all the cached connections, sorted by DSN
+func PingAllDBConnections(ctx context.Context) []*DatabaseStatus {
+	var statuses []*DatabaseStatus
+	databaseConnectionCache.Range(func(key, value interface{}) bool {
+		statuses = append(statuses, value.(*BunDbWrapper).Ping(ctx))
+		return true
+	})
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].DSN < statuses[j].DSN
+	})
+	return statuses
+}
+
 type BunDbWrapper struct {
 	config            *DatabaseConfig
 	db                *bun.DB
@@ -134,6 +157,20 @@ func (w *BunDbWrapper) DB() *bun.DB {
 	return w.db
 }
 
+func (w *BunDbWrapper) Ping(ctx context.Context) *DatabaseStatus {
+	start := time.Now()
+	err := w.db.PingContext(ctx)
+	status := &DatabaseStatus{
+		DSN:     w.config.parsedLogSafeConnectionURL(),
+		Healthy: err == nil,
+		Latency: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
 // Because we have multiple plugins, and listener, and on init each listener/plugin may want to
 // run the same migrations, just keep track of already executed ones in a cache
 func (w *BunDbWrapper) ApplyMigrations(plugin PluginConfigNeedsDb) error {
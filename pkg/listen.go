@@ -0,0 +1,249 @@
+package pkg
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+
+	"qvalet/pkg/utils"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	listenAddressUnixPrefix    = "unix:"
+	listenAddressSystemdPrefix = "systemd:"
+
+	unixSocketDefaultMode = "0660"
+
+	// systemd passes sockets starting from this file descriptor
+	systemdListenFdsStart = 3
+)
+
+// @formatter:off
+/// [unix-socket-docs]
+type UnixSocketConfig struct {
+	// Path of the socket file, which is created on startup
+	Path string `mapstructure:"path" validate:"required"`
+
+	// Octal permissions of the socket file, defaults to [unixSocketDefaultMode]
+	Mode string `mapstructure:"mode" validate:"omitempty,octal"`
+
+	// Owner of the socket file, either `user` or `user:group`
+	Owner string `mapstructure:"owner"`
+}
+
+/// [unix-socket-docs]
+// @formatter:on
+
+func init() {
+	if err := utils.Validate.RegisterValidation("octal", func(fl validator.FieldLevel) bool {
+		_, err := strconv.ParseUint(fl.Field().String(), 8, 32)
+		return err == nil
+	}); err != nil {
+		logrus.Fatal("failed to register octal validator")
+	}
+}
+
+func (config *UnixSocketConfig) fileMode() os.FileMode {
+	mode := unixSocketDefaultMode
+	if config.Mode != "" {
+		mode = config.Mode
+	}
+	parsed, _ := strconv.ParseUint(mode, 8, 32)
+	return os.FileMode(parsed)
+}
+
+// ListenAddress identifies where this config should be served: a TCP address
+// (e.g. `:7055`), a Unix socket (`unix:/path`) or a systemd socket (`systemd:name`)
+func (config *Config) ListenAddress() string {
+	if config.UnixSocket != nil {
+		return listenAddressUnixPrefix + config.UnixSocket.Path
+	}
+	if config.SystemdSocket != "" {
+		return listenAddressSystemdPrefix + config.SystemdSocket
+	}
+	return tcpListenAddress(config.Port)
+}
+
+func tcpListenAddress(port int) string {
+	return fmt.Sprintf(":%d", port)
+}
+
+// getUnixSocketConfig returns the socket config shared by configs listening on the same address, if any
+func getUnixSocketConfig(configs []*Config) *UnixSocketConfig {
+	for _, config := range configs {
+		if config.UnixSocket != nil {
+			return config.UnixSocket
+		}
+	}
+	return nil
+}
+
+// Listen opens the listener for the address. The Unix socket config is only
+// used for `unix:` addresses.
+func Listen(address string, unixSocket *UnixSocketConfig) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(address, listenAddressUnixPrefix):
+		if unixSocket == nil {
+			unixSocket = &UnixSocketConfig{Path: strings.TrimPrefix(address, listenAddressUnixPrefix)}
+		}
+		return listenUnixSocket(unixSocket)
+	case strings.HasPrefix(address, listenAddressSystemdPrefix):
+		return listenSystemdSocket(strings.TrimPrefix(address, listenAddressSystemdPrefix))
+	}
+
+	return net.Listen("tcp", address)
+}
+
+func listenUnixSocket(config *UnixSocketConfig) (net.Listener, error) {
+	// Remove sockets left behind by a previous unclean shutdown
+	if info, err := os.Stat(config.Path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.Errorf("file %s already exists and is not a socket", config.Path)
+		}
+		if err := os.Remove(config.Path); err != nil {
+			return nil, errors.WithMessage(err, "failed to remove stale socket")
+		}
+	}
+
+	listener, err := net.Listen("unix", config.Path)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to listen on socket %s", config.Path)
+	}
+
+	if err := os.Chmod(config.Path, config.fileMode()); err != nil {
+		_ = listener.Close()
+		return nil, errors.WithMessage(err, "failed to set socket permissions")
+	}
+
+	if config.Owner != "" {
+		if err := chownSocket(config.Path, config.Owner); err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+	}
+
+	return listener, nil
+}
+
+func chownSocket(path string, owner string) error {
+	username, groupName, _ := strings.Cut(owner, ":")
+
+	u, err := user.Lookup(username)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to find user %s", username)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return errors.WithMessagef(err, "failed to find group %s", groupName)
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	if err := os.Chown(path, uid, gid); err != nil {
+		return errors.WithMessage(err, "failed to set socket owner")
+	}
+	return nil
+}
+
+// clientIPFeature returns a description of the first feature of the config which
+// keys clients by IP, if any. Requests received via a Unix socket have no client
+// IP, so all the clients would share the same lockouts and rate limits.
+func clientIPFeature(config *Config, result *MountRoutesResult) string {
+	for _, listener := range result.listenersMap {
+		if authUsesBruteForce(listener.authBruteForce, listener.config.Auth) {
+			return fmt.Sprintf("the authentication brute force protection of listener %s", listener.route)
+		}
+		for _, plugin := range listener.plugins {
+			if plugin, ok := plugin.(*PluginRateLimit); ok && plugin.tplKey == nil {
+				return fmt.Sprintf("the rate limit plugin of listener %s, which has no key", listener.route)
+			}
+		}
+	}
+
+	if config.Admin != nil && authUsesBruteForce(config.AuthBruteForce, config.Admin.Auth) {
+		return "the authentication brute force protection of the admin API"
+	}
+	// Metrics served on their own port are not affected
+	if config.Metrics != nil && config.Metrics.Port == nil && authUsesBruteForce(config.AuthBruteForce, config.Metrics.Auth) {
+		return "the authentication brute force protection of the metrics endpoint"
+	}
+
+	return ""
+}
+
+var systemdListenersOnce sync.Once
+var systemdListeners map[string]net.Listener
+var systemdListenersErr error
+
+// Parses the sockets passed via systemd socket activation, see sd_listen_fds(3)
+func loadSystemdListeners() (map[string]net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, errors.New("no sockets passed by systemd, LISTEN_PID is missing or does not match")
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, errors.New("no sockets passed by systemd, LISTEN_FDS is missing")
+	}
+
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	listeners := make(map[string]net.Listener)
+	for idx := 0; idx < count; idx++ {
+		// systemd uses "unknown" when no names are provided
+		name := "unknown"
+		if idx < len(names) {
+			name = names[idx]
+		}
+
+		file := os.NewFile(uintptr(systemdListenFdsStart+idx), name)
+		listener, err := net.FileListener(file)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to use systemd socket %s", name)
+		}
+		// FileListener duplicates the descriptor
+		_ = file.Close()
+
+		if _, found := listeners[name]; found {
+			return nil, errors.Errorf("multiple systemd sockets named %s, please set FileDescriptorName", name)
+		}
+		listeners[name] = listener
+	}
+
+	// Do not pass the sockets to the commands we run
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	return listeners, nil
+}
+
+func listenSystemdSocket(name string) (net.Listener, error) {
+	systemdListenersOnce.Do(func() {
+		systemdListeners, systemdListenersErr = loadSystemdListeners()
+	})
+	if systemdListenersErr != nil {
+		return nil, systemdListenersErr
+	}
+
+	listener, found := systemdListeners[name]
+	if !found {
+		return nil, errors.Errorf("systemd socket %s not found", name)
+	}
+	return listener, nil
+}
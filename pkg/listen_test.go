@@ -0,0 +1,102 @@
+//go:build !windows
+
+package pkg
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "qvalet.sock")
+
+	// Stale sockets are replaced
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	config := &UnixSocketConfig{Path: path, Mode: "0600"}
+	listener, err := Listen("unix:"+path, config)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	httpServer := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})}
+	go func() { _ = httpServer.Serve(listener) }()
+	defer httpServer.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	res, err := client.Get("http://unix/")
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	require.Equal(t, http.StatusTeapot, res.StatusCode)
+
+	// Regular files are never removed
+	filename := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(filename, nil, 0644))
+	_, err = Listen("unix:"+filename, nil)
+	require.Error(t, err)
+}
+
+func TestListenUnixSocketClientIP(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "config.yaml")
+	socketConfig := `
+unixSocket:
+  path: ` + filepath.Join(dir, "qvalet.sock") + `
+listeners:
+`
+
+	// Features keyed by client IP cannot work on sockets
+	writeTestServerConfig(t, filename, socketConfig+`
+  /limited:
+    command: "true"
+    plugins:
+      - rateLimit:
+          limits:
+            - requests: 1
+              window: 1m
+`)
+	_, err := NewServer(ServerOptions{ConfigFilenames: []string{filename}})
+	require.ErrorContains(t, err, "needs the client IP")
+
+	writeTestServerConfig(t, filename, socketConfig+`
+  /protected:
+    command: "true"
+    auth:
+      - apiKeys: [ myKey ]
+        bruteForce: {}
+`)
+	_, err = NewServer(ServerOptions{ConfigFilenames: []string{filename}})
+	require.ErrorContains(t, err, "needs the client IP")
+
+	// Explicit rate limit keys are fine
+	writeTestServerConfig(t, filename, socketConfig+`
+  /limited:
+    command: "true"
+    plugins:
+      - rateLimit:
+          key: "{{ .user }}"
+          limits:
+            - requests: 1
+              window: 1m
+`)
+	_, err = NewServer(ServerOptions{ConfigFilenames: []string{filename}})
+	require.NoError(t, err)
+}
@@ -1,15 +1,16 @@
 package pkg
 
 import (
-	"bytes"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
 
@@ -53,6 +54,21 @@ type CompiledListener struct {
 	plugins []PluginInterface
 
 	dbWrapper *BunDbWrapper
+
+	// Config-wide brute-force protection, used for auth configs which do not define their own
+	authBruteForce *AuthBruteForceConfig
+
+	// Masks sensitive values before they get logged, stored or returned
+	redactor *redactor
+
+	// Set at execution time, if the trigger condition was not met
+	notTriggered bool
+
+	// Set via the admin API, shared by all clones of the listener
+	disabled *atomic.Bool
+
+	// If defined, commands are not executed, used by `qvalet test`
+	commandMock *ListenerTestMockConfig
 }
 
 func (listener *CompiledListener) Plugins() []PluginInterface {
@@ -60,13 +76,27 @@ func (listener *CompiledListener) Plugins() []PluginInterface {
 }
 
 func (listener *CompiledListener) Logger() logrus.FieldLogger {
-	return logrus.WithField("listener", listener.route)
+	if listener.log != nil {
+		return listener.log
+	}
+	return logrus.WithField(logFieldListener, listener.route)
 }
 
 func (listener *CompiledListener) SetId(value string) {
 	listener.id = value
 }
 
+// Disabled listeners reject HTTP requests until enabled again
+func (listener *CompiledListener) Disabled() bool {
+	return listener.disabled != nil && listener.disabled.Load()
+}
+
+func (listener *CompiledListener) SetDisabled(value bool) {
+	if listener.disabled != nil {
+		listener.disabled.Store(value)
+	}
+}
+
 const funcMapKeyQV = "qv"
 
 func (listener *CompiledListener) clone() (*CompiledListener, error) {
@@ -89,6 +119,11 @@ func (listener *CompiledListener) clone() (*CompiledListener, error) {
 		map[string]string{},
 		[]PluginInterface{},
 		listener.dbWrapper,
+		listener.authBruteForce,
+		listener.redactor,
+		false,
+		listener.disabled,
+		listener.commandMock,
 	}
 
 	tplCmdClone, err := listener.tplCmd.CloneForListener(newListener)
@@ -154,14 +189,14 @@ func compileListener(
 	route string,
 	isErrorHandler bool,
 	storageCache *sync.Map,
+	// If true, storage and databases are not initialized, e.g. to only validate the config
+	offline bool,
 ) (*CompiledListener, error) {
 	sourceRoute := route
 	if isErrorHandler {
 		route = fmt.Sprintf("%s-on-error", route)
 	}
 
-	log := logrus.WithField("listener", route)
-
 	listenerConfig, err := MergeListenerConfig(defaults, listenerConfig)
 	if err != nil {
 		return nil, errors.WithMessage(err, "failed to merge listener config")
@@ -171,6 +206,12 @@ func compileListener(
 		return nil, errors.WithMessage(err, "failed to validate listener config")
 	}
 
+	logger, err := newListenerLogger(listenerConfig.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	log := logger.WithField(logFieldListener, route)
+
 	if isErrorHandler {
 		// Error handlers do NOT need certain features, so disable them
 		listenerConfig.Auth = nil
@@ -189,18 +230,23 @@ func compileListener(
 		tplArgs:  listenerConfig.Args,
 		tplEnv:   listenerConfig.Env,
 		tplFiles: listenerConfig.Files,
+
+		redactor: newRedactor(listenerConfig.Redact, listenerConfig.Auth),
+		disabled: new(atomic.Bool),
 	}
 
 	if listenerConfig.ErrorHandler != nil {
-		errorHandler, err := compileListener(defaults, listenerConfig.ErrorHandler, route, true, storageCache)
+		errorHandler, err := compileListener(defaults, listenerConfig.ErrorHandler, route, true, storageCache, offline)
 		if err != nil {
 			return nil, errors.WithMessage(err, "failed to compile error handler listener")
 		}
+		// Error handlers receive the original args, so they need to mask the original api keys too
+		errorHandler.redactor = newRedactor(errorHandler.config.Redact, listenerConfig.Auth)
 		listener.errorHandler = errorHandler
 	}
 
 	// If storage is defined, we need to initialize the storager
-	if listenerConfig.Storage != nil && len(listenerConfig.Storage.Store) > 0 {
+	if listenerConfig.Storage != nil && len(listenerConfig.Storage.Store) > 0 && !offline {
 		// Re-use already-found instances
 		if storageCache != nil {
 			if storager, found := storageCache.Load(listenerConfig.Storage.Conn); found {
@@ -220,25 +266,8 @@ func compileListener(
 		}
 
 		// Check that we can write there
-		{
-			routePrefix := regexListenerRouteCleaner.ReplaceAllString(listener.route, "_")
-			nowNano := time.Now().UnixNano()
-			rand, _ := goutils.RandomAlphaNumeric(8)
-			p := fmt.Sprintf("%s-testwrite-%d-%s", routePrefix, nowNano, rand)
-
-			b := []byte(fmt.Sprintf("%d", nowNano))
-			_, err = storager.Write(p, bytes.NewBuffer(b), int64(len(b)))
-			if err != nil {
-				return nil, errors.WithMessage(err, "failed to check if storage is writable")
-			}
-
-			listener.log.WithField("path", p).Debug("written check writable file")
-
-			// Clean up if possible
-			if err := storager.Delete(p); err != nil {
-				listener.log.WithError(err).Debug("failed to remove check writable storage file")
-			}
-
+		if err := checkStorageWritable(storager, listenerConfig.Storage.Conn, listener.route, listener.log); err != nil {
+			return nil, err
 		}
 
 		if storageCache != nil {
@@ -271,7 +300,15 @@ afterStorage:
 	// If a database is defined and is required, connect!
 	if len(dbRequiredForPlugins) > 0 {
 		if listenerConfig.Database == nil {
-			return nil, errors.WithMessagef(err, "database is required for plugins %v to work", dbRequiredForPlugins)
+			var ids []string
+			for _, p := range dbRequiredForPlugins {
+				ids = append(ids, p.Id())
+			}
+			return nil, errors.Errorf("database is required for plugins %v to work", ids)
+		}
+
+		if offline {
+			return listener, nil
 		}
 
 		db, err := NewDB(listenerConfig.Database)
@@ -339,18 +376,23 @@ func (listener *CompiledListener) ExecCommand(args map[string]interface{}, toSto
 	cmdArgs := preparedExecutionResult.Args
 	cmdEnv := preparedExecutionResult.Env
 
+	// Anything which gets logged, stored or returned needs to be redacted
+	redactedCmdStr := listener.redactor.String(cmdStr)
+	redactedCmdArgs := listener.redactor.Strings(cmdArgs)
+	redactedCmdEnv := listener.redactor.Env(cmdEnv)
+
 	if listener.config.LogArgs() {
-		log = log.WithField("args", args)
+		log = log.WithField("args", listener.redactor.Args(args))
 	}
 
 	{
 		logCommandFields := map[string]interface{}{}
 		if listener.config.LogCommand() {
-			logCommandFields["command"] = cmdStr
-			logCommandFields["args"] = cmdArgs
+			logCommandFields["command"] = redactedCmdStr
+			logCommandFields["args"] = redactedCmdArgs
 		}
 		if listener.config.LogEnv() {
-			logCommandFields["env"] = cmdEnv
+			logCommandFields["env"] = redactedCmdEnv
 		}
 		if len(logCommandFields) > 0 {
 			log = log.WithFields(logrus.Fields{
@@ -362,11 +404,11 @@ func (listener *CompiledListener) ExecCommand(args map[string]interface{}, toSto
 	toReturn := &ExecCommandResult{}
 
 	if listener.config.ReturnCommand() {
-		toReturn.Command = cmdStr
-		toReturn.Args = cmdArgs
+		toReturn.Command = redactedCmdStr
+		toReturn.Args = redactedCmdArgs
 	}
 	if listener.config.ReturnEnv() {
-		toReturn.Env = cmdEnv
+		toReturn.Env = redactedCmdEnv
 	}
 
 	cmd := exec.Command(cmdStr, cmdArgs...)
@@ -379,11 +421,11 @@ func (listener *CompiledListener) ExecCommand(args map[string]interface{}, toSto
 	if listener.storager != nil {
 		storeCommandFields := map[string]interface{}{}
 		if listener.config.Storage.StoreCommand() {
-			storeCommandFields["command"] = cmdStr
-			storeCommandFields["args"] = cmdArgs
+			storeCommandFields["command"] = redactedCmdStr
+			storeCommandFields["args"] = redactedCmdArgs
 		}
 		if listener.config.Storage.StoreEnv() {
-			storeCommandFields["env"] = cmdEnv
+			storeCommandFields["env"] = redactedCmdEnv
 		}
 
 		if len(storeCommandFields) > 0 {
@@ -391,8 +433,19 @@ func (listener *CompiledListener) ExecCommand(args map[string]interface{}, toSto
 		}
 	}
 
-	out, err := cmd.CombinedOutput()
-	outStr := string(out)
+	timeStart := time.Now()
+	var out []byte
+	if listener.commandMock != nil {
+		out, err = listener.commandMock.run()
+	} else {
+		out, err = runCommand(cmd)
+	}
+	outStr := listener.redactor.String(string(out))
+
+	log = log.WithField(logFieldDuration, time.Since(timeStart).Seconds())
+	if cmd.ProcessState != nil {
+		log = log.WithField(logFieldExitCode, cmd.ProcessState.ExitCode())
+	}
 
 	if listener.storager != nil && listener.config.Storage.StoreOutput() {
 		toStore["output"] = outStr
@@ -404,7 +457,7 @@ func (listener *CompiledListener) ExecCommand(args map[string]interface{}, toSto
 
 	if err != nil {
 		if listener.storager != nil && listener.config.Storage.StoreOutput() {
-			toStore["error"] = err.Error()
+			toStore["error"] = listener.redactor.String(err.Error())
 		}
 
 		err := errors.WithMessage(err, "failed to execute command")
@@ -436,6 +489,9 @@ type preparedExecutionResult struct {
 	Command string   `json:"command,omitempty" yaml:"command,omitempty"`
 	Args    []string `json:"args,omitempty" yaml:"args,omitempty"`
 	Env     []string `json:"env,omitempty" yaml:"env,omitempty"`
+
+	// Details added by other plugins, only filled by the preview plugin
+	Plugins map[string]interface{} `json:"plugins,omitempty" yaml:"plugins,omitempty"`
 }
 
 func (listener *CompiledListener) prepareExecution(args map[string]interface{}, toStore map[string]interface{}) (*preparedExecutionResult, *ExecCommandResult, error) {
@@ -451,13 +507,13 @@ func (listener *CompiledListener) prepareExecution(args map[string]interface{},
 	}
 
 	if listener.storager != nil && listener.config.Storage.StoreArgs() {
-		toStore["args"] = args
+		toStore["args"] = listener.redactor.Args(args)
 	}
 
 	log := listener.log
 
 	if listener.config.LogArgs() {
-		log = log.WithField("args", args)
+		log = log.WithField("args", listener.redactor.Args(args))
 	}
 
 	if listener.config.Trigger != nil {
@@ -471,6 +527,7 @@ func (listener *CompiledListener) prepareExecution(args map[string]interface{},
 
 		if !isTrue {
 			// All good, do nothing
+			listener.notTriggered = true
 			return nil, &ExecCommandResult{
 				Output: "not triggered",
 			}, nil
@@ -529,7 +586,12 @@ func (listener *CompiledListener) prepareExecution(args map[string]interface{},
 }
 
 func (listener *CompiledListener) HandleRequest(c *gin.Context, args map[string]interface{}, retryMap map[string]*HookShouldRetryInfo) (bool, *ListenerResponse, error) {
-	if retryMap == nil {
+	isFirstAttempt := retryMap == nil
+	if isFirstAttempt {
+		// Retries are part of the same execution
+		metricsExecutionsInFlight.Inc(listener.route)
+		defer metricsExecutionsInFlight.Dec(listener.route)
+
 		retryMap = make(map[string]*HookShouldRetryInfo)
 	}
 
@@ -548,15 +610,32 @@ func (listener *CompiledListener) HandleRequest(c *gin.Context, args map[string]
 		return false, nil, errors.WithMessage(err, "failed to clone listener")
 	}
 
+	defer trackExecution()()
+
+	if isFirstAttempt {
+		// Retries keep the same ids, as they are part of the same execution
+		executionId, _ := goutils.RandomAlphaNumeric(16)
+		log := l.log.WithField(logFieldExecutionId, executionId)
+		if requestId := c.GetString(utils.GinContextRequestId); requestId != "" {
+			log = log.WithField(logFieldRequestId, requestId)
+		}
+		l.log = log
+	}
+
 	timeStart := time.Now()
 
 	out, errCommand := l.ExecCommand(args, toStore)
 	defer l.cleanTemporaryFiles()
 
+	if !l.notTriggered {
+		metricsExecutionDuration.Observe(time.Since(timeStart).Seconds(), l.route)
+	}
+
 	for _, plugin := range l.plugins {
 		if p, ok := plugin.(PluginHookPostExecute); ok {
 			err := p.HookPostExecute(out)
 			if err != nil {
+				metricsExecutions.Inc(l.route, metricsOutcomeFailure)
 				c.JSON(http.StatusInternalServerError, errors.WithMessage(err, "failed to process post execution via plugin"))
 				return true, nil, err
 			}
@@ -601,56 +680,30 @@ func (listener *CompiledListener) HandleRequest(c *gin.Context, args map[string]
 	if retryDelay != nil {
 		// We should retry!
 		l.log.Infof("retrying command in %s", retryDelay.String())
+		metricsRetries.Inc(l.route)
 		time.Sleep(*retryDelay)
 		return l.HandleRequest(c, args, retryMap)
 	}
 
+	switch {
+	case errCommand != nil:
+		metricsExecutions.Inc(l.route, metricsOutcomeFailure)
+	case l.notTriggered:
+		metricsExecutions.Inc(l.route, metricsOutcomeNotTriggered)
+		c.Set(ginContextNotTriggered, true)
+	default:
+		metricsExecutions.Inc(l.route, metricsOutcomeSuccess)
+	}
+
 	if errCommand != nil {
 		err := errors.WithMessagef(errCommand, "failed to execute listener %s", l.route)
 		response := &ListenerResponse{
 			ExecCommandResult: out,
-			Error:             stringPtr(err.Error()),
+			Error:             stringPtr(l.redactor.String(err.Error())),
 		}
 
-		var errorHandlerResult *ListenerResponse
 		if l.errorHandler != nil {
-			errorHandler := l.errorHandler
-			errorHandlerResult = &ListenerResponse{}
-
-			toStoreOnError := make(map[string]interface{})
-
-			// Trigger a command on error
-			onErrorArgs := map[string]interface{}{
-				"route":  l.route,
-				"error":  err.Error(),
-				"output": out,
-				"args":   args,
-			}
-
-			if errorHandler.storager != nil && errorHandler.config.Storage.StoreArgs() {
-				toStoreOnError["args"] = args
-			}
-
-			errorHandlerExecCommandResult, err := errorHandler.ExecCommand(onErrorArgs, toStoreOnError)
-			defer errorHandler.cleanTemporaryFiles()
-			errorHandlerResult.ExecCommandResult = errorHandlerExecCommandResult
-			if err != nil {
-				errorHandlerResult.Error = stringPtr(err.Error())
-				errorHandler.log.WithError(err).Error("failed to execute error listener")
-			} else {
-				errorHandler.log.Info("executed error listener")
-			}
-
-			if errorHandler.storager != nil && len(toStoreOnError) > 0 {
-				if entry := storePayload(
-					errorHandler,
-					toStoreOnError,
-				); entry != nil {
-					if errorHandler.config.ReturnStorage() {
-						errorHandlerResult.Storage = entry
-					}
-				}
-			}
+			errorHandlerResult, toStoreOnError := l.executeErrorHandler(args, err, out)
 
 			toStore["errorHandler"] = toStoreOnError
 			if l.storager != nil && len(toStore) > 0 {
@@ -701,6 +754,59 @@ func (listener *CompiledListener) HandleRequest(c *gin.Context, args map[string]
 	return false, response, nil
 }
 
+// executeErrorHandler triggers the error handler of the listener, returning its response and
+// the payload it stored
+func (listener *CompiledListener) executeErrorHandler(args map[string]interface{}, err error, out *ExecCommandResult) (*ListenerResponse, map[string]interface{}) {
+	errorHandler := listener.errorHandler
+	errorHandlerResult := &ListenerResponse{}
+
+	toStoreOnError := make(map[string]interface{})
+
+	// Trigger a command on error
+	onErrorArgs := map[string]interface{}{
+		"route":  listener.route,
+		"error":  err.Error(),
+		"output": out,
+		"args":   args,
+	}
+
+	if errorHandler.storager != nil && errorHandler.config.Storage.StoreArgs() {
+		toStoreOnError["args"] = errorHandler.redactor.Args(args)
+	}
+
+	errorHandlerExecCommandResult, err := errorHandler.ExecCommand(onErrorArgs, toStoreOnError)
+	defer errorHandler.cleanTemporaryFiles()
+	errorHandlerResult.ExecCommandResult = errorHandlerExecCommandResult
+	if err != nil {
+		errorHandlerResult.Error = stringPtr(errorHandler.redactor.String(err.Error()))
+		errorHandler.log.WithError(err).Error("failed to execute error listener")
+	} else {
+		errorHandler.log.Info("executed error listener")
+	}
+
+	if errorHandler.storager != nil && len(toStoreOnError) > 0 {
+		if entry := storePayload(
+			errorHandler,
+			toStoreOnError,
+		); entry != nil {
+			if errorHandler.config.ReturnStorage() {
+				errorHandlerResult.Storage = entry
+			}
+		}
+	}
+
+	return errorHandlerResult, toStoreOnError
+}
+
+// handleBackgroundRequest handles a request which has no HTTP client waiting for it, e.g.
+// a delayed execution, discarding the HTTP response
+func (listener *CompiledListener) handleBackgroundRequest(args map[string]interface{}) (*ListenerResponse, error) {
+	w := httptest.NewRecorder()
+	writeOnlyContext, _ := gin.CreateTestContext(w)
+	_, response, err := listener.HandleRequest(writeOnlyContext, args, nil)
+	return response, err
+}
+
 var regexReplaceTemporaryFileName = regexp.MustCompile(`\W`)
 
 // processFiles stores files defined in the "files" listener config entry in the right place
@@ -0,0 +1,378 @@
+package pkg
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// @formatter:off
+/// [listener-tests-docs]
+type ListenerTestConfig struct {
+	// Name of the test case, defaults to its index
+	Name string `mapstructure:"name"`
+
+	// Request to send to the listener
+	Request ListenerTestRequestConfig `mapstructure:"request"`
+
+	// If defined, commands are not executed, and return the mocked output instead
+	Mock *ListenerTestMockConfig `mapstructure:"mock"`
+
+	// What to check once the request has been handled
+	Expect ListenerTestExpectConfig `mapstructure:"expect"`
+}
+
+type ListenerTestRequestConfig struct {
+	// Defaults to the first method of the listener
+	Method string `mapstructure:"method" validate:"omitempty,oneof=GET POST PUT PATCH HEAD DELETE OPTIONS"`
+
+	// Defaults to the listener route, required if the route has parameters, e.g. `/hello/world`
+	Path string `mapstructure:"path" validate:"omitempty,startswith=/"`
+
+	// Query string, e.g. `name=world&lang=en`
+	Query string `mapstructure:"query"`
+
+	// Request headers, e.g. `Authorization: Bearer token`
+	Headers map[string]string `mapstructure:"headers"`
+
+	// Request body. Unless set via headers, the content type is JSON.
+	Body string `mapstructure:"body"`
+}
+
+type ListenerTestMockConfig struct {
+	// Output of the command
+	Output string `mapstructure:"output"`
+
+	// If not 0, the command fails
+	ExitCode int `mapstructure:"exitCode"`
+
+	// Mock of the error handler command, which otherwise succeeds with no output
+	ErrorHandler *ListenerTestMockConfig `mapstructure:"errorHandler"`
+}
+
+type ListenerTestExpectConfig struct {
+	// If defined, the HTTP status code of the response
+	Status int `mapstructure:"status" validate:"omitempty,min=100,max=599"`
+
+	// If defined, the output of the command must be equal to this value,
+	// ignoring trailing new lines
+	Output *string `mapstructure:"output"`
+
+	// The output of the command must contain all these values
+	OutputContains []string `mapstructure:"outputContains"`
+
+	// If defined, whether the trigger condition must not be met
+	NotTriggered *bool `mapstructure:"notTriggered"`
+
+	// If defined, whether the error handler must be invoked
+	ErrorHandler *bool `mapstructure:"errorHandler"`
+}
+
+/// [listener-tests-docs]
+// @formatter:on
+
+func (mock *ListenerTestMockConfig) run() ([]byte, error) {
+	if mock.ExitCode != 0 {
+		return []byte(mock.Output), errors.Errorf("exit status %d", mock.ExitCode)
+	}
+	return []byte(mock.Output), nil
+}
+
+type ListenerTestResult struct {
+	File     string
+	Route    string
+	Name     string
+	Duration time.Duration
+
+	// Unmet expectations
+	Failures []string
+	// Set if the test could not be run at all
+	Error error
+}
+
+func (r *ListenerTestResult) Passed() bool {
+	return r.Error == nil && len(r.Failures) == 0
+}
+
+func (r *ListenerTestResult) String() string {
+	status := "PASS"
+	if !r.Passed() {
+		status = "FAIL"
+	}
+	return fmt.Sprintf("%s %s [%s] %s", status, r.File, r.Route, r.Name)
+}
+
+type ListenerTestReport struct {
+	Results []*ListenerTestResult
+}
+
+func (r *ListenerTestReport) Passed() bool {
+	for _, result := range r.Results {
+		if !result.Passed() {
+			return false
+		}
+	}
+	return true
+}
+
+// RunListenerTests runs the test cases defined in the `tests` entry of every listener,
+// sending the requests to an in-process engine, without binding any port. Storage and
+// databases are not used.
+func RunListenerTests(options ServerOptions) (*ListenerTestReport, error) {
+	report := &ListenerTestReport{}
+
+	for _, filename := range options.ConfigFilenames {
+		fileOptions := options
+		fileOptions.ConfigFilenames = []string{filename}
+		configs, err := loadConfigs(fileOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, config := range configs {
+			var routes []string
+			for route := range config.Listeners {
+				routes = append(routes, route)
+			}
+			sort.Strings(routes)
+
+			for _, route := range routes {
+				listenerConfig := config.Listeners[route]
+				for idx, test := range listenerConfig.Tests {
+					name := test.Name
+					if name == "" {
+						name = fmt.Sprintf("#%d", idx)
+					}
+
+					result := &ListenerTestResult{
+						File:  filename,
+						Route: route,
+						Name:  name,
+					}
+					timeStart := time.Now()
+					result.Failures, result.Error = runListenerTest(config, route, listenerConfig, test)
+					result.Duration = time.Since(timeStart)
+					report.Results = append(report.Results, result)
+				}
+			}
+		}
+	}
+
+	return report, nil
+}
+
+func runListenerTest(config *Config, route string, listenerConfig *ListenerConfig, test *ListenerTestConfig) ([]string, error) {
+	// The output is checked even if the listener does not return it
+	testListenerConfig := withReturnOutput(listenerConfig)
+	if listenerConfig.ErrorHandler != nil {
+		testListenerConfig.ErrorHandler = withReturnOutput(listenerConfig.ErrorHandler)
+	}
+
+	listener, err := compileListener(&config.Defaults, testListenerConfig, route, false, nil, true)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to compile listener for route %s", route)
+	}
+	listener.authBruteForce = config.AuthBruteForce
+
+	if test.Mock != nil {
+		listener.commandMock = test.Mock
+		if listener.errorHandler != nil {
+			listener.errorHandler.commandMock = &ListenerTestMockConfig{}
+			if test.Mock.ErrorHandler != nil {
+				listener.errorHandler.commandMock = test.Mock.ErrorHandler
+			}
+		}
+	}
+
+	req, err := newListenerTestRequest(listener, route, &test.Request)
+	if err != nil {
+		return nil, err
+	}
+
+	var response *ListenerResponse
+	notTriggered := false
+
+	engine := gin.New()
+	engine.Use(func(c *gin.Context) {
+		c.Next()
+		if value, found := c.Get(ginContextListenerResponse); found {
+			response, _ = value.(*ListenerResponse)
+		}
+		notTriggered = c.GetBool(ginContextNotTriggered)
+	})
+	// A panicking listener fails its test, instead of the whole run
+	engine.Use(gin.Recovery())
+	mountRoutesForListener(engine, listener, route, getGinListenerHandler(listener))
+
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, req)
+
+	return checkListenerTestExpectations(&test.Expect, recorder.Code, response, notTriggered), nil
+}
+
+// Returns a copy of the listener config, which returns the output of the command
+func withReturnOutput(listenerConfig *ListenerConfig) *ListenerConfig {
+	newConfig := *listenerConfig
+	newConfig.Return = append([]ReturnKey{ReturnKeyOutput}, listenerConfig.Return...)
+	return &newConfig
+}
+
+func newListenerTestRequest(listener *CompiledListener, route string, config *ListenerTestRequestConfig) (*http.Request, error) {
+	method := config.Method
+	if method == "" {
+		method = listener.config.methods()[0]
+	}
+
+	path := config.Path
+	if path == "" {
+		if strings.ContainsAny(route, ":*") {
+			return nil, errors.Errorf("request path is required, as route %s has parameters", route)
+		}
+		path = route
+	}
+	if config.Query != "" {
+		path += "?" + config.Query
+	}
+
+	req := httptest.NewRequest(method, path, strings.NewReader(config.Body))
+	for key, value := range config.Headers {
+		req.Header.Set(key, value)
+	}
+	if config.Body != "" && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", gin.MIMEJSON)
+	}
+	return req, nil
+}
+
+func checkListenerTestExpectations(expect *ListenerTestExpectConfig, status int, response *ListenerResponse, notTriggered bool) []string {
+	var failures []string
+
+	if expect.Status != 0 && expect.Status != status {
+		failures = append(failures, fmt.Sprintf("expected status %d, got %d", expect.Status, status))
+	}
+
+	if expect.Output != nil || len(expect.OutputContains) > 0 {
+		if response == nil || response.ExecCommandResult == nil {
+			failures = append(failures, fmt.Sprintf("expected an output, but the command was not executed (status %d)", status))
+		} else {
+			output := response.Output
+			if expect.Output != nil && strings.TrimRight(output, "\r\n") != strings.TrimRight(*expect.Output, "\r\n") {
+				failures = append(failures, fmt.Sprintf("expected output %q, got %q", *expect.Output, output))
+			}
+			for _, value := range expect.OutputContains {
+				if !strings.Contains(output, value) {
+					failures = append(failures, fmt.Sprintf("expected output to contain %q, got %q", value, output))
+				}
+			}
+		}
+	}
+
+	if expect.NotTriggered != nil && *expect.NotTriggered != notTriggered {
+		if notTriggered {
+			failures = append(failures, "expected the trigger condition to be met")
+		} else {
+			failures = append(failures, "expected the trigger condition not to be met")
+		}
+	}
+
+	if expect.ErrorHandler != nil {
+		invoked := response != nil && response.ErrorHandlerResult != nil
+		if *expect.ErrorHandler != invoked {
+			if invoked {
+				failures = append(failures, "expected the error handler not to be invoked")
+			} else {
+				failures = append(failures, "expected the error handler to be invoked")
+			}
+		}
+	}
+
+	return failures
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name          `xml:"testsuites"`
+	Suites  []*junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Time     string           `xml:"time,attr"`
+	Cases    []*junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func junitDuration(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// WriteJUnit writes the report in the JUnit XML format, with a test suite per config file
+func (r *ListenerTestReport) WriteJUnit(w io.Writer) error {
+	suites := &junitTestSuites{}
+	suitesByFile := make(map[string]*junitTestSuite)
+	suitesDurations := make(map[*junitTestSuite]time.Duration)
+
+	for _, result := range r.Results {
+		suite, found := suitesByFile[result.File]
+		if !found {
+			suite = &junitTestSuite{Name: result.File}
+			suitesByFile[result.File] = suite
+			suites.Suites = append(suites.Suites, suite)
+		}
+
+		testCase := &junitTestCase{
+			ClassName: result.Route,
+			Name:      result.Name,
+			Time:      junitDuration(result.Duration),
+		}
+		switch {
+		case result.Error != nil:
+			testCase.Error = &junitMessage{Message: result.Error.Error()}
+			suite.Errors++
+		case len(result.Failures) > 0:
+			testCase.Failure = &junitMessage{
+				Message: result.Failures[0],
+				Text:    strings.Join(result.Failures, "\n"),
+			}
+			suite.Failures++
+		}
+
+		suite.Tests++
+		suite.Cases = append(suite.Cases, testCase)
+		suitesDurations[suite] += result.Duration
+		suite.Time = junitDuration(suitesDurations[suite])
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(suites); err != nil {
+		return errors.WithMessage(err, "failed to encode JUnit report")
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,81 @@
+package pkg
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunListenerTests(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(filename, []byte(`
+listeners:
+  /hello/:name:
+    methods: [ POST ]
+    command: echo
+    args: [ "hello {{ .name }} {{ .value }}" ]
+    trigger: eq .value "go"
+    tests:
+      - name: greets
+        request:
+          path: /hello/world
+          body: '{"value": "go"}'
+        expect:
+          status: 200
+          output: hello world go
+      - name: skips
+        request:
+          path: /hello/world
+          query: value=stop
+        expect:
+          notTriggered: true
+      - name: wrong expectation
+        request:
+          path: /hello/world
+          body: '{"value": "go"}'
+        expect:
+          outputContains: [ "bye" ]
+  /fail:
+    command: "false"
+    errorHandler:
+      command: echo
+    tests:
+      - name: mocked failure
+        mock:
+          output: oops
+          exitCode: 1
+        expect:
+          status: 500
+          output: oops
+          errorHandler: true
+  /params/:id:
+    command: echo
+    tests:
+      - expect:
+          status: 200
+`), 0600))
+
+	report, err := RunListenerTests(ServerOptions{ConfigFilenames: []string{filename}})
+	require.NoError(t, err)
+	require.False(t, report.Passed())
+	require.Len(t, report.Results, 5)
+
+	results := make(map[string]*ListenerTestResult)
+	for _, result := range report.Results {
+		results[result.Name] = result
+	}
+
+	require.True(t, results["greets"].Passed(), results["greets"].Failures)
+	require.True(t, results["skips"].Passed(), results["skips"].Failures)
+	require.True(t, results["mocked failure"].Passed(), results["mocked failure"].Failures)
+	require.Equal(t, []string{`expected output to contain "bye", got "hello world go\n"`}, results["wrong expectation"].Failures)
+	require.Error(t, results["#0"].Error)
+
+	var junit bytes.Buffer
+	require.NoError(t, report.WriteJUnit(&junit))
+	require.Contains(t, junit.String(), `<testsuite name="`+filename+`" tests="5" failures="1" errors="1"`)
+	require.Contains(t, junit.String(), `<testcase classname="/fail" name="mocked failure"`)
+}
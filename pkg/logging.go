@@ -0,0 +1,179 @@
+package pkg
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/davecgh/go-spew/spew"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	LoggingFormatText   = "text"
+	LoggingFormatJSON   = "json"
+	LoggingFormatLogfmt = "logfmt"
+
+	LoggingOutputStdout = "stdout"
+	LoggingOutputStderr = "stderr"
+)
+
+// Stable log field names, which log pipelines can rely on
+const (
+	logFieldListener    = "listener"
+	logFieldExecutionId = "executionId"
+	logFieldRequestId   = "requestId"
+	logFieldDuration    = "duration"
+	logFieldExitCode    = "exitCode"
+)
+
+// @formatter:off
+/// [logging-docs]
+type LoggingConfig struct {
+	// Format of the log lines, one of:
+	// - text: human-readable lines, where complex values are expanded (default)
+	// - json: one JSON object per line
+	// - logfmt: `key=value` pairs
+	Format string `mapstructure:"format" validate:"omitempty,oneof=text json logfmt"`
+
+	// Where to write logs: `stdout` (default), `stderr`, or a file path
+	Output string `mapstructure:"output"`
+}
+
+/// [logging-docs]
+// @formatter:on
+
+// All loggers, including per-listener ones, share the same formatter and output,
+// so that the logging config can be changed at any time, e.g. on reload
+var logFormatter = &swappableFormatter{}
+var logOutput = &swappableWriter{}
+
+type swappableFormatter struct {
+	lock      sync.RWMutex
+	formatter logrus.Formatter
+}
+
+func (f *swappableFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.formatter.Format(entry)
+}
+
+type swappableWriter struct {
+	lock   sync.RWMutex
+	writer io.Writer
+	// Set if the writer is a file we opened, which needs to be closed on change
+	file *os.File
+}
+
+func (w *swappableWriter) Write(p []byte) (int, error) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return w.writer.Write(p)
+}
+
+func init() {
+	if err := ConfigureLogging(nil); err != nil {
+		logrus.WithError(err).Fatal("failed to configure default logging")
+	}
+	logrus.SetFormatter(logFormatter)
+	logrus.SetOutput(logOutput)
+}
+
+func newLogFormatter(format string) logrus.Formatter {
+	switch format {
+	case LoggingFormatJSON:
+		return &logrus.JSONFormatter{}
+	case LoggingFormatLogfmt:
+		return &logrus.TextFormatter{
+			DisableColors: true,
+			FullTimestamp: true,
+		}
+	}
+
+	return &logrus.TextFormatter{
+		// Expand complex values, e.g. args, to make them readable
+		RenderFunc: func(value interface{}) string {
+			return spew.Sprintf("%#v", value)
+		},
+	}
+}
+
+// ConfigureLogging applies the logging config to all loggers. A nil config restores the defaults.
+func ConfigureLogging(config *LoggingConfig) error {
+	if config == nil {
+		config = &LoggingConfig{}
+	}
+
+	var writer io.Writer
+	var file *os.File
+	switch config.Output {
+	case "", LoggingOutputStdout:
+		writer = os.Stdout
+	case LoggingOutputStderr:
+		writer = os.Stderr
+	default:
+		f, err := os.OpenFile(config.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return errors.WithMessagef(err, "failed to open log file %s", config.Output)
+		}
+		writer = f
+		file = f
+	}
+
+	logOutput.lock.Lock()
+	previousFile := logOutput.file
+	logOutput.writer = writer
+	logOutput.file = file
+	logOutput.lock.Unlock()
+
+	if previousFile != nil {
+		_ = previousFile.Close()
+	}
+
+	logFormatter.lock.Lock()
+	logFormatter.formatter = newLogFormatter(config.Format)
+	logFormatter.lock.Unlock()
+
+	return nil
+}
+
+// GetLoggingConfig returns the logging config shared by all configs, if any
+func GetLoggingConfig(configs []*Config) (*LoggingConfig, error) {
+	var found *LoggingConfig
+	for _, config := range configs {
+		if config.Logging == nil {
+			continue
+		}
+		if found != nil && !reflect.DeepEqual(found, config.Logging) {
+			return nil, errors.New("all configs defining a logging config must define the same one")
+		}
+		found = config.Logging
+	}
+	return found, nil
+}
+
+// newListenerLogger returns a logger which can have its own level, but otherwise
+// behaves like the global one
+func newListenerLogger(level string) (*logrus.Logger, error) {
+	std := logrus.StandardLogger()
+	if level == "" {
+		return std, nil
+	}
+
+	parsedLevel, err := logrus.ParseLevel(level)
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid log level")
+	}
+
+	return &logrus.Logger{
+		Out:          std.Out,
+		Formatter:    std.Formatter,
+		Hooks:        std.Hooks,
+		Level:        parsedLevel,
+		ExitFunc:     std.ExitFunc,
+		ReportCaller: std.ReportCaller,
+	}, nil
+}
@@ -0,0 +1,56 @@
+package pkg
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigureLogging(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "qv.log")
+	require.NoError(t, ConfigureLogging(&LoggingConfig{Format: LoggingFormatJSON, Output: logFile}))
+	defer func() {
+		require.NoError(t, ConfigureLogging(nil))
+	}()
+
+	previousLevel := logrus.GetLevel()
+	logrus.SetLevel(logrus.InfoLevel)
+	defer logrus.SetLevel(previousLevel)
+
+	// Listener loggers can be more verbose than the global one
+	logger, err := newListenerLogger("debug")
+	require.NoError(t, err)
+	logger.WithField(logFieldListener, "/hello").Debug("listener debug")
+	logrus.Debug("global debug")
+
+	content, err := os.ReadFile(logFile)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 1)
+
+	entry := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	require.Equal(t, "listener debug", entry["msg"])
+	require.Equal(t, "debug", entry["level"])
+	require.Equal(t, "/hello", entry[logFieldListener])
+
+	_, err = newListenerLogger("loud")
+	require.Error(t, err)
+}
+
+func TestGetLoggingConfig(t *testing.T) {
+	jsonConfig := &LoggingConfig{Format: LoggingFormatJSON}
+
+	found, err := GetLoggingConfig([]*Config{{}, {Logging: jsonConfig}, {Logging: &LoggingConfig{Format: LoggingFormatJSON}}})
+	require.NoError(t, err)
+	require.Equal(t, jsonConfig, found)
+
+	_, err = GetLoggingConfig([]*Config{{Logging: jsonConfig}, {Logging: &LoggingConfig{Format: LoggingFormatLogfmt}}})
+	require.Error(t, err)
+}
@@ -69,3 +69,28 @@ func (t mergoTransformerCustom) Transformer(typ reflect.Type) func(dst, src refl
 	}
 	return nil
 }
+
+// mergoCopyPointedStructs replaces all the pointers to structs with pointers to copies,
+// because mergo merges pointed structs in place, which would alter the merge sources
+func mergoCopyPointedStructs(value reflect.Value) {
+	for idx := 0; idx < value.NumField(); idx++ {
+		field := value.Field(idx)
+		if !field.CanSet() {
+			continue
+		}
+
+		switch {
+		case field.Kind() == reflect.Struct:
+			mergoCopyPointedStructs(field)
+		case field.Kind() == reflect.Ptr &&
+			!field.IsNil() &&
+			field.Elem().Kind() == reflect.Struct &&
+			// Replaced as a whole, never merged
+			MergoTransformerCustomInstance.Transformer(field.Type()) == nil:
+			copied := reflect.New(field.Elem().Type())
+			copied.Elem().Set(field.Elem())
+			mergoCopyPointedStructs(copied.Elem())
+			field.Set(copied)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package pkg
+
+import (
+	"net/http"
+
+	"qvalet/pkg/metrics"
+	"qvalet/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	metricsOutcomeSuccess      = "success"
+	metricsOutcomeFailure      = "failure"
+	metricsOutcomeNotTriggered = "not_triggered"
+	metricsOutcomeAuthRejected = "auth_rejected"
+	metricsOutcomeDisabled     = "disabled"
+	metricsOutcomeRateLimited  = "rate_limited"
+	metricsOutcomeDuplicate    = "duplicate"
+	metricsOutcomeCached       = "cached"
+	metricsOutcomeCircuitOpen  = "circuit_open"
+)
+
+var (
+	metricsExecutions = metrics.DefaultRegistry.NewCounterVec(
+		"qvalet_executions_total",
+		"Listener executions, by outcome: success, failure, not_triggered, auth_rejected, disabled, rate_limited, duplicate, cached, circuit_open",
+		"listener", "outcome",
+	)
+	metricsExecutionDuration = metrics.DefaultRegistry.NewHistogramVec(
+		"qvalet_execution_duration_seconds",
+		"Duration of the listener command executions, including retry attempts",
+		metrics.DefaultBuckets,
+		"listener",
+	)
+	metricsExecutionsInFlight = metrics.DefaultRegistry.NewGaugeVec(
+		"qvalet_executions_in_flight",
+		"Listener executions currently in progress",
+		"listener",
+	)
+	metricsRetries = metrics.DefaultRegistry.NewCounterVec(
+		"qvalet_retries_total",
+		"Retries scheduled by the retry plugin",
+		"listener",
+	)
+	metricsScheduleQueueDepth = metrics.DefaultRegistry.NewGaugeVec(
+		"qvalet_schedule_queue_depth",
+		"Tasks waiting to be executed by the schedule plugin",
+		"schedule",
+	)
+	metricsScheduleLag = metrics.DefaultRegistry.NewGaugeVec(
+		"qvalet_schedule_lag_seconds",
+		"How late is the oldest due task of the schedule plugin",
+		"schedule",
+	)
+	metricsCircuitBreakersOpen = metrics.DefaultRegistry.NewGaugeVec(
+		"qvalet_circuit_breakers_open",
+		"Circuits of the circuit breaker plugin which are currently open or half-open",
+		"circuit_breaker",
+	)
+	metricsCircuitBreakerTransitions = metrics.DefaultRegistry.NewCounterVec(
+		"qvalet_circuit_breaker_transitions_total",
+		"State changes of the circuits of the circuit breaker plugin, by new state: open, half_open, closed",
+		"circuit_breaker", "state",
+	)
+	metricsStorageWriteFailures = metrics.DefaultRegistry.NewCounterVec(
+		"qvalet_storage_write_failures_total",
+		"Payloads which could not be written to the storage",
+		"listener",
+	)
+)
+
+// @formatter:off
+/// [metrics-docs]
+const metricsRouteDefault = "/metrics"
+
+type MetricsConfig struct {
+	// Route of the metrics endpoint, defaults to [metricsRouteDefault]
+	Route *string `mapstructure:"route"`
+
+	// If defined, the metrics endpoint is served on this port, instead of
+	// the config's one, e.g. to keep it private to the cluster
+	Port *int `mapstructure:"port" validate:"omitempty,min=0,max=65535"`
+
+	// List of allowed authentication methods
+	Auth []*AuthConfig `mapstructure:"auth" validate:"dive"`
+}
+
+/// [metrics-docs]
+// @formatter:on
+
+func (config *MetricsConfig) route() string {
+	if config.Route != nil {
+		return *config.Route
+	}
+	return metricsRouteDefault
+}
+
+func mountMetricsRoutes(engine *gin.Engine, config *Config) {
+	route := config.Metrics.route()
+
+	engine.GET(route, getAuthMiddleware(route, config.AuthBruteForce, config.Metrics.Auth), func(c *gin.Context) {
+		// Scrapes are way too frequent to be logged
+		c.Set(utils.GinContextDoNotLogEntry, true)
+		c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		c.Status(http.StatusOK)
+		if err := metrics.DefaultRegistry.Write(c.Writer); err != nil {
+			logrus.WithError(err).Warn("failed to write metrics")
+		}
+	})
+
+	logrus.Infof("mounted metrics at %s", route)
+}
@@ -0,0 +1,279 @@
+// Package metrics implements a minimal registry of counters, gauges and
+// histograms, which can be exposed in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// DefaultBuckets are suited for command executions, which can last from milliseconds to minutes
+var DefaultBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+type Registry struct {
+	lock sync.RWMutex
+	vecs []*vec
+}
+
+// DefaultRegistry holds all qValet metrics
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(v *vec) *vec {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, other := range r.vecs {
+		if other.name == v.name {
+			panic(fmt.Sprintf("metric %s registered twice", v.name))
+		}
+	}
+	r.vecs = append(r.vecs, v)
+	return v
+}
+
+// Write writes all metrics in the Prometheus text exposition format
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.RLock()
+	vecs := append([]*vec{}, r.vecs...)
+	r.lock.RUnlock()
+
+	sort.Slice(vecs, func(i, j int) bool {
+		return vecs[i].name < vecs[j].name
+	})
+
+	bw := bufio.NewWriter(w)
+	for _, v := range vecs {
+		v.write(bw)
+	}
+	return bw.Flush()
+}
+
+type series struct {
+	labelValues []string
+
+	value float64
+
+	// Histograms only
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+}
+
+type vec struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+	buckets    []float64
+
+	lock   sync.Mutex
+	series map[string]*series
+}
+
+func newVec(name string, help string, typ string, labelNames []string) *vec {
+	return &vec{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		series:     make(map[string]*series),
+	}
+}
+
+// NOTE: needs to be invoked with the lock held
+func (v *vec) get(labelValues []string) *series {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, found := v.series[key]
+	if !found {
+		s = &series{
+			labelValues:  append([]string{}, labelValues...),
+			bucketCounts: make([]uint64, len(v.buckets)),
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *vec) delete(labelValues []string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	delete(v.series, strings.Join(labelValues, "\xff"))
+}
+
+func (v *vec) write(w *bufio.Writer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.typ)
+
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := v.series[key]
+
+		if v.typ != typeHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labelNames, s.labelValues, "", ""), formatValue(s.value))
+			continue
+		}
+
+		var cumulative uint64
+		for idx, bound := range v.buckets {
+			cumulative += s.bucketCounts[idx]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labelNames, s.labelValues, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labelNames, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, formatLabels(v.labelNames, s.labelValues, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, formatLabels(v.labelNames, s.labelValues, "", ""), s.count)
+	}
+}
+
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+
+	var parts []string
+	for idx, name := range names {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(values[idx])))
+	}
+	if extraName != "" {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func escapeHelp(value string) string {
+	return helpEscaper.Replace(value)
+}
+
+// --- Counter
+
+type CounterVec struct {
+	vec *vec
+}
+
+func (r *Registry) NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{r.register(newVec(name, help, typeCounter, labelNames))}
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic("counters cannot decrease")
+	}
+
+	c.vec.lock.Lock()
+	defer c.vec.lock.Unlock()
+	c.vec.get(labelValues).value += value
+}
+
+// --- Gauge
+
+type GaugeVec struct {
+	vec *vec
+}
+
+func (r *Registry) NewGaugeVec(name string, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{r.register(newVec(name, help, typeGauge, labelNames))}
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.vec.lock.Lock()
+	defer g.vec.lock.Unlock()
+	g.vec.get(labelValues).value = value
+}
+
+func (g *GaugeVec) Add(value float64, labelValues ...string) {
+	g.vec.lock.Lock()
+	defer g.vec.lock.Unlock()
+	g.vec.get(labelValues).value += value
+}
+
+func (g *GaugeVec) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+func (g *GaugeVec) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// Delete removes the series with the given label values, e.g. when the
+// entity it describes does not exist anymore
+func (g *GaugeVec) Delete(labelValues ...string) {
+	g.vec.delete(labelValues)
+}
+
+// --- Histogram
+
+type HistogramVec struct {
+	vec *vec
+}
+
+func (r *Registry) NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	v := newVec(name, help, typeHistogram, labelNames)
+	v.buckets = append([]float64{}, buckets...)
+	sort.Float64s(v.buckets)
+	return &HistogramVec{r.register(v)}
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.vec.lock.Lock()
+	defer h.vec.lock.Unlock()
+
+	s := h.vec.get(labelValues)
+	for idx, bound := range h.vec.buckets {
+		if value <= bound {
+			s.bucketCounts[idx]++
+			break
+		}
+	}
+	s.sum += value
+	s.count++
+}
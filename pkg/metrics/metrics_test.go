@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	r := NewRegistry()
+
+	counter := r.NewCounterVec("test_total", "Test counter", "listener", "outcome")
+	counter.Inc("/a", "success")
+	counter.Inc("/a", "success")
+	counter.Inc(`/b"`, "failure")
+
+	gauge := r.NewGaugeVec("test_in_flight", "Test gauge", "listener")
+	gauge.Inc("/a")
+	gauge.Inc("/a")
+	gauge.Dec("/a")
+	gauge.Set(5, "/b")
+	gauge.Delete("/b")
+
+	histogram := r.NewHistogramVec("test_duration_seconds", "Test histogram", []float64{1, 0.1}, "listener")
+	histogram.Observe(0.05, "/a")
+	histogram.Observe(0.5, "/a")
+	histogram.Observe(5, "/a")
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, r.Write(buf))
+	require.Equal(t, `# HELP test_duration_seconds Test histogram
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{listener="/a",le="0.1"} 1
+test_duration_seconds_bucket{listener="/a",le="1"} 2
+test_duration_seconds_bucket{listener="/a",le="+Inf"} 3
+test_duration_seconds_sum{listener="/a"} 5.55
+test_duration_seconds_count{listener="/a"} 3
+# HELP test_in_flight Test gauge
+# TYPE test_in_flight gauge
+test_in_flight{listener="/a"} 1
+# HELP test_total Test counter
+# TYPE test_total counter
+test_total{listener="/a",outcome="success"} 2
+test_total{listener="/b\"",outcome="failure"} 1
+`, buf.String())
+
+	require.Panics(t, func() {
+		r.NewCounterVec("test_total", "Duplicate")
+	})
+	require.Panics(t, func() {
+		counter.Inc("/a")
+	})
+}
@@ -3,6 +3,7 @@ package pkg
 import (
 	"fmt"
 	"reflect"
+	"sync"
 	"time"
 
 	"qvalet/pkg/utils"
@@ -39,6 +40,26 @@ func NewPluginBase(idPrefix string) PluginBase {
 	return PluginBase{id: fmt.Sprintf("plugin-%s-%d", idPrefix, GetNextPluginIdx())}
 }
 
+const (
+	PluginStateStopped = "stopped"
+	PluginStateRunning = "running"
+	PluginStateFailed  = "failed"
+)
+
+// Maps lifecycle plugin -> its current state, exposed via the admin API
+var pluginLifecycleStates = new(sync.Map)
+
+func setPluginLifecycleState(plugin PluginLifecycle, state string) {
+	pluginLifecycleStates.Store(plugin, state)
+}
+
+func GetPluginLifecycleState(plugin PluginLifecycle) string {
+	if state, found := pluginLifecycleStates.Load(plugin); found {
+		return state.(string)
+	}
+	return PluginStateStopped
+}
+
 type PluginLifecycle interface {
 	PluginInterface
 
@@ -49,6 +70,13 @@ type PluginLifecycle interface {
 	OnStop()
 }
 
+type PluginHealthCheck interface {
+	PluginInterface
+
+	// Invoked by the readiness endpoint, returns an error if the plugin cannot operate
+	HealthCheck() error
+}
+
 type PluginConfigValidateCheckOtherPlugins interface {
 	PluginInterface
 
@@ -79,6 +107,22 @@ type PluginHookGetMiddlewares interface {
 	HookGetMiddlewares(method string) []gin.HandlerFunc
 }
 
+type PluginHookRequest interface {
+	PluginInterface
+
+	// Called at runtime, after authentication and before listener execution, allows plugins to
+	// reject requests. If handled, the plugin has already written the response.
+	HookRequest(c *gin.Context, args map[string]interface{}) (handled bool, err error)
+}
+
+type PluginHookPreview interface {
+	PluginInterface
+
+	// Called by the preview plugin, allows plugins to add their own details to the preview,
+	// under the returned name
+	HookPreview(args map[string]interface{}) (name string, preview interface{}, err error)
+}
+
 type PluginHookPreExecute interface {
 	PluginInterface
 
@@ -136,12 +180,30 @@ type PluginEntryConfig struct {
 	// AWS SNS plugin, to auto-confirm AWS SNS subscriptions and handle SNS notifications
 	AWSSNS *PluginAWSSNSConfig `mapstructure:"awsSNS"`
 
+	// Batch plugin, to aggregate multiple events into a single execution
+	Batch *PluginBatchConfig `mapstructure:"batch"`
+
+	// Cache plugin, to return cached responses of read-only listeners
+	Cache *PluginCacheConfig `mapstructure:"cache"`
+
+	// Circuit breaker plugin, to stop executing commands which keep failing
+	CircuitBreaker *PluginCircuitBreakerConfig `mapstructure:"circuitBreaker"`
+
+	// Debounce plugin, to collapse bursts of events into a single execution
+	Debounce *PluginDebounceConfig `mapstructure:"debounce"`
+
+	// Dedupe plugin, to execute only once requests which get delivered multiple times
+	Dedupe *PluginDedupeConfig `mapstructure:"dedupe"`
+
 	// HTTP response plugin, to alter HTTP response headers, status code, etc...
 	HTTPResponse *PluginHTTPResponseConfig `mapstructure:"httpResponse"`
 
 	// Preview plugin, used to preview the command which will be executed
 	Preview *PluginPreviewConfig `mapstructure:"preview"`
 
+	// Rate limit plugin, to limit how frequently a listener can be triggered
+	RateLimit *PluginRateLimitConfig `mapstructure:"rateLimit"`
+
 	// You can use the Retry plugin to retry a command execution, depending on
 	// any condition you want
 	Retry *PluginRetryConfig `mapstructure:"retry"`
@@ -0,0 +1,484 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"qvalet/pkg/plugin_batch"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/migrate"
+)
+
+var _ PluginInterface = (*PluginBatch)(nil)
+var _ PluginHookRequest = (*PluginBatch)(nil)
+var _ PluginLifecycle = (*PluginBatch)(nil)
+var _ PluginConfigNeedsDb = (*PluginBatch)(nil)
+var _ PluginConfigValidateCheckOtherPlugins = (*PluginBatch)(nil)
+var _ PluginConfig = (*PluginBatchConfig)(nil)
+
+// How frequently the database is checked for batches ready to be executed
+const pluginBatchScanInterval = 1 * time.Second
+
+// @formatter:off
+/// [config]
+type PluginBatchConfig struct {
+	// Identifies the batches of this plugin in the database, defaults to the
+	// listener route. An error will be thrown if multiple batch plugins with the
+	// same id exist.
+	Id string `mapstructure:"id"`
+
+	// Template used to group items in batches, e.g. `{{ .alertname }}`.
+	// Defaults to one batch for all items.
+	Key *ListenerTemplate `mapstructure:"key"`
+
+	// When a batch reaches this many items, the command is executed right away.
+	// If 0, batches are limited only by maxWait.
+	MaxSize int `mapstructure:"maxSize" validate:"min=0"`
+
+	// The command is executed at most this long after the first item of the
+	// batch has been received
+	MaxWait time.Duration `mapstructure:"maxWait" validate:"required,gt=0"`
+
+	// If true, the items are also written as a JSON array to a temporary file,
+	// which is removed after the execution
+	ToFile bool `mapstructure:"toFile"`
+
+	// If true, batches are stored in the listener database, and shared by all
+	// the replicas which use the same database
+	Shared bool `mapstructure:"shared"`
+}
+
+/// [config]
+// @formatter:on
+
+// @formatter:off
+/// [batch-payload]
+// When the command is executed, the [PluginBatchInfo] payload can be accessed
+// under the [pluginBatchKeyBatchInfo] key, e.g. `{{ len .__qvBatch.items }}`.
+const pluginBatchKeyBatchInfo = "__qvBatch"
+
+type PluginBatchInfo struct {
+	// The evaluated key of the batch
+	Key string `json:"key"`
+
+	// The args of every item, in the order they have been received
+	Items []map[string]interface{} `json:"items"`
+
+	// If toFile is enabled, the path of the file containing the items
+	File string `json:"file,omitempty"`
+}
+
+/// [batch-payload]
+// @formatter:on
+
+// Returned to the caller, when an item is received
+type PluginBatchResult struct {
+	Key string `json:"key"`
+
+	// How many items the batch contains, including this one
+	Count int `json:"count"`
+}
+
+func (c *PluginBatchConfig) NewPlugin(listener *CompiledListener) (PluginInterface, error) {
+	if c.Shared && listener.config.Database == nil {
+		return nil, errors.New("shared batches need the listener database to be defined")
+	}
+
+	var tplKey *ListenerTemplate
+	if c.Key != nil {
+		_tplKey, err := c.Key.CloneForListener(listener)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to clone key template")
+		}
+		tplKey = _tplKey
+	}
+
+	id := c.Id
+	if id == "" {
+		id = listener.route
+	}
+
+	return &PluginBatch{
+		PluginBase: NewPluginBase("batch"),
+		listener:   listener,
+		config:     c,
+		batchId:    id,
+		tplKey:     tplKey,
+		pending:    make(map[string]*pluginBatchPending),
+		flushNow:   make(chan struct{}, 1),
+	}, nil
+}
+
+func (c *PluginBatchConfig) IsUnique() bool {
+	return true
+}
+
+type PluginBatch struct {
+	PluginBase
+	listener *CompiledListener
+	config   *PluginBatchConfig
+
+	batchId string
+	tplKey  *ListenerTemplate
+
+	// Maps key -> in-memory pending batch
+	lock    sync.Mutex
+	pending map[string]*pluginBatchPending
+
+	// Signals the database loop that a batch is full
+	flushNow chan struct{}
+	// Closed to stop the database loop
+	stop chan struct{}
+	// Closed once the database loop completed its last iteration
+	loopDone chan struct{}
+}
+
+type pluginBatchPending struct {
+	items []map[string]interface{}
+	timer *time.Timer
+}
+
+// The same instance is used by all the clones, as it holds the pending batches
+func (p *PluginBatch) Clone(_ *CompiledListener) (PluginInterface, error) {
+	return p, nil
+}
+
+func (p *PluginBatch) NeedsDb() bool {
+	return p.config.Shared
+}
+
+func (p *PluginBatch) Migrations() *migrate.Migrations {
+	return plugin_batch.Migrations
+}
+
+func (p *PluginBatch) ValidateCheckOtherPlugins(otherPlugins []PluginInterface) error {
+	for _, other := range otherPlugins {
+		if other, ok := other.(*PluginBatch); ok {
+			if p.batchId == other.batchId {
+				return errors.Errorf("duplicate batch plugin with id `%s` found", p.batchId)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *PluginBatch) HookRequest(c *gin.Context, args map[string]interface{}) (bool, error) {
+	key := ""
+	if p.tplKey != nil {
+		evaluated, err := p.tplKey.Execute(args)
+		if err != nil {
+			return false, errors.WithMessage(err, "failed to evaluate batch key template")
+		}
+		key = strings.TrimSpace(evaluated)
+	}
+
+	var result *PluginBatchResult
+	var err error
+	if p.isShared() {
+		result, err = p.addShared(key, args, time.Now())
+	} else {
+		result = p.add(key, args)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	c.AbortWithStatusJSON(http.StatusAccepted, result)
+	return true, nil
+}
+
+// Offline, e.g. when running listener tests, there is no database connection,
+// so batches are kept in memory
+func (p *PluginBatch) isShared() bool {
+	return p.config.Shared && p.listener.dbWrapper != nil
+}
+
+func (p *PluginBatch) isFull(count int) bool {
+	return p.config.MaxSize > 0 && count >= p.config.MaxSize
+}
+
+func (p *PluginBatch) add(key string, args map[string]interface{}) *PluginBatchResult {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	pending := p.pending[key]
+	if pending == nil {
+		pending = &pluginBatchPending{}
+		p.pending[key] = pending
+		pending.timer = time.AfterFunc(p.config.MaxWait, func() {
+			p.lock.Lock()
+			if p.pending[key] != pending {
+				// Already executed, because full
+				p.lock.Unlock()
+				return
+			}
+			delete(p.pending, key)
+			// Tracked while holding the lock, so that a shutdown either finds the batch
+			// still pending, or waits for it
+			done := trackExecution()
+			p.lock.Unlock()
+
+			defer done()
+			p.execute(key, pending.items)
+		})
+	}
+
+	pending.items = append(pending.items, args)
+	result := &PluginBatchResult{key, len(pending.items)}
+
+	if p.isFull(len(pending.items)) {
+		pending.timer.Stop()
+		delete(p.pending, key)
+		done := trackExecution()
+		go func() {
+			defer done()
+			p.execute(key, pending.items)
+		}()
+	}
+
+	return result
+}
+
+func (p *PluginBatch) execute(key string, items []map[string]interface{}) {
+	if err := p.executeItems(key, items); err != nil {
+		p.listener.Logger().WithError(err).Error("failed to handle batch request")
+	}
+}
+
+func (p *PluginBatch) executeItems(key string, items []map[string]interface{}) error {
+	info := &PluginBatchInfo{
+		Key:   key,
+		Items: items,
+	}
+
+	if p.config.ToFile {
+		file, err := os.CreateTemp("", "qv-batch-*.json")
+		if err != nil {
+			return errors.WithMessage(err, "failed to create batch file")
+		}
+		defer os.Remove(file.Name())
+
+		err = json.NewEncoder(file).Encode(items)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return errors.WithMessage(err, "failed to write batch file")
+		}
+		info.File = file.Name()
+	}
+
+	_, err := p.listener.handleBackgroundRequest(map[string]interface{}{
+		pluginBatchKeyBatchInfo: info.asArgs(),
+	})
+	return err
+}
+
+// Plain map, so that templates can access the json keys
+func (info *PluginBatchInfo) asArgs() map[string]interface{} {
+	items := make([]interface{}, len(info.Items))
+	for idx, item := range info.Items {
+		items[idx] = item
+	}
+
+	return map[string]interface{}{
+		"key":   info.Key,
+		"items": items,
+		"file":  info.File,
+	}
+}
+
+func (p *PluginBatch) addShared(key string, args map[string]interface{}, now time.Time) (*PluginBatchResult, error) {
+	db := p.listener.dbWrapper.DB()
+
+	item := &plugin_batch.BatchItem{
+		BatchId:   p.batchId,
+		Key:       key,
+		Args:      args,
+		CreatedAt: now,
+	}
+	if _, err := db.NewInsert().Model(item).Exec(context.Background()); err != nil {
+		return nil, errors.WithMessage(err, "failed to insert batch item in database")
+	}
+
+	count, err := db.NewSelect().
+		Model((*plugin_batch.BatchItem)(nil)).
+		Where("batch_id = ?", p.batchId).
+		Where("key = ?", key).
+		Count(context.Background())
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to count batch items")
+	}
+
+	if p.isFull(count) {
+		select {
+		case p.flushNow <- struct{}{}:
+		default:
+		}
+	}
+
+	return &PluginBatchResult{key, count}, nil
+}
+
+// Returns the keys of the batches which are full, or have been waiting for too long.
+// If provided, only the given keys are checked.
+func (p *PluginBatch) dueKeys(ctx context.Context, db bun.IDB, now time.Time, keys ...string) ([]string, error) {
+	query := db.NewSelect().
+		Model((*plugin_batch.BatchItem)(nil)).
+		Column("key").
+		Where("batch_id = ?", p.batchId).
+		Group("key")
+	if len(keys) > 0 {
+		query = query.Where("key IN (?)", bun.In(keys))
+	}
+	if p.config.MaxSize > 0 {
+		query = query.Having("COUNT(*) >= ? OR MIN(created_at) <= ?", p.config.MaxSize, now.Add(-p.config.MaxWait))
+	} else {
+		query = query.Having("MIN(created_at) <= ?", now.Add(-p.config.MaxWait))
+	}
+
+	var due []string
+	if err := query.Scan(ctx, &due); err != nil {
+		return nil, errors.WithMessage(err, "failed to find due batches")
+	}
+	return due, nil
+}
+
+// Executes a batch stored in the database, and removes its items once done
+func (p *PluginBatch) flushShared(key string, now time.Time) error {
+	db := p.listener.dbWrapper.DB()
+
+	var processingError error
+	err := db.RunInTx(context.Background(), nil, func(ctx context.Context, tx bun.Tx) error {
+		// The whole batch is claimed by one replica at a time, so that others never
+		// execute the items received in the meantime as a partial batch
+		var claimed bool
+		if err := tx.NewRaw("SELECT pg_try_advisory_xact_lock(hashtext(?))", p.advisoryLockKey(key)).Scan(ctx, &claimed); err != nil {
+			return errors.WithMessage(err, "failed to claim batch")
+		}
+		if !claimed {
+			return nil
+		}
+
+		// Another replica may have executed the batch since it was found to be due,
+		// and the items received in the meantime must wait for their own batch
+		due, err := p.dueKeys(ctx, tx, now, key)
+		if err != nil {
+			return err
+		}
+		if len(due) == 0 {
+			return nil
+		}
+
+		var items []*plugin_batch.BatchItem
+		query := tx.NewSelect().
+			Model(&items).
+			Where("batch_id = ?", p.batchId).
+			Where("key = ?", key).
+			Order("id ASC")
+		if p.config.MaxSize > 0 {
+			query = query.Limit(p.config.MaxSize)
+		}
+		if err := query.Scan(ctx); err != nil {
+			return errors.WithMessage(err, "failed to select batch items")
+		}
+		if len(items) == 0 {
+			return nil
+		}
+
+		var ids []int64
+		var itemsArgs []map[string]interface{}
+		for _, item := range items {
+			ids = append(ids, item.Id)
+			itemsArgs = append(itemsArgs, item.Args)
+		}
+
+		processingError = p.executeItems(key, itemsArgs)
+
+		if _, err := tx.NewDelete().
+			Model((*plugin_batch.BatchItem)(nil)).
+			Where("id IN (?)", bun.In(ids)).
+			Exec(ctx); err != nil {
+			return errors.WithMessage(err, "failed to delete batch items")
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.WithMessage(err, "failed to process batch (db error)")
+	}
+	return processingError
+}
+
+func (p *PluginBatch) advisoryLockKey(key string) string {
+	return "qvalet-batch|" + p.batchId + "|" + key
+}
+
+func (p *PluginBatch) loop() {
+	defer close(p.loopDone)
+
+	for {
+		keys, err := p.dueKeys(context.Background(), p.listener.dbWrapper.DB(), time.Now())
+		if err != nil {
+			p.listener.Logger().WithError(err).Warn("plugin batch iteration failed")
+		}
+
+		for _, key := range keys {
+			if err := p.flushShared(key, time.Now()); err != nil {
+				p.listener.Logger().WithError(err).Error("failed to handle batch request")
+			}
+		}
+
+		select {
+		case <-p.stop:
+			return
+		case <-p.flushNow:
+		case <-time.After(pluginBatchScanInterval):
+		}
+	}
+}
+
+func (p *PluginBatch) OnStart() error {
+	if !p.isShared() {
+		return nil
+	}
+
+	p.stop = make(chan struct{})
+	p.loopDone = make(chan struct{})
+	go p.loop()
+	return nil
+}
+
+// OnStop executes all the in-memory pending batches, so that no items are lost. Batches
+// stored in the database are executed after the next start.
+func (p *PluginBatch) OnStop() {
+	if p.stop != nil {
+		close(p.stop)
+		<-p.loopDone
+	}
+
+	p.lock.Lock()
+	pending := p.pending
+	p.pending = make(map[string]*pluginBatchPending)
+	p.lock.Unlock()
+
+	// Executed concurrently, so that all of them are drained, and signaled, together
+	wg := sync.WaitGroup{}
+	for key, batch := range pending {
+		key, batch := key, batch
+		batch.timer.Stop()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.execute(key, batch.items)
+		}()
+	}
+	wg.Wait()
+}
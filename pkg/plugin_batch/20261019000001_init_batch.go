@@ -0,0 +1,22 @@
+package plugin_batch
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.NewCreateTable().Model((*BatchItem)(nil)).IfNotExists().Exec(ctx); err != nil {
+			return err
+		}
+
+		if _, err := db.Exec(fmt.Sprintf("CREATE INDEX %s_batch_id_key ON %s (batch_id, key)", tableNameBatchItem, tableNameBatchItem)); err != nil {
+			return err
+		}
+
+		return nil
+	}, nil)
+}
@@ -0,0 +1,26 @@
+package plugin_batch
+
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+const tableNameBatchItem = "batch_items"
+
+type BatchItem struct {
+	bun.BaseModel `bun:"batch_items"`
+
+	Id int64 `bun:",autoincrement"`
+
+	// Which batch plugin has received this item?
+	BatchId string `bun:",nullzero,notnull"`
+
+	// The evaluated key of the item
+	Key string `bun:",notnull"`
+
+	// What arguments have we received?
+	Args map[string]interface{} `bun:"type:json,nullzero"`
+
+	CreatedAt time.Time `bun:",nullzero,notnull"`
+}
@@ -0,0 +1,114 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPluginBatchRequests(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "output.txt")
+	s := newTestServer(t, fmt.Sprintf(`
+listeners:
+  /batch:
+    command: bash
+    args:
+      - -c
+      - |
+        grep -q '"a":"{{ (index .__qvBatch.items 0).a }}"' {{ .__qvBatch.file }}
+        echo "{{ .__qvBatch.key }} {{ len .__qvBatch.items }} {{ range .__qvBatch.items }}{{ .a }}{{ end }}" >> %s
+    plugins:
+      - batch:
+          key: "{{ .alert }}"
+          maxSize: 2
+          maxWait: 1s
+          toFile: true
+`, output))
+
+	require.Equal(t, http.StatusAccepted, s.get("/batch?alert=disk&a=1").Code)
+	require.Equal(t, http.StatusAccepted, s.get("/batch?alert=cpu&a=2").Code)
+
+	// Full batches are executed right away
+	require.Equal(t, http.StatusAccepted, s.get("/batch?alert=disk&a=3").Code)
+	require.Eventually(t, func() bool {
+		data, _ := os.ReadFile(output)
+		return string(data) == "disk 2 13\n"
+	}, 800*time.Millisecond, 10*time.Millisecond)
+
+	// Others are executed after the max wait
+	require.Eventually(t, func() bool {
+		data, _ := os.ReadFile(output)
+		return strings.HasSuffix(string(data), "cpu 1 2\n")
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestPluginBatchShared(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "output.txt")
+	config := testDatabaseDefaults(t) + fmt.Sprintf(`
+listeners:
+  /batch/shared:
+    command: bash
+    args:
+      - -c
+      - |
+        sleep 0.5
+        echo "{{ len .__qvBatch.items }} {{ range .__qvBatch.items }}{{ .a }}{{ end }}" >> %s
+    plugins:
+      - batch:
+          id: %s
+          maxSize: 2
+          maxWait: 1h
+          shared: true
+`, output, testDatabaseId("batch"))
+
+	// Two replicas share the same batches
+	replicas := []*testServer{newTestServer(t, config), newTestServer(t, config)}
+	for idx := 1; idx <= 4; idx++ {
+		w := replicas[idx%2].get(fmt.Sprintf("/batch/shared?a=%d", idx))
+		require.Equal(t, http.StatusAccepted, w.Code)
+	}
+
+	// Every batch is executed once, as a whole
+	require.Eventually(t, func() bool {
+		data, _ := os.ReadFile(output)
+		return string(data) == "2 12\n2 34\n"
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// Replicas which found a batch to be due before another one executed it never
+	// execute the items received in the meantime
+	require.Equal(t, http.StatusAccepted, replicas[0].get("/batch/shared?a=5").Code)
+	var plugin *PluginBatch
+	for _, listener := range replicas[1].MountResults()[0].listenersMap {
+		for _, p := range listener.Plugins() {
+			if p, ok := p.(*PluginBatch); ok {
+				plugin = p
+			}
+		}
+	}
+	require.NoError(t, plugin.flushShared("", time.Now()))
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, "2 12\n2 34\n", string(data))
+}
+
+func TestPluginBatchSharedNeedsDatabase(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestServerConfig(t, filename, `
+listeners:
+  /batch/noDatabase:
+    command: "true"
+    plugins:
+      - batch:
+          maxWait: 1s
+          shared: true
+`)
+
+	_, err := NewServer(ServerOptions{ConfigFilenames: []string{filename}})
+	require.ErrorContains(t, err, "shared batches need the listener database")
+}
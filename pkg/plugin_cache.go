@@ -0,0 +1,424 @@
+package pkg
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"qvalet/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+var _ PluginInterface = (*PluginCache)(nil)
+var _ PluginHookRequest = (*PluginCache)(nil)
+var _ PluginHookGetMiddlewares = (*PluginCache)(nil)
+var _ PluginConfig = (*PluginCacheConfig)(nil)
+
+// Set on the gin context with the key of the response to cache, suffixed by the plugin id
+const pluginCacheContextKeyPrefix = "PluginCacheKey-"
+
+// @formatter:off
+/// [config]
+const pluginCacheDefaultMaxEntries = 1000
+const pluginCacheDefaultBypassHeader = "X-QV-Cache-Bypass"
+
+type PluginCacheConfig struct {
+	// Template used to identify the cached responses, e.g. `{{ .namespace }}`.
+	// Defaults to the request method and path, together with a hash of all the
+	// args, including the body and `__qvAuth`, but not `__qvRequest`.
+	// NOTE: if the response depends on the authenticated user, include it in
+	// the key, e.g. `{{ .namespace }}-{{ .__qvAuth.Username }}`.
+	Key *ListenerTemplate `mapstructure:"key"`
+
+	// How long responses are fresh for
+	TTL time.Duration `mapstructure:"ttl" validate:"required,gt=0"`
+
+	// If provided, once a response is not fresh anymore, it keeps being served
+	// for this long, while it gets refreshed in the background
+	StaleWhileRevalidate *time.Duration `mapstructure:"staleWhileRevalidate" validate:"omitempty,gt=0"`
+
+	// How many responses to keep, the least recently used ones get removed first.
+	// Defaults to [pluginCacheDefaultMaxEntries].
+	MaxEntries int `mapstructure:"maxEntries" validate:"min=0"`
+
+	// Requests with this header set to any value always execute the command,
+	// and refresh the cached response. Defaults to [pluginCacheDefaultBypassHeader].
+	BypassHeader string `mapstructure:"bypassHeader"`
+}
+
+/// [config]
+// @formatter:on
+
+func (c *PluginCacheConfig) NewPlugin(listener *CompiledListener) (PluginInterface, error) {
+	var tplKey *ListenerTemplate
+	if c.Key != nil {
+		_tplKey, err := c.Key.CloneForListener(listener)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to clone key template")
+		}
+		tplKey = _tplKey
+	}
+
+	return &PluginCache{
+		PluginBase: NewPluginBase("cache"),
+		listener:   listener,
+		config:     c,
+		tplKey:     tplKey,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}, nil
+}
+
+func (c *PluginCacheConfig) IsUnique() bool {
+	return true
+}
+
+func (c *PluginCacheConfig) maxEntries() int {
+	if c.MaxEntries > 0 {
+		return c.MaxEntries
+	}
+	return pluginCacheDefaultMaxEntries
+}
+
+func (c *PluginCacheConfig) bypassHeader() string {
+	if c.BypassHeader != "" {
+		return c.BypassHeader
+	}
+	return pluginCacheDefaultBypassHeader
+}
+
+func (c *PluginCacheConfig) staleWhileRevalidate() time.Duration {
+	if c.StaleWhileRevalidate != nil {
+		return *c.StaleWhileRevalidate
+	}
+	return 0
+}
+
+type PluginCache struct {
+	PluginBase
+	listener *CompiledListener
+	config   *PluginCacheConfig
+
+	tplKey *ListenerTemplate
+
+	// Maps key -> element of the lru list, which holds a *pluginCacheEntry.
+	// The most recently used entries are at the front of the list.
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type pluginCacheEntry struct {
+	key string
+
+	status   int
+	header   http.Header
+	body     []byte
+	etag     string
+	response *ListenerResponse
+	storedAt time.Time
+
+	// True while the response is being refreshed in the background
+	revalidating bool
+}
+
+// The same instance is used by all the clones, as it holds the cached responses
+func (p *PluginCache) Clone(_ *CompiledListener) (PluginInterface, error) {
+	return p, nil
+}
+
+func (p *PluginCache) contextKey() string {
+	return pluginCacheContextKeyPrefix + p.Id()
+}
+
+func (p *PluginCache) evaluateKey(c *gin.Context, args map[string]interface{}) (string, error) {
+	if p.tplKey == nil {
+		return pluginCacheDefaultKey(c.Request, args)
+	}
+
+	evaluated, err := p.tplKey.Execute(args)
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to evaluate cache key template")
+	}
+	return strings.TrimSpace(evaluated), nil
+}
+
+// The request details, e.g. the headers and the client address, are not part of the
+// default key, otherwise every client would get its own cached responses
+func pluginCacheDefaultKey(req *http.Request, args map[string]interface{}) (string, error) {
+	hashedArgs := make(map[string]interface{}, len(args))
+	for key, value := range args {
+		if key != utils.KeyArgsRequestKey {
+			hashedArgs[key] = value
+		}
+	}
+
+	data, err := json.Marshal(hashedArgs)
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to hash args for cache key")
+	}
+	hash := sha256.Sum256(data)
+	return req.Method + " " + req.URL.Path + " " + hex.EncodeToString(hash[:]), nil
+}
+
+func (p *PluginCache) HookRequest(c *gin.Context, args map[string]interface{}) (bool, error) {
+	key, err := p.evaluateKey(c, args)
+	if err != nil {
+		return false, err
+	}
+
+	if c.GetHeader(p.config.bypassHeader()) == "" {
+		now := time.Now()
+		if entry, revalidate := p.get(key, now); entry != nil {
+			if revalidate {
+				req, freshArgs := p.revalidationRequest(c.Request, args)
+				go p.revalidate(req, entry, freshArgs)
+			}
+
+			metricsExecutions.Inc(p.listener.route, metricsOutcomeCached)
+			c.Set(ginContextListenerResponse, entry.response)
+			p.writeEntry(c, entry, now)
+			c.Abort()
+			return true, nil
+		}
+	}
+
+	// The middleware caches the response, once written
+	c.Set(p.contextKey(), key)
+	return false, nil
+}
+
+// Returns the cached entry, if fresh or stale but still usable, and whether it needs
+// to be refreshed in the background
+func (p *PluginCache) get(key string, now time.Time) (*pluginCacheEntry, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	element, found := p.entries[key]
+	if !found {
+		return nil, false
+	}
+	entry := element.Value.(*pluginCacheEntry)
+
+	age := now.Sub(entry.storedAt)
+	if age < p.config.TTL {
+		p.lru.MoveToFront(element)
+		return entry, false
+	}
+
+	if age < p.config.TTL+p.config.staleWhileRevalidate() {
+		p.lru.MoveToFront(element)
+		revalidate := !entry.revalidating
+		entry.revalidating = true
+		return entry, revalidate
+	}
+
+	p.lru.Remove(element)
+	delete(p.entries, key)
+	return nil, false
+}
+
+func (p *PluginCache) set(entry *pluginCacheEntry) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if element, found := p.entries[entry.key]; found {
+		p.lru.Remove(element)
+	}
+	p.entries[entry.key] = p.lru.PushFront(entry)
+
+	for p.lru.Len() > p.config.maxEntries() {
+		oldest := p.lru.Back()
+		p.lru.Remove(oldest)
+		delete(p.entries, oldest.Value.(*pluginCacheEntry).key)
+	}
+}
+
+func (p *PluginCache) newEntry(key string, status int, header http.Header, body []byte, response *ListenerResponse) *pluginCacheEntry {
+	// The request id belongs to the request which gets the cached response
+	header = header.Clone()
+	header.Del(utils.HeaderRequestId)
+
+	hash := sha256.Sum256(body)
+	return &pluginCacheEntry{
+		key:      key,
+		status:   status,
+		header:   header,
+		body:     body,
+		etag:     fmt.Sprintf(`"%s"`, hex.EncodeToString(hash[:16])),
+		response: response,
+		storedAt: time.Now(),
+	}
+}
+
+// Only successful responses are cached
+func pluginCacheIsCacheable(status int) bool {
+	return status >= 200 && status < 300
+}
+
+func (p *PluginCache) writeEntry(c *gin.Context, entry *pluginCacheEntry, now time.Time) {
+	header := c.Writer.Header()
+	for key, values := range entry.header {
+		header[key] = values
+	}
+
+	maxAge := int(math.Max(0, math.Ceil((p.config.TTL - now.Sub(entry.storedAt)).Seconds())))
+	header.Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAge))
+	header.Set("Age", strconv.Itoa(int(now.Sub(entry.storedAt).Seconds())))
+	header.Set("ETag", entry.etag)
+
+	if pluginCacheETagMatches(c.GetHeader("If-None-Match"), entry.etag) {
+		c.Status(http.StatusNotModified)
+		c.Writer.WriteHeaderNow()
+		return
+	}
+
+	c.Status(entry.status)
+	_, _ = c.Writer.Write(entry.body)
+}
+
+func pluginCacheETagMatches(ifNoneMatch string, etag string) bool {
+	for _, value := range strings.Split(ifNoneMatch, ",") {
+		value = strings.TrimSpace(value)
+		if value == "*" || strings.TrimPrefix(value, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Builds a fresh request out of the original one, which is not usable anymore once its
+// handler has returned
+func (p *PluginCache) revalidationRequest(original *http.Request, args map[string]interface{}) (*http.Request, map[string]interface{}) {
+	req := httptest.NewRequest(original.Method, original.URL.RequestURI(), nil)
+	req.Host = original.Host
+	req.RemoteAddr = original.RemoteAddr
+	req.Header = original.Header.Clone()
+	req.Header.Del("If-None-Match")
+
+	freshArgs := make(map[string]interface{}, len(args))
+	for key, value := range args {
+		freshArgs[key] = value
+	}
+	return req, freshArgs
+}
+
+// Executes the listener again, to refresh a stale response. The other request plugins, e.g.
+// rate limits and dedupe, are skipped on purpose: the refresh is not a request sent by a
+// client, and must never use up, or leave behind, their state.
+func (p *PluginCache) revalidate(req *http.Request, entry *pluginCacheEntry, args map[string]interface{}) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = req
+
+	handleListenerRequest(c, p.listener, args)
+
+	if !pluginCacheIsCacheable(w.Code) {
+		p.listener.Logger().WithField("status", w.Code).Warn("failed to refresh cached response")
+
+		p.lock.Lock()
+		entry.revalidating = false
+		p.lock.Unlock()
+		return
+	}
+
+	var response *ListenerResponse
+	if value, found := c.Get(ginContextListenerResponse); found {
+		response, _ = value.(*ListenerResponse)
+	}
+	p.set(p.newEntry(entry.key, w.Code, w.Header(), w.Body.Bytes(), response))
+}
+
+// Buffers the response, so that it can be cached, and caching headers can be added
+type pluginCacheResponseWriter struct {
+	gin.ResponseWriter
+
+	status  int
+	written bool
+	body    bytes.Buffer
+}
+
+func (w *pluginCacheResponseWriter) WriteHeader(code int) {
+	if code > 0 && !w.written {
+		w.status = code
+	}
+}
+
+func (w *pluginCacheResponseWriter) WriteHeaderNow() {
+	w.written = true
+}
+
+func (w *pluginCacheResponseWriter) Write(data []byte) (int, error) {
+	w.written = true
+	return w.body.Write(data)
+}
+
+func (w *pluginCacheResponseWriter) WriteString(s string) (int, error) {
+	w.written = true
+	return w.body.WriteString(s)
+}
+
+func (w *pluginCacheResponseWriter) Status() int {
+	return w.status
+}
+
+func (w *pluginCacheResponseWriter) Size() int {
+	if !w.written {
+		return -1
+	}
+	return w.body.Len()
+}
+
+func (w *pluginCacheResponseWriter) Written() bool {
+	return w.written
+}
+
+func (p *PluginCache) HookGetMiddlewares(_ string) []gin.HandlerFunc {
+	return []gin.HandlerFunc{func(c *gin.Context) {
+		original := c.Writer
+		writer := &pluginCacheResponseWriter{ResponseWriter: original, status: http.StatusOK}
+		c.Writer = writer
+
+		c.Next()
+
+		c.Writer = original
+		body := writer.body.Bytes()
+
+		if key := c.GetString(p.contextKey()); key != "" && pluginCacheIsCacheable(writer.status) {
+			var response *ListenerResponse
+			if value, found := c.Get(ginContextListenerResponse); found {
+				response, _ = value.(*ListenerResponse)
+			}
+
+			entry := p.newEntry(key, writer.status, original.Header(), body, response)
+			p.set(entry)
+
+			original.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(p.config.TTL.Seconds())))
+			original.Header().Set("ETag", entry.etag)
+
+			if pluginCacheETagMatches(c.GetHeader("If-None-Match"), entry.etag) {
+				original.WriteHeader(http.StatusNotModified)
+				original.WriteHeaderNow()
+				return
+			}
+		}
+
+		original.WriteHeader(writer.status)
+		if writer.written {
+			original.WriteHeaderNow()
+		}
+		_, _ = original.Write(body)
+	}}
+}
@@ -0,0 +1,161 @@
+package pkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPluginCacheRequests(t *testing.T) {
+	s := newTestServer(t, `
+listeners:
+  /pods:
+    return: output
+    command: bash
+    args: [ -c, "date +%s%N" ]
+    plugins:
+      - httpResponse:
+          headers:
+            X-Namespace: "{{ .namespace }}"
+      - cache:
+          key: "{{ .namespace }}"
+          ttl: 1h
+          maxEntries: 1
+  /status:
+    return: output
+    command: bash
+    args: [ -c, "date +%s%N" ]
+    plugins:
+      - cache:
+          ttl: 100ms
+          staleWhileRevalidate: 1h
+`)
+
+	serve := func(path string, header string, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		return s.serve(req)
+	}
+
+	first := s.get("/pods?namespace=default")
+	require.Equal(t, http.StatusOK, first.Code)
+	require.Equal(t, "max-age=3600", first.Header().Get("Cache-Control"))
+	etag := first.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	// Cached responses keep the headers set by other plugins
+	cached := s.get("/pods?namespace=default")
+	require.Equal(t, first.Body.String(), cached.Body.String())
+	require.Equal(t, "default", cached.Header().Get("X-Namespace"))
+	require.Equal(t, etag, cached.Header().Get("ETag"))
+
+	notModified := serve("/pods?namespace=default", "If-None-Match", etag)
+	require.Equal(t, http.StatusNotModified, notModified.Code)
+	require.Empty(t, notModified.Body.String())
+
+	// The bypass header refreshes the cached response
+	bypassed := serve("/pods?namespace=default", "X-QV-Cache-Bypass", "true")
+	require.NotEqual(t, first.Body.String(), bypassed.Body.String())
+	require.Equal(t, bypassed.Body.String(), s.get("/pods?namespace=default").Body.String())
+
+	// Only the most recently used entry is kept
+	other := s.get("/pods?namespace=other")
+	require.Equal(t, other.Body.String(), s.get("/pods?namespace=other").Body.String())
+	require.NotEqual(t, bypassed.Body.String(), s.get("/pods?namespace=default").Body.String())
+
+	// Stale responses are served while refreshed in the background
+	stale := s.get("/status").Body.String()
+	time.Sleep(150 * time.Millisecond)
+	require.Equal(t, stale, s.get("/status").Body.String())
+	require.Eventually(t, func() bool {
+		return s.get("/status").Body.String() != stale
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPluginCacheDefaultKey(t *testing.T) {
+	s := newTestServer(t, `
+listeners:
+  /report:
+    return: output
+    command: bash
+    args: [ -c, "date +%s%N" ]
+    auth:
+      - apiKeys: [ alicePassword ]
+        basicAuth: true
+        basicAuthUser: alice
+      - apiKeys: [ bobPassword ]
+        basicAuth: true
+        basicAuthUser: bob
+    plugins:
+      - cache:
+          ttl: 1h
+`)
+
+	serve := func(user string, password string, body string) string {
+		req := httptest.NewRequest(http.MethodPost, "/report", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.SetBasicAuth(user, password)
+		w := s.serve(req)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+
+	// The body and the authenticated identity are part of the default key
+	alice := serve("alice", "alicePassword", `{"month":1}`)
+	require.Equal(t, alice, serve("alice", "alicePassword", `{"month":1}`))
+	require.NotEqual(t, alice, serve("alice", "alicePassword", `{"month":2}`))
+	require.NotEqual(t, alice, serve("bob", "bobPassword", `{"month":1}`))
+}
+
+func TestPluginCacheRevalidateSkipsPlugins(t *testing.T) {
+	s := newTestServer(t, `
+listeners:
+  /combined:
+    return: output
+    command: bash
+    args: [ -c, "date +%s%N" ]
+    plugins:
+      - cache:
+          ttl: 100ms
+          staleWhileRevalidate: 1h
+      - rateLimit:
+          limits:
+            - requests: 2
+              window: 1h
+      - dedupe: {}
+      - circuitBreaker:
+          failures: 1
+          window: 1h
+          cooldown: 1h
+`)
+
+	serve := func(bypass bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/combined", nil)
+		req.Header.Set("X-GitHub-Delivery", "abc")
+		if bypass {
+			req.Header.Set("X-QV-Cache-Bypass", "true")
+		}
+		return s.serve(req)
+	}
+
+	first := serve(false)
+	require.Equal(t, http.StatusOK, first.Code)
+	time.Sleep(150 * time.Millisecond)
+
+	// Background refreshes are not deduplicated against the delivery of the stale response
+	require.Equal(t, first.Body.String(), serve(false).Body.String())
+	require.Eventually(t, func() bool {
+		return serve(false).Body.String() != first.Body.String()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Refreshes neither use up rate limit tokens, nor leave dedupe entries in progress
+	duplicate := serve(true)
+	require.Equal(t, http.StatusOK, duplicate.Code)
+	require.Equal(t, first.Body.String(), duplicate.Body.String())
+}
@@ -0,0 +1,493 @@
+package pkg
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"qvalet/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+var _ PluginInterface = (*PluginCircuitBreaker)(nil)
+var _ PluginHookRequest = (*PluginCircuitBreaker)(nil)
+var _ PluginHookGetMiddlewares = (*PluginCircuitBreaker)(nil)
+var _ PluginHookPreview = (*PluginCircuitBreaker)(nil)
+var _ PluginConfig = (*PluginCircuitBreakerConfig)(nil)
+
+// Set on the gin context with the *pluginCircuitBreakerRequest being handled, suffixed by the plugin id
+const pluginCircuitBreakerContextKeyPrefix = "PluginCircuitBreakerRequest-"
+
+const (
+	pluginCircuitBreakerStateClosed   = "closed"
+	pluginCircuitBreakerStateOpen     = "open"
+	pluginCircuitBreakerStateHalfOpen = "half_open"
+)
+
+// @formatter:off
+/// [config]
+const pluginCircuitBreakerDefaultStatus = http.StatusServiceUnavailable
+
+type PluginCircuitBreakerConfig struct {
+	// Identifies the circuits of this plugin, defaults to the listener route.
+	// Listeners with the same id share the same circuits.
+	Id string `mapstructure:"id"`
+
+	// Template used to group requests in circuits, e.g. `{{ .region }}`, so
+	// that a failing dependency does not block requests which do not use it.
+	// Defaults to a single circuit for all requests.
+	Key *ListenerTemplate `mapstructure:"key"`
+
+	// How many failed executions, within the window, open the circuit
+	Failures int `mapstructure:"failures" validate:"required,min=1"`
+
+	// Duration of the rolling window in which failures are counted, e.g. `1m`
+	Window time.Duration `mapstructure:"window" validate:"required,gt=0"`
+
+	// How long the circuit stays open, before letting a single request through
+	// to check if the command works again
+	Cooldown time.Duration `mapstructure:"cooldown" validate:"required,gt=0"`
+
+	// Status code returned while the circuit is open, defaults to
+	// [pluginCircuitBreakerDefaultStatus]
+	Status int `mapstructure:"status" validate:"omitempty,min=100,max=599"`
+
+	// If provided, the body returned while the circuit is open
+	Body *ListenerTemplate `mapstructure:"body"`
+
+	// If true, while the circuit is open, requests are passed straight to the
+	// listener errorHandler, without executing the command
+	ErrorHandler bool `mapstructure:"errorHandler"`
+}
+
+/// [config]
+// @formatter:on
+
+// @formatter:off
+/// [circuit-breaker-payload]
+// When a request is rejected, and the listener has a storage, the [PluginCircuitBreakerInfo]
+// payload is stored under the [pluginCircuitBreakerKeyCircuitOpen] key.
+const pluginCircuitBreakerKeyCircuitOpen = "circuitOpen"
+
+type PluginCircuitBreakerInfo struct {
+	// The evaluated key of the request
+	Key string `json:"key"`
+
+	// One of `closed`, `open`, `half_open`
+	State string `json:"state"`
+
+	// Failures within the window
+	Failures int `json:"failures"`
+
+	// When the circuit was opened, if not closed
+	OpenedAt *time.Time `json:"openedAt,omitempty"`
+
+	// When the circuit lets a request through again, if open
+	RetryAt *time.Time `json:"retryAt,omitempty"`
+}
+
+/// [circuit-breaker-payload]
+// @formatter:on
+
+func (c *PluginCircuitBreakerConfig) NewPlugin(listener *CompiledListener) (PluginInterface, error) {
+	if c.ErrorHandler && listener.errorHandler == nil {
+		return nil, errors.New("circuit breaker errorHandler is enabled, but the listener has no errorHandler")
+	}
+
+	var tplKey *ListenerTemplate
+	if c.Key != nil {
+		_tplKey, err := c.Key.CloneForListener(listener)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to clone key template")
+		}
+		tplKey = _tplKey
+	}
+
+	var tplBody *ListenerTemplate
+	if c.Body != nil {
+		_tplBody, err := c.Body.CloneForListener(listener)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to clone body template")
+		}
+		tplBody = _tplBody
+	}
+
+	id := c.Id
+	if id == "" {
+		id = listener.route
+	}
+
+	return &PluginCircuitBreaker{
+		PluginBase: NewPluginBase("circuit-breaker"),
+		listener:   listener,
+		config:     c,
+		circuitsId: id,
+		tplKey:     tplKey,
+		tplBody:    tplBody,
+	}, nil
+}
+
+func (c *PluginCircuitBreakerConfig) IsUnique() bool {
+	return true
+}
+
+func (c *PluginCircuitBreakerConfig) status() int {
+	if c.Status > 0 {
+		return c.Status
+	}
+	return pluginCircuitBreakerDefaultStatus
+}
+
+type PluginCircuitBreaker struct {
+	PluginBase
+	listener *CompiledListener
+	config   *PluginCircuitBreakerConfig
+
+	circuitsId string
+	tplKey     *ListenerTemplate
+	tplBody    *ListenerTemplate
+}
+
+type pluginCircuitBreakerCircuit struct {
+	// The id of the circuits the circuit belongs to, used as metrics label
+	circuitsId string
+
+	state string
+
+	// Times of the failures within the window, oldest first
+	failures []time.Time
+
+	openedAt time.Time
+
+	// True while the single request let through by a half-open circuit is in progress
+	probing bool
+}
+
+type pluginCircuitBreakerRequest struct {
+	key string
+
+	// True if this is the request let through by a half-open circuit
+	probe bool
+}
+
+// Maximum number of in-memory circuits, so that requests with ever-changing keys
+// cannot exhaust the memory
+const pluginCircuitBreakerMaxCircuits = 100000
+
+// Maps circuit key -> *pluginCircuitBreakerCircuit, kept for the whole lifetime of the
+// process, so that circuits survive config reloads. Closed circuits expire once they have
+// no failures within the window.
+var pluginCircuitBreakerCircuits = newPluginCircuitBreakerCircuits()
+
+func newPluginCircuitBreakerCircuits() *utils.Cache {
+	circuits := utils.NewCacheWithMaxEntries(pluginCircuitBreakerMaxCircuits)
+	// Evicted circuits are forgotten, so they do not count as open anymore
+	circuits.SetEvictHandler(func(_ string, value interface{}) {
+		if circuit := value.(*pluginCircuitBreakerCircuit); circuit.state != pluginCircuitBreakerStateClosed {
+			metricsCircuitBreakersOpen.Dec(circuit.circuitsId)
+		}
+	})
+	return circuits
+}
+
+func (p *PluginCircuitBreaker) Clone(_ *CompiledListener) (PluginInterface, error) {
+	return p, nil
+}
+
+func (p *PluginCircuitBreaker) contextKey() string {
+	return pluginCircuitBreakerContextKeyPrefix + p.Id()
+}
+
+func (p *PluginCircuitBreaker) circuitKey(key string) string {
+	return p.circuitsId + "|" + key
+}
+
+func (p *PluginCircuitBreaker) evaluateKey(args map[string]interface{}) (string, error) {
+	if p.tplKey == nil {
+		return "", nil
+	}
+
+	evaluated, err := p.tplKey.Execute(args)
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to evaluate circuit breaker key template")
+	}
+	return strings.TrimSpace(evaluated), nil
+}
+
+func (p *PluginCircuitBreaker) HookRequest(c *gin.Context, args map[string]interface{}) (bool, error) {
+	key, err := p.evaluateKey(args)
+	if err != nil {
+		return false, err
+	}
+
+	allowed, probe, info := p.allow(key, time.Now())
+	if allowed {
+		// The middleware records the outcome of the execution
+		c.Set(p.contextKey(), &pluginCircuitBreakerRequest{key, probe})
+		return false, nil
+	}
+
+	metricsExecutions.Inc(p.listener.route, metricsOutcomeCircuitOpen)
+	p.listener.log.WithField("key", key).Warn("request rejected, circuit breaker is open")
+
+	toStore := map[string]interface{}{
+		pluginCircuitBreakerKeyCircuitOpen: info,
+	}
+	if p.listener.storager != nil && p.listener.config.Storage.StoreArgs() {
+		toStore["args"] = p.listener.redactor.Args(args)
+	}
+
+	if info.RetryAt != nil {
+		retryAfterSeconds := math.Max(1, math.Ceil(time.Until(*info.RetryAt).Seconds()))
+		c.Header("Retry-After", strconv.Itoa(int(retryAfterSeconds)))
+	}
+
+	errOpen := errors.Errorf("circuit breaker is open for key %q", key)
+
+	if p.config.ErrorHandler {
+		// Every execution needs its own clone, to handle temporary files
+		l, err := p.listener.clone()
+		if err != nil {
+			return false, errors.WithMessage(err, "failed to clone listener")
+		}
+
+		errorHandlerResult, toStoreOnError := l.executeErrorHandler(args, errOpen, nil)
+		toStore["errorHandler"] = toStoreOnError
+
+		response := &ListenerResponse{
+			Error:              stringPtr(errOpen.Error()),
+			ErrorHandlerResult: errorHandlerResult,
+		}
+		if p.listener.storager != nil {
+			if entry := storePayload(p.listener, toStore); entry != nil && p.listener.config.ReturnStorage() {
+				response.Storage = entry
+			}
+		}
+
+		c.AbortWithStatusJSON(p.config.status(), response)
+		return true, nil
+	}
+
+	if p.listener.storager != nil {
+		storePayload(p.listener, toStore)
+	}
+
+	if p.tplBody != nil {
+		body, err := p.tplBody.Execute(args)
+		if err != nil {
+			return false, errors.WithMessage(err, "failed to evaluate circuit breaker body template")
+		}
+		c.String(p.config.status(), body)
+		c.Abort()
+		return true, nil
+	}
+
+	c.AbortWithError(p.config.status(), errOpen)
+	return true, nil
+}
+
+// Records the outcome of the executions let through
+func (p *PluginCircuitBreaker) HookGetMiddlewares(_ string) []gin.HandlerFunc {
+	return []gin.HandlerFunc{func(c *gin.Context) {
+		// Deferred, so that the probe of a half-open circuit is released even if the handler
+		// panics, otherwise the circuit would reject all the following requests
+		defer p.recordOutcome(c)
+		c.Next()
+	}}
+}
+
+func (p *PluginCircuitBreaker) recordOutcome(c *gin.Context) {
+	value, found := c.Get(p.contextKey())
+	if !found {
+		return
+	}
+	request := value.(*pluginCircuitBreakerRequest)
+
+	var response *ListenerResponse
+	if value, found := c.Get(ginContextListenerResponse); found {
+		response, _ = value.(*ListenerResponse)
+	}
+
+	if response == nil {
+		// The command was not executed, e.g. because another plugin handled the request
+		p.release(request)
+		return
+	}
+
+	failed := response.Error != nil || c.Writer.Status() >= http.StatusInternalServerError
+	p.record(request, failed, time.Now())
+}
+
+func (p *PluginCircuitBreaker) HookPreview(args map[string]interface{}) (string, interface{}, error) {
+	key, err := p.evaluateKey(args)
+	if err != nil {
+		return "", nil, err
+	}
+
+	pluginCircuitBreakerCircuits.Lock()
+	defer pluginCircuitBreakerCircuits.Unlock()
+
+	return "circuitBreaker", p.info(key, p.get(key), time.Now()), nil
+}
+
+// Returns the circuit for the key, or nil if it is closed and has no failures.
+// Must be called while holding the circuits lock.
+func (p *PluginCircuitBreaker) get(key string) *pluginCircuitBreakerCircuit {
+	if circuit := pluginCircuitBreakerCircuits.Get(p.circuitKey(key)); circuit != nil {
+		return circuit.(*pluginCircuitBreakerCircuit)
+	}
+	return nil
+}
+
+// Stores the circuit, closed circuits expire once their failures leave the window.
+// Must be called while holding the circuits lock.
+func (p *PluginCircuitBreaker) set(key string, circuit *pluginCircuitBreakerCircuit) {
+	if circuit.state != pluginCircuitBreakerStateClosed {
+		pluginCircuitBreakerCircuits.Set(p.circuitKey(key), circuit)
+		return
+	}
+
+	if len(circuit.failures) == 0 {
+		pluginCircuitBreakerCircuits.Delete(p.circuitKey(key))
+		return
+	}
+
+	lastFailure := circuit.failures[len(circuit.failures)-1]
+	pluginCircuitBreakerCircuits.SetWithExpiry(p.circuitKey(key), circuit, lastFailure.Add(p.config.Window))
+}
+
+func (p *PluginCircuitBreaker) info(key string, circuit *pluginCircuitBreakerCircuit, now time.Time) *PluginCircuitBreakerInfo {
+	info := &PluginCircuitBreakerInfo{
+		Key:   key,
+		State: pluginCircuitBreakerStateClosed,
+	}
+	if circuit == nil {
+		return info
+	}
+
+	info.State = circuit.state
+	info.Failures = len(p.pruneFailures(circuit, now))
+	if circuit.state != pluginCircuitBreakerStateClosed {
+		openedAt := circuit.openedAt
+		info.OpenedAt = &openedAt
+	}
+	if circuit.state == pluginCircuitBreakerStateOpen {
+		retryAt := circuit.openedAt.Add(p.config.Cooldown)
+		info.RetryAt = &retryAt
+	}
+	return info
+}
+
+// Removes the failures which are not within the window anymore
+func (p *PluginCircuitBreaker) pruneFailures(circuit *pluginCircuitBreakerCircuit, now time.Time) []time.Time {
+	idx := 0
+	for idx < len(circuit.failures) && now.Sub(circuit.failures[idx]) >= p.config.Window {
+		idx++
+	}
+	circuit.failures = circuit.failures[idx:]
+	return circuit.failures
+}
+
+func (p *PluginCircuitBreaker) transition(key string, circuit *pluginCircuitBreakerCircuit, state string, now time.Time) {
+	previous := circuit.state
+	circuit.state = state
+
+	switch state {
+	case pluginCircuitBreakerStateOpen:
+		circuit.openedAt = now
+		if previous == pluginCircuitBreakerStateClosed {
+			metricsCircuitBreakersOpen.Inc(p.circuitsId)
+		}
+	case pluginCircuitBreakerStateClosed:
+		circuit.failures = nil
+		metricsCircuitBreakersOpen.Dec(p.circuitsId)
+	}
+	metricsCircuitBreakerTransitions.Inc(p.circuitsId, state)
+
+	log := p.listener.log.WithField("key", key).WithField("circuitBreaker", p.circuitsId)
+	switch state {
+	case pluginCircuitBreakerStateOpen:
+		log.WithField("failures", len(circuit.failures)).Warnf("circuit breaker opened for %s", p.config.Cooldown)
+	case pluginCircuitBreakerStateHalfOpen:
+		log.Info("circuit breaker half-open, letting a request through")
+	case pluginCircuitBreakerStateClosed:
+		log.Info("circuit breaker closed")
+	}
+}
+
+// Returns whether the request can be executed, and if it is the request let through by a
+// half-open circuit. If not allowed, it returns the current state of the circuit.
+func (p *PluginCircuitBreaker) allow(key string, now time.Time) (bool, bool, *PluginCircuitBreakerInfo) {
+	pluginCircuitBreakerCircuits.Lock()
+	defer pluginCircuitBreakerCircuits.Unlock()
+
+	circuit := p.get(key)
+	if circuit == nil || circuit.state == pluginCircuitBreakerStateClosed {
+		return true, false, nil
+	}
+
+	if circuit.state == pluginCircuitBreakerStateOpen && now.Sub(circuit.openedAt) >= p.config.Cooldown {
+		p.transition(key, circuit, pluginCircuitBreakerStateHalfOpen, now)
+	}
+
+	if circuit.state == pluginCircuitBreakerStateHalfOpen && !circuit.probing {
+		circuit.probing = true
+		return true, true, nil
+	}
+
+	return false, false, p.info(key, circuit, now)
+}
+
+func (p *PluginCircuitBreaker) record(request *pluginCircuitBreakerRequest, failed bool, now time.Time) {
+	pluginCircuitBreakerCircuits.Lock()
+	defer pluginCircuitBreakerCircuits.Unlock()
+
+	circuit := p.get(request.key)
+
+	if request.probe {
+		if circuit == nil || circuit.state != pluginCircuitBreakerStateHalfOpen {
+			return
+		}
+		circuit.probing = false
+
+		if failed {
+			p.transition(request.key, circuit, pluginCircuitBreakerStateOpen, now)
+		} else {
+			p.transition(request.key, circuit, pluginCircuitBreakerStateClosed, now)
+		}
+		p.set(request.key, circuit)
+		return
+	}
+
+	// Outcomes of executions which started before the circuit opened do not matter
+	if !failed || (circuit != nil && circuit.state != pluginCircuitBreakerStateClosed) {
+		return
+	}
+
+	if circuit == nil {
+		circuit = &pluginCircuitBreakerCircuit{circuitsId: p.circuitsId, state: pluginCircuitBreakerStateClosed}
+	}
+	circuit.failures = append(p.pruneFailures(circuit, now), now)
+	if len(circuit.failures) >= p.config.Failures {
+		p.transition(request.key, circuit, pluginCircuitBreakerStateOpen, now)
+	}
+	p.set(request.key, circuit)
+}
+
+// Lets another request through, if the probe of a half-open circuit was not executed
+func (p *PluginCircuitBreaker) release(request *pluginCircuitBreakerRequest) {
+	if !request.probe {
+		return
+	}
+
+	pluginCircuitBreakerCircuits.Lock()
+	defer pluginCircuitBreakerCircuits.Unlock()
+
+	if circuit := p.get(request.key); circuit != nil {
+		circuit.probing = false
+	}
+}
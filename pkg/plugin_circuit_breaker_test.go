@@ -0,0 +1,130 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPluginCircuitBreakerRequests(t *testing.T) {
+	s := newTestServer(t, `
+listeners:
+  /sync:
+    return: output
+    command: bash
+    args: [ -c, "echo synced; exit {{ .code }}" ]
+    plugins:
+      - preview: {}
+      - circuitBreaker:
+          key: "{{ .region }}"
+          failures: 2
+          window: 1m
+          cooldown: 200ms
+          body: "{{ .region }} is down"
+  /notify:
+    command: bash
+    args: [ -c, "exit 1" ]
+    errorHandler:
+      return: output
+      command: echo
+      args: [ "handled {{ .error }}" ]
+    plugins:
+      - circuitBreaker:
+          failures: 1
+          window: 1m
+          cooldown: 1h
+          status: 500
+          errorHandler: true
+`)
+
+	previewState := func(region string) string {
+		var preview struct {
+			Plugins struct {
+				CircuitBreaker PluginCircuitBreakerInfo `json:"circuitBreaker"`
+			} `json:"plugins"`
+		}
+		require.NoError(t, json.Unmarshal(s.get("/sync/preview?code=0&region="+region).Body.Bytes(), &preview))
+		return preview.Plugins.CircuitBreaker.State
+	}
+
+	require.Equal(t, http.StatusInternalServerError, s.get("/sync?code=1&region=eu").Code)
+	require.Equal(t, pluginCircuitBreakerStateClosed, previewState("eu"))
+	require.Equal(t, http.StatusInternalServerError, s.get("/sync?code=1&region=eu").Code)
+	require.Equal(t, pluginCircuitBreakerStateOpen, previewState("eu"))
+
+	// Open circuits reject requests without executing the command
+	rejected := s.get("/sync?code=0&region=eu")
+	require.Equal(t, http.StatusServiceUnavailable, rejected.Code)
+	require.Equal(t, "eu is down", rejected.Body.String())
+	require.Equal(t, "1", rejected.Header().Get("Retry-After"))
+
+	// Other keys are not affected
+	require.Equal(t, http.StatusOK, s.get("/sync?code=0&region=us").Code)
+
+	// After the cooldown, a successful request closes the circuit
+	time.Sleep(250 * time.Millisecond)
+	require.Equal(t, http.StatusOK, s.get("/sync?code=0&region=eu").Code)
+	require.Equal(t, pluginCircuitBreakerStateClosed, previewState("eu"))
+
+	// A failed request while half-open opens the circuit again
+	require.Equal(t, http.StatusInternalServerError, s.get("/sync?code=1&region=eu").Code)
+	require.Equal(t, http.StatusInternalServerError, s.get("/sync?code=1&region=eu").Code)
+	time.Sleep(250 * time.Millisecond)
+	require.Equal(t, http.StatusInternalServerError, s.get("/sync?code=1&region=eu").Code)
+	require.Equal(t, pluginCircuitBreakerStateOpen, previewState("eu"))
+
+	// Rejected requests can be routed to the error handler
+	require.Equal(t, http.StatusInternalServerError, s.get("/notify").Code)
+	routed := s.get("/notify")
+	require.Equal(t, http.StatusInternalServerError, routed.Code)
+	var response ListenerResponse
+	require.NoError(t, json.Unmarshal(routed.Body.Bytes(), &response))
+	require.Nil(t, response.ExecCommandResult)
+	require.NotNil(t, response.ErrorHandlerResult)
+	require.Contains(t, response.ErrorHandlerResult.Output, "handled circuit breaker is open")
+}
+
+func TestPluginCircuitBreakerProbePanic(t *testing.T) {
+	s := newTestServer(t, `
+listeners:
+  /circuitBreaker/panic:
+    command: "false"
+    plugins:
+      - circuitBreaker:
+          failures: 1
+          window: 1m
+          cooldown: 100ms
+`)
+
+	var plugin *PluginCircuitBreaker
+	for _, listener := range s.MountResults()[0].listenersMap {
+		for _, p := range listener.Plugins() {
+			if p, ok := p.(*PluginCircuitBreaker); ok {
+				plugin = p
+			}
+		}
+	}
+
+	// The probe of the half-open circuit panics
+	engine := gin.New()
+	engine.Use(gin.Recovery())
+	engine.GET("/probe", append(plugin.HookGetMiddlewares(http.MethodGet), func(c *gin.Context) {
+		if handled, _ := plugin.HookRequest(c, map[string]interface{}{}); !handled {
+			panic("probe failed")
+		}
+	})...)
+
+	require.Equal(t, http.StatusInternalServerError, s.get("/circuitBreaker/panic").Code)
+	time.Sleep(150 * time.Millisecond)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/probe", nil))
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+
+	// Another request is let through, instead of the circuit staying half-open forever
+	require.Equal(t, http.StatusInternalServerError, s.get("/circuitBreaker/panic").Code)
+}
@@ -0,0 +1,357 @@
+package pkg
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"qvalet/pkg/plugin_schedule"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/migrate"
+)
+
+var _ PluginInterface = (*PluginDebounce)(nil)
+var _ PluginHookRequest = (*PluginDebounce)(nil)
+var _ PluginLifecycle = (*PluginDebounce)(nil)
+var _ PluginConfigNeedsDb = (*PluginDebounce)(nil)
+var _ PluginConfigValidateCheckOtherPlugins = (*PluginDebounce)(nil)
+var _ PluginConfig = (*PluginDebounceConfig)(nil)
+
+// @formatter:off
+/// [config]
+type PluginDebounceConfig struct {
+	// Template used to group events, e.g. `{{ .repository.name }}`. Events with
+	// the same key collapse into one execution. Defaults to one group for all events.
+	Key *ListenerTemplate `mapstructure:"key"`
+
+	// The command is executed once no new events have been received for this long
+	QuietPeriod time.Duration `mapstructure:"quietPeriod" validate:"required,gt=0"`
+
+	// If provided, the command is executed at most this long after the first event,
+	// even if new events keep arriving
+	MaxWait *time.Duration `mapstructure:"maxWait" validate:"omitempty,gt=0"`
+
+	// If true, the args of all the events are merged, with the latest events'
+	// values overriding the previous ones. Otherwise, only the args of the
+	// last event are used.
+	Merge bool `mapstructure:"merge"`
+
+	// If provided, pending executions are stored in the database as tasks of the
+	// schedule plugin with this id, which needs to be defined on the same listener,
+	// so that they survive restarts
+	ScheduleId string `mapstructure:"scheduleId"`
+}
+
+/// [config]
+// @formatter:on
+
+// @formatter:off
+/// [debounce-payload]
+// When the command is executed, the [PluginDebounceInfo] payload can be accessed
+// under the [pluginDebounceKeyDebounceInfo] key, e.g. `{{ .__qvDebounce.count }}`.
+const pluginDebounceKeyDebounceInfo = "__qvDebounce"
+
+type PluginDebounceInfo struct {
+	// The evaluated key of the events
+	Key string `json:"key"`
+
+	// How many events have been collapsed into this execution
+	Count int `json:"count"`
+
+	FirstEventAt time.Time `json:"firstEventAt"`
+	LastEventAt  time.Time `json:"lastEventAt"`
+}
+
+/// [debounce-payload]
+// @formatter:on
+
+// Returned to the caller, when an event is received
+type PluginDebounceResult struct {
+	Key       string    `json:"key"`
+	Count     int       `json:"count"`
+	ExecuteAt time.Time `json:"executeAt"`
+}
+
+func (c *PluginDebounceConfig) NewPlugin(listener *CompiledListener) (PluginInterface, error) {
+	var tplKey *ListenerTemplate
+	if c.Key != nil {
+		_tplKey, err := c.Key.CloneForListener(listener)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to clone key template")
+		}
+		tplKey = _tplKey
+	}
+
+	return &PluginDebounce{
+		PluginBase: NewPluginBase("debounce"),
+		listener:   listener,
+		config:     c,
+		tplKey:     tplKey,
+		pending:    make(map[string]*pluginDebouncePending),
+	}, nil
+}
+
+func (c *PluginDebounceConfig) IsUnique() bool {
+	return true
+}
+
+type PluginDebounce struct {
+	PluginBase
+	listener *CompiledListener
+	config   *PluginDebounceConfig
+
+	tplKey *ListenerTemplate
+
+	// Maps key -> in-memory pending execution
+	lock    sync.Mutex
+	pending map[string]*pluginDebouncePending
+}
+
+type pluginDebouncePending struct {
+	info  PluginDebounceInfo
+	args  map[string]interface{}
+	timer *time.Timer
+}
+
+// The same instance is used by all the clones, as it holds the pending executions
+func (p *PluginDebounce) Clone(_ *CompiledListener) (PluginInterface, error) {
+	return p, nil
+}
+
+func (p *PluginDebounce) NeedsDb() bool {
+	return p.config.ScheduleId != ""
+}
+
+func (p *PluginDebounce) Migrations() *migrate.Migrations {
+	return plugin_schedule.Migrations
+}
+
+func (p *PluginDebounce) ValidateCheckOtherPlugins(otherPlugins []PluginInterface) error {
+	if p.config.ScheduleId == "" {
+		return nil
+	}
+
+	for _, other := range otherPlugins {
+		if other, ok := other.(*PluginSchedule); ok && other.listener == p.listener && other.config.Id == p.config.ScheduleId {
+			return nil
+		}
+	}
+	return errors.Errorf("schedule plugin with id `%s` not found on listener %s", p.config.ScheduleId, p.listener.route)
+}
+
+// Returns when the command should be executed, given the first and last event times
+func (p *PluginDebounce) executeAt(firstEventAt time.Time, lastEventAt time.Time) time.Time {
+	executeAt := lastEventAt.Add(p.config.QuietPeriod)
+	if p.config.MaxWait != nil {
+		if maxExecuteAt := firstEventAt.Add(*p.config.MaxWait); maxExecuteAt.Before(executeAt) {
+			executeAt = maxExecuteAt
+		}
+	}
+	return executeAt
+}
+
+func (p *PluginDebounce) mergeArgs(previous map[string]interface{}, args map[string]interface{}) map[string]interface{} {
+	if !p.config.Merge || previous == nil {
+		return args
+	}
+
+	merged := make(map[string]interface{})
+	for key, val := range previous {
+		merged[key] = val
+	}
+	for key, val := range args {
+		merged[key] = val
+	}
+	return merged
+}
+
+// Plain map, so that templates can access the same keys, whether the args come from
+// memory or the database
+func (info *PluginDebounceInfo) asArgs() map[string]interface{} {
+	return map[string]interface{}{
+		"key":          info.Key,
+		"count":        info.Count,
+		"firstEventAt": info.FirstEventAt,
+		"lastEventAt":  info.LastEventAt,
+	}
+}
+
+func (p *PluginDebounce) HookRequest(c *gin.Context, args map[string]interface{}) (bool, error) {
+	key := ""
+	if p.tplKey != nil {
+		evaluated, err := p.tplKey.Execute(args)
+		if err != nil {
+			return false, errors.WithMessage(err, "failed to evaluate debounce key template")
+		}
+		key = strings.TrimSpace(evaluated)
+	}
+
+	var result *PluginDebounceResult
+	var err error
+	if p.config.ScheduleId != "" {
+		result, err = p.debounceShared(key, args, time.Now())
+	} else {
+		result = p.debounce(key, args, time.Now())
+	}
+	if err != nil {
+		return false, err
+	}
+
+	c.AbortWithStatusJSON(http.StatusAccepted, result)
+	return true, nil
+}
+
+func (p *PluginDebounce) debounce(key string, args map[string]interface{}, now time.Time) *PluginDebounceResult {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	pending := p.pending[key]
+	if pending == nil {
+		pending = &pluginDebouncePending{info: PluginDebounceInfo{Key: key, FirstEventAt: now}}
+		p.pending[key] = pending
+	} else {
+		pending.timer.Stop()
+	}
+
+	pending.info.Count++
+	pending.info.LastEventAt = now
+	pending.args = p.mergeArgs(pending.args, args)
+
+	executeAt := p.executeAt(pending.info.FirstEventAt, now)
+	pending.timer = time.AfterFunc(executeAt.Sub(now), func() {
+		p.lock.Lock()
+		if p.pending[key] != pending {
+			// Already executed
+			p.lock.Unlock()
+			return
+		}
+		delete(p.pending, key)
+		// Tracked while holding the lock, so that a shutdown either finds the execution
+		// still pending, or waits for it
+		done := trackExecution()
+		p.lock.Unlock()
+
+		defer done()
+		p.execute(pending)
+	})
+
+	return &PluginDebounceResult{key, pending.info.Count, executeAt}
+}
+
+func (p *PluginDebounce) execute(pending *pluginDebouncePending) {
+	args := make(map[string]interface{})
+	for key, val := range pending.args {
+		args[key] = val
+	}
+	args[pluginDebounceKeyDebounceInfo] = pending.info.asArgs()
+
+	if _, err := p.listener.handleBackgroundRequest(args); err != nil {
+		p.listener.Logger().WithError(err).Error("failed to handle debounced request")
+	}
+}
+
+// Stores the pending execution as a task of the schedule plugin, which executes it
+func (p *PluginDebounce) debounceShared(key string, args map[string]interface{}, now time.Time) (*PluginDebounceResult, error) {
+	if p.listener.dbWrapper == nil {
+		return nil, errors.New("database not initialized")
+	}
+
+	var result *PluginDebounceResult
+	err := p.listener.dbWrapper.DB().RunInTx(context.Background(), nil, func(ctx context.Context, tx bun.Tx) error {
+		// Row locks cannot protect tasks which do not exist yet, so events with the same
+		// key are serialized across replicas by an advisory lock, released on commit
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext(?))", p.advisoryLockKey(key)); err != nil {
+			return errors.WithMessage(err, "failed to lock debounce key")
+		}
+
+		task := new(plugin_schedule.ScheduledTask)
+		err := tx.NewSelect().
+			Model(task).
+			Where("listener_id = ?", p.config.ScheduleId).
+			Where("args->?->>'key' = ?", pluginDebounceKeyDebounceInfo, key).
+			Limit(1).
+			// Tasks locked by the schedule plugin are being executed, so a new task
+			// is created instead of waiting for the execution to complete
+			For("UPDATE SKIP LOCKED").
+			Scan(ctx)
+		if err != nil && err != sql.ErrNoRows {
+			return errors.WithMessage(err, "failed to find pending debounced task")
+		}
+
+		info := PluginDebounceInfo{Key: key, FirstEventAt: now}
+		var previousArgs map[string]interface{}
+		if task.Id != 0 {
+			previousArgs = task.Args
+			if previous, ok := task.Args[pluginDebounceKeyDebounceInfo].(map[string]interface{}); ok {
+				if count, ok := previous["count"].(float64); ok {
+					info.Count = int(count)
+				}
+				if firstEventAt, ok := previous["firstEventAt"].(string); ok {
+					if t, err := time.Parse(time.RFC3339Nano, firstEventAt); err == nil {
+						info.FirstEventAt = t
+					}
+				}
+			}
+		}
+
+		info.Count++
+		info.LastEventAt = now
+
+		task.ListenerId = p.config.ScheduleId
+		task.ExecuteAt = p.executeAt(info.FirstEventAt, now)
+		task.Args = p.mergeArgs(previousArgs, args)
+		task.Args[pluginDebounceKeyDebounceInfo] = info.asArgs()
+
+		if task.Id != 0 {
+			_, err = tx.NewUpdate().Model(task).Column("execute_at", "args").Where("id = ?", task.Id).Exec(ctx)
+		} else {
+			_, err = tx.NewInsert().Model(task).Exec(ctx)
+		}
+		if err != nil {
+			return errors.WithMessage(err, "failed to store debounced task in database")
+		}
+
+		result = &PluginDebounceResult{key, info.Count, task.ExecuteAt}
+		return nil
+	})
+
+	return result, err
+}
+
+func (p *PluginDebounce) advisoryLockKey(key string) string {
+	return "qvalet-debounce|" + p.config.ScheduleId + "|" + key
+}
+
+func (p *PluginDebounce) OnStart() error {
+	return nil
+}
+
+// OnStop executes all the in-memory pending executions, so that no events are lost
+func (p *PluginDebounce) OnStop() {
+	p.lock.Lock()
+	var pendingList []*pluginDebouncePending
+	for key, pending := range p.pending {
+		pending.timer.Stop()
+		pendingList = append(pendingList, pending)
+		delete(p.pending, key)
+	}
+	p.lock.Unlock()
+
+	// Executed concurrently, so that all of them are drained, and signaled, together
+	wg := sync.WaitGroup{}
+	for _, pending := range pendingList {
+		pending := pending
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.execute(pending)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPluginDebounceExecuteAt(t *testing.T) {
+	maxWait := 10 * time.Second
+	plugin := &PluginDebounce{config: &PluginDebounceConfig{QuietPeriod: 3 * time.Second, MaxWait: &maxWait}}
+
+	now := time.Now()
+	require.Equal(t, now.Add(3*time.Second), plugin.executeAt(now, now))
+	require.Equal(t, now.Add(8*time.Second), plugin.executeAt(now, now.Add(5*time.Second)))
+
+	// Events keep arriving, but the command runs anyway after the max wait
+	require.Equal(t, now.Add(10*time.Second), plugin.executeAt(now, now.Add(9*time.Second)))
+}
+
+func TestPluginDebounceRequests(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "output.txt")
+	s := newTestServer(t, fmt.Sprintf(`
+listeners:
+  /debounce:
+    command: bash
+    args:
+      - -c
+      - echo "{{ .repo }} {{ .__qvDebounce.count }} {{ .a }} {{ .b }}" >> %s
+    plugins:
+      - debounce:
+          key: "{{ .repo }}"
+          quietPeriod: 200ms
+          merge: true
+`, output))
+
+	require.Equal(t, http.StatusAccepted, s.get("/debounce?repo=one&a=1").Code)
+	require.Equal(t, http.StatusAccepted, s.get("/debounce?repo=one&b=2").Code)
+	require.Equal(t, http.StatusAccepted, s.get("/debounce?repo=two&a=3").Code)
+
+	require.Eventually(t, func() bool {
+		data, _ := os.ReadFile(output)
+		return len(data) == len("one 2 1 2\ntwo 1 3 <no value>\n")
+	}, 5*time.Second, 50*time.Millisecond)
+
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"one 2 1 2", "two 1 3 <no value>"}, strings.Split(strings.TrimSpace(string(data)), "\n"))
+}
+
+func TestPluginDebounceShared(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "output.txt")
+	scheduleId := testDatabaseId("debounce")
+	s := newTestServer(t, testDatabaseDefaults(t)+fmt.Sprintf(`
+listeners:
+  /debounce/shared:
+    command: bash
+    args:
+      - -c
+      - echo "{{ .__qvDebounce.count }}" >> %s
+    plugins:
+      - schedule:
+          id: %s
+          scanInterval: 100ms
+      - debounce:
+          key: "{{ .repo }}"
+          quietPeriod: 500ms
+          scheduleId: %s
+`, output, scheduleId, scheduleId))
+
+	// Concurrent events with the same key collapse into a single task
+	const events = 5
+	counts := make(chan int, events)
+	var wg sync.WaitGroup
+	for i := 0; i < events; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := s.get("/debounce/shared?repo=one")
+			var result PluginDebounceResult
+			if w.Code == http.StatusAccepted && json.Unmarshal(w.Body.Bytes(), &result) == nil {
+				counts <- result.Count
+			}
+		}()
+	}
+	wg.Wait()
+	close(counts)
+
+	var received []int
+	for count := range counts {
+		received = append(received, count)
+	}
+	require.ElementsMatch(t, []int{1, 2, 3, 4, 5}, received)
+
+	require.Eventually(t, func() bool {
+		data, _ := os.ReadFile(output)
+		return strings.TrimSpace(string(data)) == "5"
+	}, 10*time.Second, 100*time.Millisecond)
+}
@@ -0,0 +1,383 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"qvalet/pkg/plugin_dedupe"
+	"qvalet/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/migrate"
+)
+
+var _ PluginInterface = (*PluginDedupe)(nil)
+var _ PluginHookRequest = (*PluginDedupe)(nil)
+var _ PluginHookGetMiddlewares = (*PluginDedupe)(nil)
+var _ PluginConfigNeedsDb = (*PluginDedupe)(nil)
+var _ PluginConfig = (*PluginDedupeConfig)(nil)
+
+// How frequently expired entries are removed from the database
+const pluginDedupeCleanupInterval = 1 * time.Minute
+
+// Most requests remembered in memory, so that ever-changing keys cannot exhaust the memory
+const pluginDedupeMaxEntries = 100000
+
+// Set on the gin context with the key of the request being handled, suffixed by the plugin id
+const pluginDedupeContextKeyPrefix = "PluginDedupeKey-"
+
+// @formatter:off
+/// [config]
+const pluginDedupeDefaultTTL = 24 * time.Hour
+const pluginDedupeDefaultLease = 5 * time.Minute
+
+// Delivery id headers used by default, in this order
+var pluginDedupeDefaultHeaders = []string{
+	"X-GitHub-Delivery",
+	"X-Gitlab-Event-UUID",
+	"X-Amz-Sns-Message-Id",
+	"Idempotency-Key",
+}
+
+type PluginDedupeConfig struct {
+	// Identifies the entries of this plugin, defaults to the listener route.
+	// Listeners with the same id share the same entries.
+	Id string `mapstructure:"id"`
+
+	// Template used to identify duplicate requests, e.g. `{{ .id }}` for Stripe
+	// events. Defaults to the first delivery id header, out of
+	// [pluginDedupeDefaultHeaders]. Requests with an empty key are never
+	// considered duplicates.
+	Key *ListenerTemplate `mapstructure:"key"`
+
+	// How long to remember requests for, defaults to [pluginDedupeDefaultTTL]
+	TTL *time.Duration `mapstructure:"ttl" validate:"omitempty,gt=0"`
+
+	// How long a request is considered in progress for, defaults to
+	// [pluginDedupeDefaultLease]. If the server stops while handling it,
+	// duplicates get executed once the lease expires. Should be longer than
+	// the longest execution of the command.
+	Lease *time.Duration `mapstructure:"lease" validate:"omitempty,gt=0"`
+
+	// If true, failed executions are remembered too. Otherwise, duplicates of
+	// failed requests are executed again.
+	CacheFailures bool `mapstructure:"cacheFailures"`
+
+	// If true, requests are remembered in the listener database, and shared by
+	// all the replicas which use the same database
+	Shared bool `mapstructure:"shared"`
+}
+
+/// [config]
+// @formatter:on
+
+func (c *PluginDedupeConfig) NewPlugin(listener *CompiledListener) (PluginInterface, error) {
+	if c.Shared && listener.config.Database == nil {
+		return nil, errors.New("shared dedupe entries need the listener database to be defined")
+	}
+
+	var tplKey *ListenerTemplate
+	if c.Key != nil {
+		_tplKey, err := c.Key.CloneForListener(listener)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to clone key template")
+		}
+		tplKey = _tplKey
+	}
+
+	id := c.Id
+	if id == "" {
+		id = listener.route
+	}
+
+	return &PluginDedupe{
+		PluginBase: NewPluginBase("dedupe"),
+		listener:   listener,
+		config:     c,
+		entriesId:  id,
+		tplKey:     tplKey,
+		cleanup:    new(pluginDedupeCleanup),
+	}, nil
+}
+
+func (c *PluginDedupeConfig) IsUnique() bool {
+	return true
+}
+
+func (c *PluginDedupeConfig) ttl() time.Duration {
+	if c.TTL != nil {
+		return *c.TTL
+	}
+	return pluginDedupeDefaultTTL
+}
+
+func (c *PluginDedupeConfig) lease() time.Duration {
+	if c.Lease != nil {
+		return *c.Lease
+	}
+	return pluginDedupeDefaultLease
+}
+
+type PluginDedupe struct {
+	PluginBase
+	listener *CompiledListener
+	config   *PluginDedupeConfig
+
+	entriesId string
+	tplKey    *ListenerTemplate
+
+	cleanup *pluginDedupeCleanup
+}
+
+type pluginDedupeCleanup struct {
+	lock    sync.Mutex
+	lastRun time.Time
+}
+
+type pluginDedupeEntry struct {
+	// 0 while the first request is in progress
+	status   int
+	header   http.Header
+	response []byte
+}
+
+// Maps entry key -> *pluginDedupeEntry, kept for the whole lifetime of the process,
+// so that entries survive config reloads
+var pluginDedupeEntries = utils.NewCacheWithMaxEntries(pluginDedupeMaxEntries)
+
+func (p *PluginDedupe) Clone(_ *CompiledListener) (PluginInterface, error) {
+	return p, nil
+}
+
+func (p *PluginDedupe) NeedsDb() bool {
+	return p.config.Shared
+}
+
+// Offline, e.g. when running listener tests, there is no database connection,
+// so entries are kept in memory
+func (p *PluginDedupe) isShared() bool {
+	return p.config.Shared && p.listener.dbWrapper != nil
+}
+
+func (p *PluginDedupe) Migrations() *migrate.Migrations {
+	return plugin_dedupe.Migrations
+}
+
+func (p *PluginDedupe) contextKey() string {
+	return pluginDedupeContextKeyPrefix + p.Id()
+}
+
+func (p *PluginDedupe) entryKey(key string) string {
+	return p.entriesId + "|" + key
+}
+
+func (p *PluginDedupe) evaluateKey(c *gin.Context, args map[string]interface{}) (string, error) {
+	if p.tplKey == nil {
+		for _, header := range pluginDedupeDefaultHeaders {
+			if value := c.GetHeader(header); value != "" {
+				return value, nil
+			}
+		}
+		return "", nil
+	}
+
+	evaluated, err := p.tplKey.Execute(args)
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to evaluate dedupe key template")
+	}
+	return strings.TrimSpace(evaluated), nil
+}
+
+func (p *PluginDedupe) HookRequest(c *gin.Context, args map[string]interface{}) (bool, error) {
+	key, err := p.evaluateKey(c, args)
+	if err != nil {
+		return false, err
+	}
+	if key == "" {
+		return false, nil
+	}
+
+	now := time.Now()
+	var entry *pluginDedupeEntry
+	if p.isShared() {
+		entry, err = p.claimShared(key, now)
+		if err != nil {
+			// A database failure should not stop the listener from working
+			p.listener.log.WithError(err).Error("failed to check duplicate request, executing it")
+			return false, nil
+		}
+	} else {
+		entry = p.claim(key, now)
+	}
+
+	if entry == nil {
+		// First request, the response gets stored by the middleware
+		c.Set(p.contextKey(), key)
+		return false, nil
+	}
+
+	metricsExecutions.Inc(p.listener.route, metricsOutcomeDuplicate)
+	p.listener.log.WithField("key", key).Info("duplicate request")
+
+	if entry.status == 0 {
+		c.AbortWithError(http.StatusConflict, errors.New("duplicate request, the first one is still in progress"))
+		return true, nil
+	}
+
+	header := c.Writer.Header()
+	for key, values := range entry.header {
+		header[key] = values
+	}
+	c.Data(entry.status, gin.MIMEJSON, entry.response)
+	c.Abort()
+	return true, nil
+}
+
+// Stores the response of the first request, once handled
+func (p *PluginDedupe) HookGetMiddlewares(_ string) []gin.HandlerFunc {
+	return []gin.HandlerFunc{func(c *gin.Context) {
+		c.Next()
+
+		key := c.GetString(p.contextKey())
+		if key == "" {
+			return
+		}
+
+		var response *ListenerResponse
+		if value, found := c.Get(ginContextListenerResponse); found {
+			response, _ = value.(*ListenerResponse)
+		}
+
+		status := c.Writer.Status()
+		if response == nil || (status >= http.StatusInternalServerError && !p.config.CacheFailures) {
+			p.release(key)
+			return
+		}
+
+		data, err := json.Marshal(response)
+		if err != nil {
+			p.listener.log.WithError(err).Error("failed to marshal response for dedupe")
+			p.release(key)
+			return
+		}
+
+		// The request id belongs to the request which gets the stored response
+		header := c.Writer.Header().Clone()
+		header.Del(utils.HeaderRequestId)
+		header.Del("Content-Length")
+
+		p.complete(key, &pluginDedupeEntry{status, header, data})
+	}}
+}
+
+// Returns the existing entry, or nil if this is the first request, which is then marked
+// as in progress until the lease expires
+func (p *PluginDedupe) claim(key string, now time.Time) *pluginDedupeEntry {
+	pluginDedupeEntries.Lock()
+	defer pluginDedupeEntries.Unlock()
+
+	if entry := pluginDedupeEntries.Get(p.entryKey(key)); entry != nil {
+		return entry.(*pluginDedupeEntry)
+	}
+
+	pluginDedupeEntries.SetWithExpiry(p.entryKey(key), &pluginDedupeEntry{}, now.Add(p.config.lease()))
+	return nil
+}
+
+// Stores the response, which is then remembered for the whole ttl
+func (p *PluginDedupe) complete(key string, entry *pluginDedupeEntry) {
+	if p.isShared() {
+		header, err := json.Marshal(entry.header)
+		if err != nil {
+			p.listener.log.WithError(err).Error("failed to marshal response headers for dedupe")
+			p.release(key)
+			return
+		}
+
+		if _, err := p.listener.dbWrapper.DB().NewUpdate().
+			Model((*plugin_dedupe.DedupeEntry)(nil)).
+			Set("status = ?", entry.status).
+			Set("header = ?", string(header)).
+			Set("response = ?", string(entry.response)).
+			Set("expires_at = ?", time.Now().Add(p.config.ttl())).
+			Where("key = ?", p.entryKey(key)).
+			Exec(context.Background()); err != nil {
+			p.listener.log.WithError(err).Error("failed to store response for dedupe")
+		}
+		return
+	}
+
+	pluginDedupeEntries.SetWithExpiry(p.entryKey(key), entry, time.Now().Add(p.config.ttl()))
+}
+
+// Forgets the request, so that duplicates get executed
+func (p *PluginDedupe) release(key string) {
+	if p.isShared() {
+		if _, err := p.listener.dbWrapper.DB().NewDelete().
+			Model((*plugin_dedupe.DedupeEntry)(nil)).
+			Where("key = ?", p.entryKey(key)).
+			Exec(context.Background()); err != nil {
+			p.listener.log.WithError(err).Error("failed to remove dedupe entry")
+		}
+		return
+	}
+
+	pluginDedupeEntries.Delete(p.entryKey(key))
+}
+
+func (p *PluginDedupe) claimShared(key string, now time.Time) (*pluginDedupeEntry, error) {
+	db := p.listener.dbWrapper.DB()
+	p.cleanupShared(db, now)
+
+	model := &plugin_dedupe.DedupeEntry{
+		Key:       p.entryKey(key),
+		ExpiresAt: now.Add(p.config.lease()),
+	}
+
+	// Creates the entry, or takes over an expired one
+	result, err := db.NewInsert().
+		Model(model).
+		On("CONFLICT (key) DO UPDATE").
+		Set("status = 0").
+		Set("header = NULL").
+		Set("response = NULL").
+		Set("expires_at = EXCLUDED.expires_at").
+		Where("?TableAlias.expires_at < ?", now).
+		Exec(context.Background())
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to store dedupe entry")
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected > 0 {
+		return nil, nil
+	}
+
+	if err := db.NewSelect().Model(model).WherePK().Scan(context.Background()); err != nil {
+		return nil, errors.WithMessage(err, "failed to load dedupe entry")
+	}
+	return &pluginDedupeEntry{model.Status, model.Header, model.Response}, nil
+}
+
+func (p *PluginDedupe) cleanupShared(db *bun.DB, now time.Time) {
+	p.cleanup.lock.Lock()
+	defer p.cleanup.lock.Unlock()
+
+	if now.Sub(p.cleanup.lastRun) < pluginDedupeCleanupInterval {
+		return
+	}
+	p.cleanup.lastRun = now
+
+	go func() {
+		if _, err := db.NewDelete().
+			Model((*plugin_dedupe.DedupeEntry)(nil)).
+			Where("expires_at < ?", now).
+			Exec(context.Background()); err != nil {
+			p.listener.log.WithError(err).Warn("failed to remove expired dedupe entries")
+		}
+	}()
+}
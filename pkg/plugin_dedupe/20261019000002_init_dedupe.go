@@ -0,0 +1,22 @@
+package plugin_dedupe
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.NewCreateTable().Model((*DedupeEntry)(nil)).IfNotExists().Exec(ctx); err != nil {
+			return err
+		}
+
+		if _, err := db.Exec(fmt.Sprintf("CREATE INDEX %s_expires_at ON %s (expires_at)", tableNameDedupeEntry, tableNameDedupeEntry)); err != nil {
+			return err
+		}
+
+		return nil
+	}, nil)
+}
@@ -0,0 +1,18 @@
+package plugin_dedupe
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS header JSON", tableNameDedupeEntry)); err != nil {
+			return err
+		}
+
+		return nil
+	}, nil)
+}
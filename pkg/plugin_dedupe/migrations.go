@@ -0,0 +1,7 @@
+package plugin_dedupe
+
+import (
+	"github.com/uptrace/bun/migrate"
+)
+
+var Migrations = migrate.NewMigrations()
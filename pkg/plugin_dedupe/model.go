@@ -0,0 +1,29 @@
+package plugin_dedupe
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+const tableNameDedupeEntry = "dedupe_entries"
+
+type DedupeEntry struct {
+	bun.BaseModel `bun:"dedupe_entries"`
+
+	// Identifies the plugin and the request key
+	Key string `bun:",pk"`
+
+	// HTTP status code of the first response, 0 while the first request is in progress
+	Status int `bun:",notnull"`
+
+	// The response headers of the first request
+	Header http.Header `bun:"type:json,nullzero"`
+
+	// The listener response of the first request
+	Response json.RawMessage `bun:"type:json,nullzero"`
+
+	ExpiresAt time.Time `bun:",notnull"`
+}
@@ -0,0 +1,149 @@
+package pkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"qvalet/pkg/utils"
+
+	"github.com/stretchr/testify/require"
+)
+
+func serveTestDelivery(s *testServer, path string, delivery string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if delivery != "" {
+		req.Header.Set("X-GitHub-Delivery", delivery)
+	}
+	return s.serve(req)
+}
+
+func TestPluginDedupeRequests(t *testing.T) {
+	s := newTestServer(t, `
+listeners:
+  /deploy:
+    return: output
+    command: bash
+    args: [ -c, "date +%s%N" ]
+    plugins:
+      - httpResponse:
+          headers:
+            X-Environment: production
+      - dedupe: {}
+  /stripe:
+    return: output
+    command: bash
+    args: [ -c, "date +%s%N; exit {{ .code }}" ]
+    plugins:
+      - dedupe:
+          key: "{{ .id }}"
+`)
+
+	// Duplicates get the response of the first delivery, including its headers
+	first := serveTestDelivery(s, "/deploy", "abc")
+	require.Equal(t, http.StatusOK, first.Code)
+	duplicate := serveTestDelivery(s, "/deploy", "abc")
+	require.Equal(t, first.Body.String(), duplicate.Body.String())
+	require.Equal(t, "production", duplicate.Header().Get("X-Environment"))
+	require.NotEqual(t, first.Header().Get(utils.HeaderRequestId), duplicate.Header().Get(utils.HeaderRequestId))
+	require.NotEqual(t, first.Body.String(), serveTestDelivery(s, "/deploy", "def").Body.String())
+
+	// Requests without a key are always executed
+	require.NotEqual(t, s.get("/deploy").Body.String(), s.get("/deploy").Body.String())
+
+	// Failed executions are not remembered
+	failed := s.get("/stripe?id=evt_1&code=1")
+	require.Equal(t, http.StatusInternalServerError, failed.Code)
+	retried := s.get("/stripe?id=evt_1&code=0")
+	require.Equal(t, http.StatusOK, retried.Code)
+	require.Equal(t, retried.Body.String(), s.get("/stripe?id=evt_1&code=1").Body.String())
+}
+
+func testPluginDedupeLease(t *testing.T, s *testServer, path string) {
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		done <- serveTestDelivery(s, path, "abc")
+	}()
+
+	// Requests are in progress only until the lease expires
+	require.Eventually(t, func() bool {
+		return serveTestDelivery(s, path, "abc").Code == http.StatusConflict
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(300 * time.Millisecond)
+	retried := serveTestDelivery(s, path, "abc")
+	require.Equal(t, http.StatusOK, retried.Code)
+	require.Equal(t, http.StatusOK, (<-done).Code)
+
+	// Completed requests are remembered for the whole ttl
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(t, retried.Body.String(), serveTestDelivery(s, path, "abc").Body.String())
+}
+
+func TestPluginDedupeLease(t *testing.T) {
+	s := newTestServer(t, `
+listeners:
+  /slow:
+    return: output
+    command: bash
+    args: [ -c, "sleep 1; date +%s%N" ]
+    plugins:
+      - dedupe:
+          lease: 200ms
+`)
+
+	testPluginDedupeLease(t, s, "/slow")
+}
+
+func TestPluginDedupeShared(t *testing.T) {
+	config := testDatabaseDefaults(t) + `
+listeners:
+  /deploy/shared:
+    return: output
+    command: bash
+    args: [ -c, "date +%s%N" ]
+    plugins:
+      - httpResponse:
+          headers:
+            X-Environment: production
+      - dedupe:
+          id: ` + testDatabaseId("dedupe") + `
+          shared: true
+  /slow/shared:
+    return: output
+    command: bash
+    args: [ -c, "sleep 1; date +%s%N" ]
+    plugins:
+      - dedupe:
+          id: ` + testDatabaseId("dedupe-slow") + `
+          lease: 200ms
+          shared: true
+`
+
+	// Replicas using the same database share the same entries
+	first := newTestServer(t, config)
+	second := newTestServer(t, config)
+	response := serveTestDelivery(first, "/deploy/shared", "abc")
+	require.Equal(t, http.StatusOK, response.Code)
+	duplicate := serveTestDelivery(second, "/deploy/shared", "abc")
+	require.Equal(t, response.Body.String(), duplicate.Body.String())
+	require.Equal(t, "production", duplicate.Header().Get("X-Environment"))
+
+	testPluginDedupeLease(t, first, "/slow/shared")
+}
+
+func TestPluginDedupeSharedNeedsDatabase(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestServerConfig(t, filename, `
+listeners:
+  /dedupe/noDatabase:
+    command: "true"
+    plugins:
+      - dedupe:
+          shared: true
+`)
+
+	_, err := NewServer(ServerOptions{ConfigFilenames: []string{filename}})
+	require.ErrorContains(t, err, "shared dedupe entries need the listener database")
+}
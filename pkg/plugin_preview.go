@@ -66,7 +66,7 @@ func (p *PluginPreview) HookMountRoutes(engine *gin.Engine) {
 			authConfig = p.listener.config.Auth
 		}
 
-		handled, args := prepareListenerRequestHandling(c, authConfig)
+		handled, args := prepareListenerRequestHandling(c, p.listener, authConfig)
 		if handled {
 			return
 		}
@@ -84,8 +84,23 @@ func (p *PluginPreview) HookMountRoutes(engine *gin.Engine) {
 			return
 		}
 
+		preview := listenerClone.redactor.PreparedExecution(preparedExecutionResult)
+		for _, plugin := range listenerClone.plugins {
+			if plugin, ok := plugin.(PluginHookPreview); ok {
+				name, pluginPreview, err := plugin.HookPreview(args)
+				if err != nil {
+					c.AbortWithError(http.StatusInternalServerError, errors.WithMessage(err, "failed to preview plugin"))
+					return
+				}
+				if preview.Plugins == nil {
+					preview.Plugins = make(map[string]interface{})
+				}
+				preview.Plugins[name] = pluginPreview
+			}
+		}
+
 		var toReturn interface{}
-		toReturn = preparedExecutionResult
+		toReturn = preview
 		if handledResult != nil {
 			toReturn = handledResult
 		}
@@ -0,0 +1,358 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"qvalet/pkg/plugin_rate_limit"
+	"qvalet/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/migrate"
+)
+
+var _ PluginInterface = (*PluginRateLimit)(nil)
+var _ PluginHookRequest = (*PluginRateLimit)(nil)
+var _ PluginConfigNeedsDb = (*PluginRateLimit)(nil)
+var _ PluginConfig = (*PluginRateLimitConfig)(nil)
+
+// How frequently expired shared buckets are removed from the database
+const pluginRateLimitCleanupInterval = 1 * time.Minute
+
+// @formatter:off
+/// [config]
+type PluginRateLimitConfig struct {
+	// Identifies the buckets of this plugin, defaults to the listener route.
+	// Listeners with the same id share the same buckets.
+	Id string `mapstructure:"id"`
+
+	// Template used to group requests in buckets, e.g. `{{ .__qvAuth.Username }}`
+	// or `{{ .repository.name }}`. Defaults to the client IP.
+	// Requests for which the key is empty share the same bucket.
+	Key *ListenerTemplate `mapstructure:"key"`
+
+	// List of limits, which must all be satisfied for a request to be accepted,
+	// e.g. 10 requests per minute and 100 requests per hour
+	Limits []*PluginRateLimitLimitConfig `mapstructure:"limits" validate:"required,min=1,dive,required"`
+
+	// If true, buckets are stored in the listener database, and shared by all
+	// the replicas which use the same database
+	Shared bool `mapstructure:"shared"`
+}
+
+type PluginRateLimitLimitConfig struct {
+	// How many requests are allowed in every window
+	Requests int `mapstructure:"requests" validate:"min=1"`
+
+	// Duration of the window, e.g. `1m`. Tokens are refilled continuously, at a
+	// rate of requests / window.
+	Window time.Duration `mapstructure:"window" validate:"required,gt=0"`
+
+	// How many requests can be accepted in a burst, defaults to the requests value
+	Burst int `mapstructure:"burst" validate:"min=0"`
+}
+
+/// [config]
+// @formatter:on
+
+// @formatter:off
+/// [rate-limit-payload]
+// When a request is rejected, and the listener has a storage, the [PluginRateLimitInfo]
+// payload is stored under the [pluginRateLimitKeyRateLimited] key.
+const pluginRateLimitKeyRateLimited = "rateLimited"
+
+type PluginRateLimitInfo struct {
+	// The evaluated key of the request
+	Key string `json:"key"`
+
+	// How long the client needs to wait before retrying
+	RetryAfter time.Duration `json:"retryAfter"`
+}
+
+/// [rate-limit-payload]
+// @formatter:on
+
+func (c *PluginRateLimitLimitConfig) capacity() float64 {
+	if c.Burst > 0 {
+		return float64(c.Burst)
+	}
+	return float64(c.Requests)
+}
+
+// Tokens refilled every second
+func (c *PluginRateLimitLimitConfig) rate() float64 {
+	return float64(c.Requests) / c.Window.Seconds()
+}
+
+func (c *PluginRateLimitLimitConfig) bucketKey(id string, key string) string {
+	return fmt.Sprintf("%s|%d/%s/%d|%s", id, c.Requests, c.Window, c.Burst, key)
+}
+
+func (c *PluginRateLimitConfig) NewPlugin(listener *CompiledListener) (PluginInterface, error) {
+	if c.Shared && listener.config.Database == nil {
+		return nil, errors.New("shared rate limits need the listener database to be defined")
+	}
+
+	id := c.Id
+	if id == "" {
+		id = listener.route
+	}
+
+	return &PluginRateLimit{
+		NewPluginBase("rate-limit"),
+		listener,
+		c,
+		id,
+		c.Key,
+		new(pluginRateLimitCleanup),
+	}, nil
+}
+
+func (c *PluginRateLimitConfig) IsUnique() bool {
+	return false
+}
+
+type PluginRateLimit struct {
+	PluginBase
+	listener *CompiledListener
+	config   *PluginRateLimitConfig
+
+	bucketsId string
+	tplKey    *ListenerTemplate
+
+	// Shared between clones
+	cleanup *pluginRateLimitCleanup
+}
+
+type pluginRateLimitCleanup struct {
+	lock    sync.Mutex
+	lastRun time.Time
+}
+
+func (p *PluginRateLimit) Clone(newListener *CompiledListener) (PluginInterface, error) {
+	var tplKeyClone *ListenerTemplate
+	if p.config.Key != nil {
+		_tplKeyClone, err := p.config.Key.CloneForListener(newListener)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to clone key template")
+		}
+		tplKeyClone = _tplKeyClone
+	}
+
+	return &PluginRateLimit{
+		PluginBase: p.PluginBase,
+		listener:   p.listener,
+		config:     p.config,
+		bucketsId:  p.bucketsId,
+		tplKey:     tplKeyClone,
+		cleanup:    p.cleanup,
+	}, nil
+}
+
+func (p *PluginRateLimit) NeedsDb() bool {
+	return p.config.Shared
+}
+
+func (p *PluginRateLimit) Migrations() *migrate.Migrations {
+	return plugin_rate_limit.Migrations
+}
+
+func (p *PluginRateLimit) HookRequest(c *gin.Context, args map[string]interface{}) (bool, error) {
+	key := c.ClientIP()
+	if p.tplKey != nil {
+		evaluated, err := p.tplKey.Execute(args)
+		if err != nil {
+			return false, errors.WithMessage(err, "failed to evaluate rate limit key template")
+		}
+		key = strings.TrimSpace(evaluated)
+	}
+
+	var retryAfter time.Duration
+	// Offline, e.g. when running listener tests, there is no database connection,
+	// so buckets are kept in memory
+	if p.config.Shared && p.listener.dbWrapper != nil {
+		_retryAfter, err := p.takeShared(key, time.Now())
+		if err != nil {
+			// A database failure should not stop the listener from working
+			p.listener.log.WithError(err).Error("failed to check shared rate limit, allowing request")
+			return false, nil
+		}
+		retryAfter = _retryAfter
+	} else {
+		retryAfter = p.take(key, time.Now())
+	}
+
+	if retryAfter == 0 {
+		return false, nil
+	}
+
+	metricsExecutions.Inc(p.listener.route, metricsOutcomeRateLimited)
+	p.listener.log.WithField("key", key).Warn("request rate limited")
+
+	if p.listener.storager != nil {
+		toStore := map[string]interface{}{
+			pluginRateLimitKeyRateLimited: &PluginRateLimitInfo{
+				Key:        key,
+				RetryAfter: retryAfter,
+			},
+		}
+		if p.listener.config.Storage.StoreArgs() {
+			toStore["args"] = p.listener.redactor.Args(args)
+		}
+		storePayload(p.listener, toStore)
+	}
+
+	retryAfterSeconds := int(math.Ceil(retryAfter.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(retryAfterSeconds))
+	c.AbortWithError(http.StatusTooManyRequests, errors.Errorf("rate limit exceeded, retry in %ds", retryAfterSeconds))
+	return true, nil
+}
+
+type pluginRateLimitBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// Refills the bucket up to now, and returns how long until a token is available
+func (b *pluginRateLimitBucket) refill(limit *PluginRateLimitLimitConfig, now time.Time) time.Duration {
+	if elapsed := now.Sub(b.updatedAt); elapsed > 0 {
+		b.tokens = math.Min(limit.capacity(), b.tokens+elapsed.Seconds()*limit.rate())
+		b.updatedAt = now
+	}
+
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / limit.rate() * float64(time.Second))
+}
+
+// When the bucket will be full again
+func (b *pluginRateLimitBucket) fullAt(limit *PluginRateLimitLimitConfig) time.Time {
+	missing := limit.capacity() - b.tokens
+	return b.updatedAt.Add(time.Duration(missing / limit.rate() * float64(time.Second)))
+}
+
+// Takes a token from all the buckets if all of them have one, otherwise returns how long
+// to wait before trying again
+func pluginRateLimitTake(limits []*PluginRateLimitLimitConfig, buckets []*pluginRateLimitBucket, now time.Time) time.Duration {
+	var retryAfter time.Duration
+	for idx, limit := range limits {
+		if wait := buckets[idx].refill(limit, now); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	if retryAfter > 0 {
+		return retryAfter
+	}
+
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return 0
+}
+
+// Maximum number of in-memory buckets, so that requests with ever-changing keys
+// cannot exhaust the memory
+const pluginRateLimitMaxBuckets = 100000
+
+// Maps bucket key -> *pluginRateLimitBucket, kept for the whole lifetime of
+// the process, so that limits survive config reloads. Buckets expire once full.
+var pluginRateLimitBuckets = utils.NewCacheWithMaxEntries(pluginRateLimitMaxBuckets)
+
+func (p *PluginRateLimit) take(key string, now time.Time) time.Duration {
+	pluginRateLimitBuckets.Lock()
+	defer pluginRateLimitBuckets.Unlock()
+
+	buckets := make([]*pluginRateLimitBucket, len(p.config.Limits))
+	for idx, limit := range p.config.Limits {
+		if bucketIntf := pluginRateLimitBuckets.Get(limit.bucketKey(p.bucketsId, key)); bucketIntf != nil {
+			buckets[idx] = bucketIntf.(*pluginRateLimitBucket)
+		} else {
+			buckets[idx] = &pluginRateLimitBucket{tokens: limit.capacity(), updatedAt: now}
+		}
+	}
+
+	retryAfter := pluginRateLimitTake(p.config.Limits, buckets, now)
+
+	// Full buckets are the same as missing ones, so they can be forgotten
+	for idx, limit := range p.config.Limits {
+		pluginRateLimitBuckets.SetWithExpiry(limit.bucketKey(p.bucketsId, key), buckets[idx], buckets[idx].fullAt(limit))
+	}
+
+	return retryAfter
+}
+
+func (p *PluginRateLimit) takeShared(key string, now time.Time) (time.Duration, error) {
+	db := p.listener.dbWrapper.DB()
+	p.cleanupShared(db, now)
+
+	var retryAfter time.Duration
+	err := db.RunInTx(context.Background(), nil, func(ctx context.Context, tx bun.Tx) error {
+		models := make([]*plugin_rate_limit.RateLimitBucket, len(p.config.Limits))
+		buckets := make([]*pluginRateLimitBucket, len(p.config.Limits))
+
+		for idx, limit := range p.config.Limits {
+			model := &plugin_rate_limit.RateLimitBucket{
+				Key:       limit.bucketKey(p.bucketsId, key),
+				Tokens:    limit.capacity(),
+				UpdatedAt: now,
+				ExpiresAt: now,
+			}
+
+			// Create the bucket if missing, then lock it
+			if _, err := tx.NewInsert().Model(model).On("CONFLICT (key) DO NOTHING").Exec(ctx); err != nil {
+				return errors.WithMessage(err, "failed to create rate limit bucket")
+			}
+			if err := tx.NewSelect().Model(model).WherePK().For("UPDATE").Scan(ctx); err != nil {
+				return errors.WithMessage(err, "failed to lock rate limit bucket")
+			}
+
+			models[idx] = model
+			buckets[idx] = &pluginRateLimitBucket{tokens: model.Tokens, updatedAt: model.UpdatedAt}
+		}
+
+		retryAfter = pluginRateLimitTake(p.config.Limits, buckets, now)
+
+		for idx, limit := range p.config.Limits {
+			models[idx].Tokens = buckets[idx].tokens
+			models[idx].UpdatedAt = buckets[idx].updatedAt
+			models[idx].ExpiresAt = buckets[idx].fullAt(limit)
+
+			if _, err := tx.NewUpdate().Model(models[idx]).WherePK().Exec(ctx); err != nil {
+				return errors.WithMessage(err, "failed to update rate limit bucket")
+			}
+		}
+
+		return nil
+	})
+
+	return retryAfter, err
+}
+
+// Full buckets are the same as missing ones, so every now and then they get removed
+func (p *PluginRateLimit) cleanupShared(db *bun.DB, now time.Time) {
+	p.cleanup.lock.Lock()
+	defer p.cleanup.lock.Unlock()
+
+	if now.Sub(p.cleanup.lastRun) < pluginRateLimitCleanupInterval {
+		return
+	}
+	p.cleanup.lastRun = now
+
+	go func() {
+		if _, err := db.NewDelete().
+			Model((*plugin_rate_limit.RateLimitBucket)(nil)).
+			Where("expires_at < ?", now).
+			Exec(context.Background()); err != nil {
+			p.listener.log.WithError(err).Warn("failed to remove expired rate limit buckets")
+		}
+	}()
+}
@@ -0,0 +1,22 @@
+package plugin_rate_limit
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.NewCreateTable().Model((*RateLimitBucket)(nil)).IfNotExists().Exec(ctx); err != nil {
+			return err
+		}
+
+		if _, err := db.Exec(fmt.Sprintf("CREATE INDEX %s_expires_at ON %s (expires_at)", tableNameRateLimitBucket, tableNameRateLimitBucket)); err != nil {
+			return err
+		}
+
+		return nil
+	}, nil)
+}
@@ -0,0 +1,7 @@
+package plugin_rate_limit
+
+import (
+	"github.com/uptrace/bun/migrate"
+)
+
+var Migrations = migrate.NewMigrations()
@@ -0,0 +1,24 @@
+package plugin_rate_limit
+
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+const tableNameRateLimitBucket = "rate_limit_buckets"
+
+type RateLimitBucket struct {
+	bun.BaseModel `bun:"rate_limit_buckets"`
+
+	// Identifies the plugin, the limit and the request key
+	Key string `bun:",pk"`
+
+	// Tokens left in the bucket, as of UpdatedAt
+	Tokens float64 `bun:",notnull"`
+
+	UpdatedAt time.Time `bun:",notnull"`
+
+	// When the bucket will be full again, after which it can be removed
+	ExpiresAt time.Time `bun:",notnull"`
+}
@@ -0,0 +1,102 @@
+package pkg
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPluginRateLimitTake(t *testing.T) {
+	limits := []*PluginRateLimitLimitConfig{
+		{Requests: 2, Window: 1 * time.Second},
+		{Requests: 3, Window: 1 * time.Minute},
+	}
+	now := time.Now()
+	buckets := []*pluginRateLimitBucket{
+		{tokens: limits[0].capacity(), updatedAt: now},
+		{tokens: limits[1].capacity(), updatedAt: now},
+	}
+
+	require.Zero(t, pluginRateLimitTake(limits, buckets, now))
+	require.Zero(t, pluginRateLimitTake(limits, buckets, now))
+
+	// The first limit has no tokens left, and refills one every 500ms
+	require.Equal(t, 500*time.Millisecond, pluginRateLimitTake(limits, buckets, now))
+	require.Equal(t, 250*time.Millisecond, pluginRateLimitTake(limits, buckets, now.Add(250*time.Millisecond)))
+
+	// Rejected requests do not consume tokens
+	now = now.Add(1 * time.Second)
+	require.Zero(t, pluginRateLimitTake(limits, buckets, now))
+
+	// The second limit refills one token every 20s, and has been refilling for 1s
+	require.Equal(t, 19*time.Second, pluginRateLimitTake(limits, buckets, now).Round(time.Millisecond))
+}
+
+func TestPluginRateLimitRequests(t *testing.T) {
+	s := newTestServer(t, `
+listeners:
+  /rateLimit:
+    command: "true"
+    plugins:
+      - rateLimit:
+          key: "{{ .user }}"
+          limits:
+            - requests: 2
+              window: 1h
+`)
+
+	require.Equal(t, http.StatusOK, s.get("/rateLimit?user=neo").Code)
+	require.Equal(t, http.StatusOK, s.get("/rateLimit?user=neo").Code)
+
+	w := s.get("/rateLimit?user=neo")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "1800", w.Header().Get("Retry-After"))
+
+	// Other keys have their own buckets
+	require.Equal(t, http.StatusOK, s.get("/rateLimit?user=trinity").Code)
+}
+
+func TestPluginRateLimitShared(t *testing.T) {
+	s := newTestServer(t, testDatabaseDefaults(t)+`
+listeners:
+  /rateLimit/shared:
+    command: "true"
+    plugins:
+      - rateLimit:
+          id: `+testDatabaseId("rate-limit")+`
+          key: "{{ .user }}"
+          shared: true
+          limits:
+            - requests: 2
+              window: 1h
+`)
+
+	require.Equal(t, http.StatusOK, s.get("/rateLimit/shared?user=neo").Code)
+	require.Equal(t, http.StatusOK, s.get("/rateLimit/shared?user=neo").Code)
+
+	w := s.get("/rateLimit/shared?user=neo")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "1800", w.Header().Get("Retry-After"))
+	require.Equal(t, http.StatusOK, s.get("/rateLimit/shared?user=trinity").Code)
+}
+
+func TestPluginRateLimitSharedNeedsDatabase(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestServerConfig(t, filename, `
+listeners:
+  /rateLimit/noDatabase:
+    command: "true"
+    plugins:
+      - rateLimit:
+          shared: true
+          limits:
+            - requests: 2
+              window: 1h
+`)
+
+	_, err := NewServer(ServerOptions{ConfigFilenames: []string{filename}})
+	require.ErrorContains(t, err, "shared rate limits need the listener database")
+}
@@ -10,6 +10,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"qvalet/pkg/plugin_schedule"
@@ -25,11 +26,16 @@ var _ PluginLifecycle = (*PluginSchedule)(nil)
 var _ PluginConfigNeedsDb = (*PluginSchedule)(nil)
 var _ PluginConfigValidateCheckOtherPlugins = (*PluginSchedule)(nil)
 var _ PluginHookMountRoutes = (*PluginSchedule)(nil)
+var _ PluginHealthCheck = (*PluginSchedule)(nil)
 var _ PluginConfig = (*PluginScheduleConfig)(nil)
 
 const pluginScheduleUrlParamTimeKey = "__qvScheduleTime"
 const pluginSchedulePayloadTimeKey = "__qvScheduleTime"
 const pluginScheduleScanIntervalMin = 100 * time.Millisecond
+const pluginScheduleMetricsInterval = 10 * time.Second
+
+// How long an iteration can take, on top of the scan interval, before the loop is considered stuck
+const pluginScheduleHeartbeatTolerance = 5 * time.Minute
 
 // @formatter:off
 /// [config]
@@ -60,7 +66,9 @@ func (c *PluginScheduleConfig) NewPlugin(listener *CompiledListener) (PluginInte
 		NewPluginBase("schedule"),
 		listener,
 		c,
-		false,
+		nil,
+		nil,
+		atomic.Value{},
 	}, nil
 }
 
@@ -72,7 +80,19 @@ type PluginSchedule struct {
 	PluginBase
 	listener *CompiledListener
 	config   *PluginScheduleConfig
-	runLoop  bool
+
+	// Closed to stop the loop
+	stop chan struct{}
+	// Closed once the loop completed its last iteration
+	loopDone chan struct{}
+
+	// Stores the *pluginScheduleHeartbeat of the last iteration
+	heartbeat atomic.Value
+}
+
+type pluginScheduleHeartbeat struct {
+	time time.Time
+	err  error
 }
 
 func (p *PluginSchedule) ValidateCheckOtherPlugins(otherPlugins []PluginInterface) error {
@@ -264,8 +284,44 @@ func (p *PluginSchedule) loopIteration() (bool, error) {
 	return rowFound, nil
 }
 
+// updateMetrics refreshes the queue depth and lag of this schedule
+func (p *PluginSchedule) updateMetrics() error {
+	if p.listener.dbWrapper == nil {
+		return errors.New("database not initialized")
+	}
+
+	var stats struct {
+		Depth     int64        `bun:"depth"`
+		OldestDue sql.NullTime `bun:"oldest_due"`
+	}
+
+	now := time.Now()
+	err := p.listener.dbWrapper.DB().NewSelect().
+		Model((*plugin_schedule.ScheduledTask)(nil)).
+		ColumnExpr("COUNT(*) AS depth").
+		ColumnExpr("MIN(execute_at) FILTER (WHERE execute_at < ?) AS oldest_due", now).
+		Where("listener_id = ?", p.config.Id).
+		Scan(context.Background(), &stats)
+	if err != nil {
+		return errors.WithMessage(err, "failed to query schedule stats")
+	}
+
+	lag := 0.0
+	if stats.OldestDue.Valid {
+		lag = now.Sub(stats.OldestDue.Time).Seconds()
+	}
+
+	metricsScheduleQueueDepth.Set(float64(stats.Depth), p.config.Id)
+	metricsScheduleLag.Set(lag, p.config.Id)
+	return nil
+}
+
 func (p *PluginSchedule) loop() {
-	for p.runLoop {
+	defer close(p.loopDone)
+
+	var lastMetricsUpdate time.Time
+
+	for {
 		now := time.Now()
 
 		rowFound, err := p.loopIteration()
@@ -273,24 +329,71 @@ func (p *PluginSchedule) loop() {
 			p.listener.Logger().WithError(err).Warn("plugin schedule iteration failed")
 		}
 
+		// Failures of the executed commands do not make the loop unhealthy, only
+		// failures to fetch the tasks do, e.g. when the database is down
+		heartbeat := &pluginScheduleHeartbeat{time: time.Now()}
+		if err != nil && !rowFound {
+			heartbeat.err = err
+		}
+		p.heartbeat.Store(heartbeat)
+
+		if now.Sub(lastMetricsUpdate) >= pluginScheduleMetricsInterval {
+			lastMetricsUpdate = now
+			if err := p.updateMetrics(); err != nil {
+				p.listener.Logger().WithError(err).Warn("failed to update schedule metrics")
+			}
+		}
+
 		elapsed := time.Now().Sub(now)
 
 		// How long should we wait before the next loop?
 		// If we found data, process fast
-		if rowFound {
-			time.Sleep(pluginScheduleScanIntervalMin - elapsed)
-			continue
+		delay := pluginScheduleScanIntervalMin
+		if !rowFound {
+			// Otherwise, use the at-rest delay
+			delay = p.scanInterval()
 		}
 
-		// Otherwise, use the at-rest delay
-		delay := pluginScheduleScanIntervalRestDefault
-		if p.config.ScanInterval != nil {
-			delay = *p.config.ScanInterval
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(delay - elapsed):
 		}
-		time.Sleep(delay - elapsed)
 	}
 }
 
+func (p *PluginSchedule) scanInterval() time.Duration {
+	if p.config.ScanInterval != nil {
+		return *p.config.ScanInterval
+	}
+	return pluginScheduleScanIntervalRestDefault
+}
+
+// HealthCheck makes sure the loop is running, and can reach the database
+func (p *PluginSchedule) HealthCheck() error {
+	if p.stop == nil {
+		return errors.New("loop not started")
+	}
+	select {
+	case <-p.loopDone:
+		return errors.New("loop stopped")
+	default:
+	}
+
+	heartbeat, ok := p.heartbeat.Load().(*pluginScheduleHeartbeat)
+	if !ok {
+		// The first iteration is still running
+		return nil
+	}
+	if heartbeat.err != nil {
+		return heartbeat.err
+	}
+	if since := time.Since(heartbeat.time); since > p.scanInterval()+pluginScheduleHeartbeatTolerance {
+		return errors.Errorf("loop stuck, last iteration completed %s ago", since.Round(time.Second))
+	}
+	return nil
+}
+
 func (p *PluginSchedule) HookMountRoutes(engine *gin.Engine) {
 	route := pluginScheduleRouteDefault
 	if p.config.Route != nil {
@@ -312,7 +415,7 @@ func (p *PluginSchedule) HookMountRoutes(engine *gin.Engine) {
 			authConfig = p.listener.config.Auth
 		}
 
-		handled, args := prepareListenerRequestHandling(c, authConfig)
+		handled, args := prepareListenerRequestHandling(c, p.listener, authConfig)
 		if handled {
 			return
 		}
@@ -333,11 +436,20 @@ func (p *PluginSchedule) HookMountRoutes(engine *gin.Engine) {
 }
 
 func (p *PluginSchedule) OnStart() error {
-	p.runLoop = true
+	p.stop = make(chan struct{})
+	p.loopDone = make(chan struct{})
 	go p.loop()
 	return nil
 }
 
+// OnStop waits for the task in progress, if any, to complete
 func (p *PluginSchedule) OnStop() {
-	p.runLoop = false
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.loopDone
+
+	metricsScheduleQueueDepth.Delete(p.config.Id)
+	metricsScheduleLag.Delete(p.config.Id)
 }
@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -27,3 +28,24 @@ func TestParseParamTime(t *testing.T) {
 		require.Equal(t, test.Expected.UnixMilli(), parsed.UnixMilli(), "parse %s", test.Value)
 	}
 }
+
+func TestPluginScheduleHealthCheck(t *testing.T) {
+	plugin := &PluginSchedule{config: &PluginScheduleConfig{Id: "test"}}
+	require.Error(t, plugin.HealthCheck())
+
+	plugin.stop = make(chan struct{})
+	plugin.loopDone = make(chan struct{})
+	require.NoError(t, plugin.HealthCheck())
+
+	plugin.heartbeat.Store(&pluginScheduleHeartbeat{time: time.Now()})
+	require.NoError(t, plugin.HealthCheck())
+
+	plugin.heartbeat.Store(&pluginScheduleHeartbeat{time: time.Now(), err: errors.New("db down")})
+	require.Error(t, plugin.HealthCheck())
+
+	plugin.heartbeat.Store(&pluginScheduleHeartbeat{time: time.Now().Add(-time.Hour)})
+	require.Error(t, plugin.HealthCheck())
+
+	close(plugin.loopDone)
+	require.Error(t, plugin.HealthCheck())
+}
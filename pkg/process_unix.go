@@ -0,0 +1,29 @@
+//go:build !windows
+
+package pkg
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Run every command in its own process group, so that on shutdown we can
+// signal the command together with all of its children
+func setCommandProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func signalProcessGroup(pid int, sig os.Signal) {
+	sysSig, ok := sig.(syscall.Signal)
+	if !ok {
+		sysSig = syscall.SIGTERM
+	}
+
+	// A negative pid signals the whole process group
+	if err := syscall.Kill(-pid, sysSig); err != nil && err != syscall.ESRCH {
+		logrus.WithField("pid", pid).WithError(err).Warn("failed to signal command process group")
+	}
+}
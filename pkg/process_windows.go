@@ -0,0 +1,26 @@
+//go:build windows
+
+package pkg
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Process groups are not supported on Windows
+func setCommandProcessGroup(_ *exec.Cmd) {
+}
+
+func signalProcessGroup(pid int, _ os.Signal) {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return
+	}
+
+	// Windows can only kill processes
+	if err := process.Kill(); err != nil {
+		logrus.WithField("pid", pid).WithError(err).Warn("failed to kill command")
+	}
+}
@@ -0,0 +1,142 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"qvalet/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Maximum duration of all the readiness checks
+const readinessTimeout = 5 * time.Second
+
+const (
+	readinessComponentDatabase = "database"
+	readinessComponentStorage  = "storage"
+	readinessComponentPlugin   = "plugin"
+)
+
+type ReadinessComponent struct {
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	Ready bool   `json:"ready"`
+	Error string `json:"error,omitempty"`
+}
+
+type ReadinessReport struct {
+	Ready      bool                  `json:"ready"`
+	Components []*ReadinessComponent `json:"components"`
+}
+
+func (r *ReadinessReport) add(componentType string, name string, err error) {
+	component := &ReadinessComponent{
+		Type:  componentType,
+		Name:  name,
+		Ready: err == nil,
+	}
+	if err != nil {
+		component.Error = err.Error()
+		r.Ready = false
+	}
+	r.Components = append(r.Components, component)
+}
+
+// Readiness checks all the dependencies of the running config: its databases are
+// pinged, its storage backends must be reachable, and plugins must be healthy
+func (s *Server) Readiness(ctx context.Context) *ReadinessReport {
+	report := &ReadinessReport{
+		Ready:      true,
+		Components: []*ReadinessComponent{},
+	}
+
+	// Cached connections may belong to previous configs, so only check the used ones
+	databases := make(map[*BunDbWrapper]bool)
+	storagers := make(map[string]*CompiledListener)
+	healthChecks := make(map[PluginHealthCheck]bool)
+	for _, r := range s.MountResults() {
+		for _, listener := range r.listenersMap {
+			for _, l := range []*CompiledListener{listener, listener.errorHandler} {
+				if l == nil {
+					continue
+				}
+				if l.dbWrapper != nil {
+					databases[l.dbWrapper] = true
+				}
+				if l.storager != nil {
+					storagers[l.config.Storage.Conn] = l
+				}
+			}
+
+			for _, plugin := range listener.plugins {
+				if plugin, ok := plugin.(PluginHealthCheck); ok {
+					healthChecks[plugin] = true
+				}
+			}
+		}
+	}
+
+	var statuses []*DatabaseStatus
+	for database := range databases {
+		statuses = append(statuses, database.Ping(ctx))
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].DSN < statuses[j].DSN
+	})
+	for _, status := range statuses {
+		component := &ReadinessComponent{
+			Type:  readinessComponentDatabase,
+			Name:  status.DSN,
+			Ready: status.Healthy,
+			Error: status.Error,
+		}
+		if !status.Healthy {
+			report.Ready = false
+		}
+		report.Components = append(report.Components, component)
+	}
+
+	var conns []string
+	for conn := range storagers {
+		conns = append(conns, conn)
+	}
+	sort.Strings(conns)
+	for _, conn := range conns {
+		err := checkStorageReachable(ctx, storagers[conn].storager)
+		report.add(readinessComponentStorage, storageLogSafeConn(conn), err)
+	}
+
+	var plugins []PluginHealthCheck
+	for plugin := range healthChecks {
+		plugins = append(plugins, plugin)
+	}
+	sort.Slice(plugins, func(i, j int) bool {
+		return plugins[i].Id() < plugins[j].Id()
+	})
+	for _, plugin := range plugins {
+		report.add(readinessComponentPlugin, plugin.Id(), plugin.HealthCheck())
+	}
+
+	return report
+}
+
+func getGinReadinessHandler(server *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(utils.GinContextDoNotLogEntry, true)
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+		defer cancel()
+
+		report := server.Readiness(ctx)
+		if !report.Ready {
+			logrus.WithField("report", report).Warn("readiness check failed")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, report)
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusOK, report)
+	}
+}
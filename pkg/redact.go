@@ -0,0 +1,266 @@
+package pkg
+
+import (
+	"path"
+	"strconv"
+	"strings"
+
+	"qvalet/pkg/utils"
+)
+
+const redactedValue = "[REDACTED]"
+
+var redactDefaultHeaders = []string{
+	"authorization",
+	"proxy-authorization",
+	"cookie",
+	"x-api-key",
+	"x-gitlab-token",
+	"x-hub-signature*",
+}
+
+// Secrets shorter than this are masked only when they are the whole value, because
+// replacing them wherever they appear would mangle unrelated output
+const redactMinSecretLength = 8
+
+var redactDefaultEnv = []string{
+	"*TOKEN*",
+	"*SECRET*",
+	"*PASSWORD*",
+}
+
+// @formatter:off
+/// [redact-docs]
+type RedactConfig struct {
+	// Names of the request headers to mask in `__qvRequest.headers`.
+	// Case-insensitive, supports wildcards, e.g. `x-*-token`.
+	// Defaults to [redactDefaultHeaders].
+	Headers []string `mapstructure:"headers"`
+
+	// Paths of the args to mask, where every path segment is separated by
+	// a dot and supports wildcards, e.g. `user.password` or `*.token`.
+	Args []string `mapstructure:"args"`
+
+	// Names of the env vars to mask, supports wildcards, e.g. `*_TOKEN`.
+	// Defaults to [redactDefaultEnv].
+	Env []string `mapstructure:"env"`
+}
+
+/// [redact-docs]
+// @formatter:on
+
+// redactor masks sensitive values before they get logged, stored or returned.
+// Besides the configured patterns, any value equal to one of the api keys of
+// the listener is always masked.
+type redactor struct {
+	config *RedactConfig
+	auth   []*AuthConfig
+}
+
+func newRedactor(config *RedactConfig, auth []*AuthConfig) *redactor {
+	if config == nil {
+		config = &RedactConfig{}
+	}
+	return &redactor{config, auth}
+}
+
+func (r *redactor) headerPatterns() []string {
+	if r.config.Headers == nil {
+		return redactDefaultHeaders
+	}
+	return r.config.Headers
+}
+
+func (r *redactor) envPatterns() []string {
+	if r.config.Env == nil {
+		return redactDefaultEnv
+	}
+	return r.config.Env
+}
+
+// Secrets are resolved every time, because they may rotate
+func (r *redactor) secrets() []string {
+	var secrets []string
+	for _, auth := range r.auth {
+		for _, apiKey := range auth.ApiKeys {
+			if value := apiKey.Value(); value != "" {
+				secrets = append(secrets, value)
+			}
+		}
+	}
+	return secrets
+}
+
+func redactMatchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func redactMatchesAnyPath(patterns []string, valuePath []string) bool {
+	for _, pattern := range patterns {
+		segments := strings.Split(pattern, ".")
+		if len(segments) != len(valuePath) {
+			continue
+		}
+
+		matched := true
+		for idx, segment := range segments {
+			if ok, _ := path.Match(segment, valuePath[idx]); !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *redactor) redactSecrets(value string, secrets []string) string {
+	for _, secret := range secrets {
+		if len(secret) < redactMinSecretLength {
+			if value == secret {
+				return redactedValue
+			}
+			continue
+		}
+		value = strings.ReplaceAll(value, secret, redactedValue)
+	}
+	return value
+}
+
+// String masks all secrets contained in the provided value
+func (r *redactor) String(value string) string {
+	return r.redactSecrets(value, r.secrets())
+}
+
+// Strings masks all secrets contained in the provided values
+func (r *redactor) Strings(values []string) []string {
+	if values == nil {
+		return nil
+	}
+
+	secrets := r.secrets()
+	redacted := make([]string, len(values))
+	for idx, value := range values {
+		redacted[idx] = r.redactSecrets(value, secrets)
+	}
+	return redacted
+}
+
+// Env masks env vars, in the `KEY=value` form, with matching names or secret values
+func (r *redactor) Env(env []string) []string {
+	if env == nil {
+		return nil
+	}
+
+	secrets := r.secrets()
+	redacted := make([]string, len(env))
+	for idx, entry := range env {
+		key, value, _ := strings.Cut(entry, "=")
+		if redactMatchesAny(r.envPatterns(), key) {
+			value = redactedValue
+		} else {
+			value = r.redactSecrets(value, secrets)
+		}
+		redacted[idx] = key + "=" + value
+	}
+	return redacted
+}
+
+// Args returns a redacted copy of the provided args, which can be safely
+// logged, stored or returned. The original args are never altered.
+func (r *redactor) Args(args map[string]interface{}) map[string]interface{} {
+	if args == nil {
+		return nil
+	}
+	return r.value(args, nil, r.secrets()).(map[string]interface{})
+}
+
+// Value returns a redacted copy of any payload, only masking secrets
+func (r *redactor) Value(value interface{}) interface{} {
+	return r.value(value, nil, r.secrets())
+}
+
+func (r *redactor) value(value interface{}, valuePath []string, secrets []string) interface{} {
+	if len(valuePath) > 0 && redactMatchesAnyPath(r.config.Args, valuePath) {
+		return redactedValue
+	}
+
+	switch v := value.(type) {
+	case string:
+		return r.redactSecrets(v, secrets)
+	case []string:
+		redacted := make([]string, len(v))
+		for idx, el := range v {
+			redacted[idx] = r.redactSecrets(el, secrets)
+		}
+		return redacted
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for key, el := range v {
+			redacted[key] = r.value(el, appendPath(valuePath, key), secrets)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for idx, el := range v {
+			redacted[idx] = r.value(el, appendPath(valuePath, strconv.Itoa(idx)), secrets)
+		}
+		return redacted
+	case *utils.QVRequest:
+		if v == nil {
+			return v
+		}
+		return r.qvRequest(v, valuePath, secrets)
+	case *ExecCommandResult:
+		if v == nil {
+			return v
+		}
+		return &ExecCommandResult{
+			Command: r.redactSecrets(v.Command, secrets),
+			Args:    r.value(v.Args, nil, secrets).([]string),
+			Env:     r.Env(v.Env),
+			Output:  r.redactSecrets(v.Output, secrets),
+		}
+	}
+
+	return value
+}
+
+func (r *redactor) qvRequest(request *utils.QVRequest, valuePath []string, secrets []string) *utils.QVRequest {
+	headerPatterns := r.headerPatterns()
+
+	headers := make(map[string]interface{}, len(request.Headers))
+	for key, el := range request.Headers {
+		if redactMatchesAny(headerPatterns, strings.ToLower(key)) {
+			headers[key] = redactedValue
+			continue
+		}
+		headers[key] = r.value(el, appendPath(valuePath, "headers", key), secrets)
+	}
+
+	redacted := *request
+	redacted.Headers = headers
+	return &redacted
+}
+
+// PreparedExecution returns a redacted copy of the prepared execution details
+func (r *redactor) PreparedExecution(result *preparedExecutionResult) *preparedExecutionResult {
+	return &preparedExecutionResult{
+		Command: r.String(result.Command),
+		Args:    r.Strings(result.Args),
+		Env:     r.Env(result.Env),
+	}
+}
+
+func appendPath(valuePath []string, segments ...string) []string {
+	newPath := make([]string, 0, len(valuePath)+len(segments))
+	newPath = append(newPath, valuePath...)
+	return append(newPath, segments...)
+}
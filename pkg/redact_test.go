@@ -0,0 +1,78 @@
+package pkg
+
+import (
+	"testing"
+
+	"qvalet/pkg/utils"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactor(t *testing.T) {
+	r := newRedactor(&RedactConfig{
+		Args: []string{"user.password", "items.*.token"},
+		Env:  []string{"*_TOKEN"},
+	}, []*AuthConfig{
+		{ApiKeys: []*utils.StringFromEnvVar{utils.NewStringFromEnvVar("superSecret")}},
+	})
+
+	args := map[string]interface{}{
+		"name": "Anderson",
+		"user": map[string]interface{}{
+			"name":     "neo",
+			"password": "matrix",
+		},
+		"items": []interface{}{
+			map[string]interface{}{"token": "abc", "id": 1},
+		},
+		"message": "my key is superSecret",
+		"__qvRequest": &utils.QVRequest{
+			Headers: map[string]interface{}{
+				"authorization": "Bearer 123",
+				"x-my-auth":     "superSecret",
+				"content-type":  "application/json",
+			},
+			Method: "POST",
+		},
+	}
+
+	redacted := r.Args(args)
+	require.Equal(t, "Anderson", redacted["name"])
+	require.Equal(t, redactedValue, redacted["user"].(map[string]interface{})["password"])
+	require.Equal(t, "neo", redacted["user"].(map[string]interface{})["name"])
+	require.Equal(t, redactedValue, redacted["items"].([]interface{})[0].(map[string]interface{})["token"])
+	require.Equal(t, 1, redacted["items"].([]interface{})[0].(map[string]interface{})["id"])
+	require.Equal(t, "my key is "+redactedValue, redacted["message"])
+
+	headers := redacted["__qvRequest"].(*utils.QVRequest).Headers
+	require.Equal(t, redactedValue, headers["authorization"])
+	require.Equal(t, redactedValue, headers["x-my-auth"])
+	require.Equal(t, "application/json", headers["content-type"])
+
+	// The original args must never be altered
+	require.Equal(t, "matrix", args["user"].(map[string]interface{})["password"])
+	require.Equal(t, "Bearer 123", args["__qvRequest"].(*utils.QVRequest).Headers["authorization"])
+
+	require.Equal(t, []string{
+		"GITHUB_TOKEN=" + redactedValue,
+		"NAME=neo",
+		"KEY=" + redactedValue,
+	}, r.Env([]string{"GITHUB_TOKEN=abc", "NAME=neo", "KEY=superSecret"}))
+}
+
+func TestRedactorDefaults(t *testing.T) {
+	r := newRedactor(nil, []*AuthConfig{
+		{ApiKeys: []*utils.StringFromEnvVar{utils.NewStringFromEnvVar("abc")}},
+	})
+
+	// Short secrets are masked only when they are the whole value
+	require.Equal(t, redactedValue, r.String("abc"))
+	require.Equal(t, "abcdef", r.String("abcdef"))
+
+	require.Equal(t, []string{
+		"GITHUB_TOKEN=" + redactedValue,
+		"DB_PASSWORD=" + redactedValue,
+		"CLIENT_SECRET_FILE=" + redactedValue,
+		"NAME=neo",
+	}, r.Env([]string{"GITHUB_TOKEN=1", "DB_PASSWORD=2", "CLIENT_SECRET_FILE=3", "NAME=neo"}))
+}
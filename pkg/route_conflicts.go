@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// RouteConflict describes two listeners which cannot be mounted on the same address
+type RouteConflict struct {
+	Address string
+	Method  string
+
+	Route string
+	File  string
+
+	// The listener mounted first
+	OtherRoute string
+	OtherFile  string
+
+	// Set if the conflicting listener could not be found
+	Reason string
+}
+
+func (c *RouteConflict) Error() string {
+	switch {
+	case c.OtherRoute == "":
+		return fmt.Sprintf("route conflict on %s: %s %s in %s: %s", c.Address, c.Method, c.Route, c.File, c.Reason)
+	case c.OtherRoute == c.Route:
+		return fmt.Sprintf("route conflict on %s: %s %s is defined in both %s and %s", c.Address, c.Method, c.Route, c.OtherFile, c.File)
+	}
+	return fmt.Sprintf("route conflict on %s: %s %s in %s conflicts with %s in %s", c.Address, c.Method, c.Route, c.File, c.OtherRoute, c.OtherFile)
+}
+
+type mountedRoute struct {
+	method string
+	route  string
+	file   string
+}
+
+// findRouteConflicts mounts the routes of every address on throwaway engines, because gin
+// panics on conflicts, and returns the conflicts found. Only the first conflict of every
+// listener is reported.
+func findRouteConflicts(configsByAddress map[string][]*Config) []*RouteConflict {
+	var addresses []string
+	for address := range configsByAddress {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	var conflicts []*RouteConflict
+	for _, address := range addresses {
+		engine := gin.New()
+		var mounted []*mountedRoute
+
+		for _, config := range configsByAddress[address] {
+			var routes []string
+			for route := range config.Listeners {
+				routes = append(routes, route)
+			}
+			sort.Strings(routes)
+
+			for _, route := range routes {
+				listenerConfig, err := MergeListenerConfig(&config.Defaults, config.Listeners[route])
+				if err != nil {
+					// Reported when compiling the listener
+					continue
+				}
+
+				current := &mountedRoute{route: route, file: config.listenerFile(route)}
+				for _, method := range listenerConfig.methods() {
+					current := *current
+					current.method = method
+
+					if conflict := mountRouteOrFindConflict(engine, mounted, &current); conflict != nil {
+						conflict.Address = address
+						conflicts = append(conflicts, conflict)
+						break
+					}
+					mounted = append(mounted, &current)
+				}
+			}
+		}
+	}
+
+	return conflicts
+}
+
+func mountRouteOrFindConflict(engine *gin.Engine, mounted []*mountedRoute, current *mountedRoute) *RouteConflict {
+	err := probeMountRoute(engine, current.method, current.route)
+	if err == nil {
+		return nil
+	}
+
+	conflict := &RouteConflict{
+		Method: current.method,
+		Route:  current.route,
+		File:   current.file,
+		Reason: err.Error(),
+	}
+
+	// Find which route conflicts, by mounting them in pairs
+	for _, other := range mounted {
+		if other.method != current.method {
+			continue
+		}
+		pairEngine := gin.New()
+		_ = probeMountRoute(pairEngine, other.method, other.route)
+		if probeMountRoute(pairEngine, current.method, current.route) != nil {
+			conflict.OtherRoute = other.route
+			conflict.OtherFile = other.file
+			break
+		}
+	}
+
+	return conflict
+}
+
+func probeMountRoute(engine *gin.Engine, method string, route string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("%v", r)
+		}
+	}()
+	engine.Handle(method, route, func(c *gin.Context) {})
+	return nil
+}
+
+// checkRouteConflicts returns an error listing all the route conflicts, if any
+func checkRouteConflicts(configsByAddress map[string][]*Config) error {
+	conflicts := findRouteConflicts(configsByAddress)
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	message := ""
+	for idx, conflict := range conflicts {
+		if idx > 0 {
+			message += "; "
+		}
+		message += conflict.Error()
+	}
+	return errors.New(message)
+}
@@ -2,6 +2,7 @@ package pkg
 
 import (
 	"net/http"
+	"reflect"
 	"regexp"
 	"sync"
 
@@ -16,6 +17,10 @@ import (
 const keyAuthDefaultHTTPBasicUser = "qv"
 const keyAuthApiKeyQuery = "__qvApiKey"
 
+// Set on the gin context after handling a request, used by `qvalet test`
+const ginContextListenerResponse = "GinContextListenerResponse"
+const ginContextNotTriggered = "GinContextNotTriggered"
+
 type RouteListenerMapping struct {
 	Route    string
 	Listener *CompiledListener
@@ -23,20 +28,52 @@ type RouteListenerMapping struct {
 
 type MountRoutesResult struct {
 	listenersMap map[string]*CompiledListener
+
+	// Maps fingerprint -> listener, to find unchanged listeners on reload
+	listenersByFingerprint map[string]*CompiledListener
+
+	// Lifecycle plugins taken over from a previous mount, which are already running
+	reusedPlugins []PluginInterface
 }
 
 func MountRoutes(engine *gin.Engine, config *Config, listenerIdPrefix string) (*MountRoutesResult, error) {
+	return RemountRoutes(engine, config, listenerIdPrefix, nil)
+}
+
+// RemountRoutes works like MountRoutes, but listeners whose config did not change since
+// the previous mount take over the running lifecycle plugins (e.g. schedule loops) of
+// their previous instance, instead of starting new ones
+func RemountRoutes(engine *gin.Engine, config *Config, listenerIdPrefix string, previous []*MountRoutesResult) (*MountRoutesResult, error) {
 	storageCache := new(sync.Map)
 
 	listenersMap := make(map[string]*CompiledListener)
+	listenersByFingerprint := make(map[string]*CompiledListener)
+	var reusedPlugins []PluginInterface
 
 	for route, listenerConfig := range config.Listeners {
 		log := logrus.WithField("listener", route)
 
-		listener, err := compileListener(&config.Defaults, listenerConfig, route, false, storageCache)
+		listener, err := compileListener(&config.Defaults, listenerConfig, route, false, storageCache, false)
 		if err != nil {
 			return nil, errors.WithMessagef(err, "failed to compile listener for route %s", route)
 		}
+		listener.authBruteForce = config.AuthBruteForce
+
+		fingerprint, err := listenerFingerprint(listenerIdPrefix, listener)
+		if err != nil {
+			log.WithError(err).Warn("failed to compute listener fingerprint, plugins will be restarted on reload")
+		} else {
+			listenersByFingerprint[fingerprint] = listener
+			for _, r := range previous {
+				if previousListener, found := r.listenersByFingerprint[fingerprint]; found {
+					reusedPlugins = append(reusedPlugins, listener.reuseLifecyclePlugins(previousListener)...)
+					// Listeners disabled via the admin API stay disabled
+					listener.disabled = previousListener.disabled
+					break
+				}
+			}
+		}
+
 		handler := getGinListenerHandler(listener)
 		mountedMethods := mountRoutesForListener(engine, listener, route, handler)
 
@@ -69,17 +106,76 @@ func MountRoutes(engine *gin.Engine, config *Config, listenerIdPrefix string) (*
 
 	return &MountRoutesResult{
 		listenersMap,
+		listenersByFingerprint,
+		reusedPlugins,
 	}, nil
 }
 
-func mountRoutesForListener(engine *gin.Engine, listener *CompiledListener, route string, handler gin.HandlerFunc) []string {
-	var methods []string
+// Identifies the full configuration of a listener, including the defaults it inherited
+func listenerFingerprint(listenerIdPrefix string, listener *CompiledListener) (string, error) {
+	fingerprint, err := configFingerprint(map[string]interface{}{
+		"id":             listenerIdPrefix + listener.route,
+		"config":         listener.config,
+		"authBruteForce": listener.authBruteForce,
+	})
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to fingerprint listener config")
+	}
+	return fingerprint, nil
+}
+
+// Replaces the lifecycle plugins of this listener with the ones of an identical
+// previous listener, returning the reused plugins
+func (listener *CompiledListener) reuseLifecyclePlugins(previous *CompiledListener) []PluginInterface {
+	// Plugins are created in the config order, so identical configs lead to the same list
+	if len(previous.plugins) != len(listener.plugins) {
+		return nil
+	}
+
+	var reused []PluginInterface
+	for idx, plugin := range listener.plugins {
+		if _, ok := plugin.(PluginLifecycle); !ok {
+			continue
+		}
+
+		previousPlugin := previous.plugins[idx]
+		if reflect.TypeOf(previousPlugin) != reflect.TypeOf(plugin) {
+			continue
+		}
+
+		listener.plugins[idx] = previousPlugin
+		reused = append(reused, previousPlugin)
+	}
+	return reused
+}
+
+func (r *MountRoutesResult) hasPlugin(search PluginInterface) bool {
+	for _, listener := range r.listenersMap {
+		if pluginsContains(listener.Plugins(), search) {
+			return true
+		}
+	}
+	return false
+}
+
+func pluginsContains(plugins []PluginInterface, search PluginInterface) bool {
+	for _, plugin := range plugins {
+		if plugin == search {
+			return true
+		}
+	}
+	return false
+}
 
-	if len(listener.config.Methods) == 0 {
-		methods = []string{http.MethodGet, http.MethodPost}
-	} else {
-		methods = listener.config.Methods
+func (config *ListenerConfig) methods() []string {
+	if len(config.Methods) == 0 {
+		return []string{http.MethodGet, http.MethodPost}
 	}
+	return config.Methods
+}
+
+func mountRoutesForListener(engine *gin.Engine, listener *CompiledListener, route string, handler gin.HandlerFunc) []string {
+	methods := listener.config.methods()
 
 	for _, method := range methods {
 		var handlers []gin.HandlerFunc
@@ -145,9 +241,16 @@ func (r *MountRoutesResult) PluginsStart() error {
 					continue
 				}
 
+				// Already running since the previous mount
+				if pluginsContains(r.reusedPlugins, plugin) {
+					continue
+				}
+
 				if err := plugin.OnStart(); err != nil {
+					setPluginLifecycleState(plugin, PluginStateFailed)
 					return errors.WithMessage(err, "failed to start plugin")
 				}
+				setPluginLifecycleState(plugin, PluginStateRunning)
 				startedPlugins = append(startedPlugins, plugin)
 			}
 		}
@@ -157,6 +260,12 @@ func (r *MountRoutesResult) PluginsStart() error {
 }
 
 func (r *MountRoutesResult) PluginsStop() {
+	r.PluginsStopExcept(nil)
+}
+
+// PluginsStopExcept stops all lifecycle plugins, except the ones which
+// are also used by any of the provided mount results
+func (r *MountRoutesResult) PluginsStopExcept(others []*MountRoutesResult) {
 	// For listeners which mount multiple methods, keep track of which plugins
 	// have been stopped, to prevent double OnStop()
 	var stoppedPlugins []PluginLifecycle
@@ -177,7 +286,25 @@ func (r *MountRoutesResult) PluginsStop() {
 					continue
 				}
 
+				// Never started, e.g. when starting another plugin failed first
+				if GetPluginLifecycleState(plugin) != PluginStateRunning {
+					continue
+				}
+
+				// Still in use elsewhere, e.g. taken over after a reload
+				inUse := false
+				for _, other := range others {
+					if other != r && other.hasPlugin(plugin) {
+						inUse = true
+						break
+					}
+				}
+				if inUse {
+					continue
+				}
+
 				plugin.OnStop()
+				setPluginLifecycleState(plugin, PluginStateStopped)
 				stoppedPlugins = append(stoppedPlugins, plugin)
 			}
 		}
@@ -200,30 +327,57 @@ var regexListenerRouteCleaner = regexp.MustCompile(`[\W]`)
 
 func getGinListenerHandler(listener *CompiledListener) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		handled, args := prepareListenerRequestHandling(c, listener.config.Auth)
-		if handled {
+		if listener.Disabled() {
+			metricsExecutions.Inc(listener.route, metricsOutcomeDisabled)
+			c.AbortWithError(http.StatusServiceUnavailable, errors.New("listener disabled"))
 			return
 		}
 
-		ctxHandled, response, err := listener.HandleRequest(c, args, nil)
-		if ctxHandled {
+		handled, args := prepareListenerRequestHandling(c, listener, listener.config.Auth)
+		if handled {
 			return
 		}
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, response)
-			return
+
+		for _, plugin := range listener.plugins {
+			if p, ok := plugin.(PluginHookRequest); ok {
+				handled, err := p.HookRequest(c, args)
+				if err != nil {
+					c.AbortWithError(http.StatusInternalServerError, errors.WithMessage(err, "failed to process request via plugin"))
+					return
+				}
+				if handled {
+					return
+				}
+			}
 		}
 
-		c.JSON(http.StatusOK, response)
+		handleListenerRequest(c, listener, args)
 	}
 }
 
+// handleListenerRequest executes the listener, and writes its response
+func handleListenerRequest(c *gin.Context, listener *CompiledListener, args map[string]interface{}) {
+	ctxHandled, response, err := listener.HandleRequest(c, args, nil)
+	c.Set(ginContextListenerResponse, response)
+	if ctxHandled {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
 func prepareListenerRequestHandling(
 	c *gin.Context,
+	listener *CompiledListener,
 	authConfigs []*AuthConfig,
 ) (bool, map[string]interface{}) {
-	if err := verifyAuth(c, authConfigs); err != nil {
-		c.AbortWithError(http.StatusUnauthorized, err)
+	authenticated, authInfo := authenticateRequest(c, listener, authConfigs)
+	if !authenticated {
+		metricsExecutions.Inc(listener.route, metricsOutcomeAuthRejected)
 		return true, nil
 	}
 
@@ -232,5 +386,9 @@ func prepareListenerRequestHandling(
 		c.AbortWithError(http.StatusBadRequest, errors.WithMessage(err, "failed to extract args from request"))
 		return true, nil
 	}
+
+	if authInfo != nil {
+		args[keyArgsAuth] = authInfo
+	}
 	return false, args
 }
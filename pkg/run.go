@@ -0,0 +1,164 @@
+package pkg
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+
+	"qvalet/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+type RunOptions struct {
+	ServerOptions
+
+	// Request to execute, e.g. `/hello/world?key=value`
+	Method  string
+	Path    string
+	Headers http.Header
+	Body    []byte
+
+	// If true, the command is only prepared, as the preview plugin does
+	DryRun bool
+}
+
+type RunResult struct {
+	// Set unless it is a dry run
+	Response *ListenerResponse
+	// Set only on dry runs
+	Preview interface{}
+
+	// True if the execution failed, or if the listener was not found
+	Failed bool
+}
+
+// RunListener executes the listener matching the request, without starting any server.
+// The args are extracted from the request exactly as for HTTP requests, but auth is
+// skipped, as this is meant to be used locally, e.g. for debugging or from cron.
+func RunListener(options RunOptions) (*RunResult, error) {
+	configs, err := loadConfigs(options.ServerOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, config := range configs {
+		result, found, err := runListenerInConfig(options, config)
+		if found {
+			return result, err
+		}
+	}
+
+	return nil, errors.Errorf("no listener found for %s %s", options.Method, options.Path)
+}
+
+func runListenerInConfig(options RunOptions, config *Config) (result *RunResult, found bool, err error) {
+	// gin panics on route conflicts
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("failed to mount routes: %v", r)
+			found = true
+		}
+	}()
+
+	engine := gin.New()
+	for route, listenerConfig := range config.Listeners {
+		route := route
+		listenerConfig := listenerConfig
+
+		// Listeners are compiled only when matched, so that we do not connect to
+		// the storage and databases of other listeners
+		handler := func(c *gin.Context) {
+			found = true
+			result, err = runListener(c, options, config, route, listenerConfig)
+			c.Abort()
+		}
+
+		mergedConfig, mergeErr := MergeListenerConfig(&config.Defaults, listenerConfig)
+		if mergeErr != nil {
+			return nil, true, errors.WithMessagef(mergeErr, "failed to merge listener config for route %s", route)
+		}
+		for _, method := range mergedConfig.methods() {
+			engine.Handle(method, route, handler)
+		}
+	}
+
+	req := httptest.NewRequest(options.Method, options.Path, bytes.NewReader(options.Body))
+	for key, values := range options.Headers {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+
+	engine.ServeHTTP(httptest.NewRecorder(), req)
+	return result, found, err
+}
+
+func runListener(
+	c *gin.Context,
+	options RunOptions,
+	config *Config,
+	route string,
+	listenerConfig *ListenerConfig,
+) (*RunResult, error) {
+	listener, err := compileListener(&config.Defaults, listenerConfig, route, false, nil, options.DryRun)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to compile listener for route %s", route)
+	}
+
+	args, err := utils.ExtractArgsFromGinContext(c)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to extract args from request")
+	}
+
+	if options.DryRun {
+		listenerClone, err := listener.clone()
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to clone listener")
+		}
+		defer listenerClone.cleanTemporaryFiles()
+
+		preparedExecutionResult, handledResult, err := listenerClone.prepareExecution(args, make(map[string]interface{}))
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to prepare command execution")
+		}
+
+		var preview interface{} = listenerClone.redactor.PreparedExecution(preparedExecutionResult)
+		if handledResult != nil {
+			preview = handledResult
+		}
+		return &RunResult{Preview: preview}, nil
+	}
+
+	warnRunSkippedPlugins(listener)
+
+	_, response, err := listener.HandleRequest(c, args, nil)
+	result := &RunResult{
+		Response: response,
+		Failed:   err != nil,
+	}
+	if response == nil && err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// warnRunSkippedPlugins warns about plugins which cannot work in a single local execution:
+// request plugins (e.g. rate limit, cache or debounce) are skipped, so that the command is
+// always executed right away, and lifecycle plugins (e.g. schedule) are never started
+func warnRunSkippedPlugins(listener *CompiledListener) {
+	var skipped []string
+	for _, plugin := range listener.plugins {
+		_, hookRequest := plugin.(PluginHookRequest)
+		_, lifecycle := plugin.(PluginLifecycle)
+		if hookRequest || lifecycle {
+			skipped = append(skipped, reflect.TypeOf(plugin).Elem().Name())
+		}
+	}
+
+	if len(skipped) > 0 {
+		listener.Logger().WithField("plugins", skipped).Warn("plugins handling requests or running in the background are not applied when running a listener from the CLI")
+	}
+}
@@ -0,0 +1,58 @@
+package pkg
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunListener(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(filename, []byte(`
+listeners:
+  /run/:name:
+    methods: [ POST ]
+    auth:
+      - apiKeys: [ myKey ]
+    command: echo
+    args: [ "{{ .name }} {{ .value }} {{ .__qvRequest.Method }}" ]
+    return: [ output ]
+  /run-fail:
+    command: "false"
+`), 0600))
+
+	options := RunOptions{
+		ServerOptions: ServerOptions{ConfigFilenames: []string{filename}},
+		Method:        http.MethodPost,
+		Path:          "/run/hello",
+		Headers:       http.Header{"Content-Type": []string{gin.MIMEJSON}},
+		Body:          []byte(`{"value": 42}`),
+	}
+
+	// Auth is not checked
+	result, err := RunListener(options)
+	require.NoError(t, err)
+	require.False(t, result.Failed)
+	require.Equal(t, "hello 42 POST\n", result.Response.Output)
+
+	options.DryRun = true
+	result, err = RunListener(options)
+	require.NoError(t, err)
+	require.Nil(t, result.Response)
+	require.Equal(t, []string{"hello 42 POST"}, result.Preview.(*preparedExecutionResult).Args)
+
+	options.DryRun = false
+	options.Method = http.MethodGet
+	_, err = RunListener(options)
+	require.Error(t, err)
+
+	options.Path = "/run-fail"
+	result, err = RunListener(options)
+	require.NoError(t, err)
+	require.True(t, result.Failed)
+	require.NotNil(t, result.Response.Error)
+}
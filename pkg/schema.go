@@ -0,0 +1,406 @@
+package pkg
+
+import (
+	"embed"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"qvalet/pkg/utils"
+
+	"github.com/pkg/errors"
+)
+
+const jsonSchemaVersion = "http://json-schema.org/draft-07/schema#"
+
+// The config types are documented only via Go comments, so the sources are embedded
+// to include the comments in the schema, which always matches the running version
+//
+//go:embed *.go
+var schemaSourceFiles embed.FS
+
+// Types decoded from strings via the config decode hooks
+var schemaStringTypes = map[reflect.Type]bool{
+	reflect.TypeOf(Template{}):               true,
+	reflect.TypeOf(IfTemplate{}):             true,
+	reflect.TypeOf(ListenerTemplate{}):       true,
+	reflect.TypeOf(ListenerIfTemplate{}):     true,
+	reflect.TypeOf(utils.StringFromEnvVar{}): true,
+}
+
+// Allowed values of the custom validators
+var schemaValidatorEnums = map[string][]string{
+	"listenerReturnKey": {ReturnKeyAll, ReturnKeyArgs, ReturnKeyCommand, ReturnKeyEnv, ReturnKeyOutput, ReturnKeyStorage},
+	"listenerLogKey":    {LogKeyAll, LogKeyArgs, LogKeyCommand, LogKeyEnv, LogKeyOutput, LogKeyStorage},
+	"storageStoreKey":   {string(StoreKeyAll), string(StoreKeyArgs), string(StoreKeyCommand), string(StoreKeyEnv), string(StoreKeyOutput)},
+	"authHeaderMethod":  {string(AuthHeaderMethodNone), string(AuthHeaderMethodHMACSHA256)},
+}
+
+func init() {
+	var versions []string
+	for version := range tlsVersions {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	schemaValidatorEnums["tlsVersion"] = versions
+}
+
+type JSONSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Ref                  string                 `json:"$ref,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Type                 interface{}            `json:"type,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	AdditionalProperties interface{}            `json:"additionalProperties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AllOf                []*JSONSchema          `json:"allOf,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	Enum                 []interface{}          `json:"enum,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	MaxLength            *int                   `json:"maxLength,omitempty"`
+	MinItems             *int                   `json:"minItems,omitempty"`
+	MaxItems             *int                   `json:"maxItems,omitempty"`
+	Definitions          map[string]*JSONSchema `json:"definitions,omitempty"`
+}
+
+// GenerateConfigJSONSchema returns the JSON Schema of config files, generated from the
+// config structs, their `mapstructure` keys, `validate` tags and documentation comments
+func GenerateConfigJSONSchema() (*JSONSchema, error) {
+	return generateJSONSchema("qValet config", reflect.TypeOf(Config{}))
+}
+
+// GenerateDefaultsJSONSchema returns the JSON Schema of defaults files, which define a listener
+func GenerateDefaultsJSONSchema() (*JSONSchema, error) {
+	return generateJSONSchema("qValet defaults", reflect.TypeOf(ListenerConfig{}))
+}
+
+func generateJSONSchema(title string, root reflect.Type) (*JSONSchema, error) {
+	comments, err := getSchemaComments()
+	if err != nil {
+		return nil, err
+	}
+
+	g := &jsonSchemaGenerator{
+		comments:    comments,
+		definitions: make(map[string]*JSONSchema),
+		names:       make(map[reflect.Type]string),
+	}
+
+	if root.Kind() != reflect.Struct {
+		return nil, errors.Errorf("root type %s is not a struct", root)
+	}
+	rootName := g.definitionForStruct(root)
+
+	// Inline the root definition, which may still be referenced, e.g. by error handlers
+	rootSchema := *g.definitions[rootName]
+	rootSchema.Schema = jsonSchemaVersion
+	rootSchema.Title = title
+	rootSchema.Definitions = g.definitions
+	return &rootSchema, nil
+}
+
+type schemaTypeComments struct {
+	doc    string
+	fields map[string]string
+}
+
+var schemaCommentsOnce sync.Once
+var schemaComments map[string]*schemaTypeComments
+var schemaCommentsErr error
+
+// Maps type name -> comments, parsed from the embedded sources
+func getSchemaComments() (map[string]*schemaTypeComments, error) {
+	schemaCommentsOnce.Do(func() {
+		schemaComments, schemaCommentsErr = parseSchemaComments()
+	})
+	return schemaComments, schemaCommentsErr
+}
+
+func parseSchemaComments() (map[string]*schemaTypeComments, error) {
+	entries, err := schemaSourceFiles.ReadDir(".")
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to list embedded sources")
+	}
+
+	comments := make(map[string]*schemaTypeComments)
+	fileSet := token.NewFileSet()
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), "_test.go") {
+			continue
+		}
+
+		src, err := schemaSourceFiles.ReadFile(entry.Name())
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to read embedded source %s", entry.Name())
+		}
+		file, err := parser.ParseFile(fileSet, entry.Name(), src, parser.ParseComments)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to parse embedded source %s", entry.Name())
+		}
+
+		for _, decl := range file.Decls {
+			genDecl, ok := decl.(*ast.GenDecl)
+			if !ok || genDecl.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range genDecl.Specs {
+				typeSpec := spec.(*ast.TypeSpec)
+				structType, ok := typeSpec.Type.(*ast.StructType)
+				if !ok {
+					continue
+				}
+
+				doc := typeSpec.Doc
+				if doc == nil && len(genDecl.Specs) == 1 {
+					doc = genDecl.Doc
+				}
+				typeComments := &schemaTypeComments{
+					doc:    cleanSchemaComment(doc),
+					fields: make(map[string]string),
+				}
+				for _, field := range structType.Fields.List {
+					comment := cleanSchemaComment(field.Doc)
+					if comment == "" {
+						comment = cleanSchemaComment(field.Comment)
+					}
+					for _, name := range field.Names {
+						typeComments.fields[name.Name] = comment
+					}
+				}
+				comments[typeSpec.Name.Name] = typeComments
+			}
+		}
+	}
+
+	return comments, nil
+}
+
+// Matches the docs fragment markers, e.g. `/// [config-docs]`, and the formatter markers
+var regexSchemaCommentMarker = regexp.MustCompile(`^(/ \[[\w-]+]|@formatter:\w+)$`)
+
+func cleanSchemaComment(group *ast.CommentGroup) string {
+	if group == nil {
+		return ""
+	}
+
+	var lines []string
+	for _, line := range strings.Split(group.Text(), "\n") {
+		if regexSchemaCommentMarker.MatchString(strings.TrimSpace(line)) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+type jsonSchemaGenerator struct {
+	comments    map[string]*schemaTypeComments
+	definitions map[string]*JSONSchema
+	// Maps type -> definition name
+	names map[reflect.Type]string
+}
+
+func (g *jsonSchemaGenerator) schemaForType(t reflect.Type) *JSONSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if schemaStringTypes[t] {
+		return &JSONSchema{Type: "string"}
+	}
+	if t == reflect.TypeOf(time.Duration(0)) {
+		// Either a duration string, e.g. `1m30s`, or nanoseconds
+		return &JSONSchema{Type: []string{"string", "integer"}}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &JSONSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &JSONSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &JSONSchema{Type: "number"}
+	case reflect.String:
+		return &JSONSchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		schema := &JSONSchema{
+			Type:  "array",
+			Items: g.schemaForType(t.Elem()),
+		}
+		if t.Elem().Kind() == reflect.String {
+			// Comma-separated strings are split into lists
+			schema.Type = []string{"array", "string"}
+		}
+		return schema
+	case reflect.Map:
+		return &JSONSchema{
+			Type:                 "object",
+			AdditionalProperties: g.schemaForType(t.Elem()),
+		}
+	case reflect.Struct:
+		return &JSONSchema{Ref: "#/definitions/" + g.definitionForStruct(t)}
+	}
+
+	// Anything goes, e.g. interface{}
+	return &JSONSchema{}
+}
+
+func (g *jsonSchemaGenerator) definitionForStruct(t reflect.Type) string {
+	if name, found := g.names[t]; found {
+		return name
+	}
+
+	name := t.Name()
+	if _, found := g.definitions[name]; found {
+		name = strings.ReplaceAll(t.PkgPath(), "/", ".") + "." + name
+	}
+	g.names[t] = name
+
+	typeComments := g.comments[t.Name()]
+	if t.PkgPath() != reflect.TypeOf(Config{}).PkgPath() || typeComments == nil {
+		typeComments = &schemaTypeComments{fields: map[string]string{}}
+	}
+
+	schema := &JSONSchema{
+		Type:                 "object",
+		Description:          typeComments.doc,
+		Properties:           make(map[string]*JSONSchema),
+		AdditionalProperties: false,
+	}
+	// Registered before the fields, to support recursive types
+	g.definitions[name] = schema
+
+	for idx := 0; idx < t.NumField(); idx++ {
+		field := t.Field(idx)
+		if field.PkgPath != "" {
+			// Unexported
+			continue
+		}
+
+		key := strings.Split(field.Tag.Get("mapstructure"), ",")[0]
+		if key == "-" {
+			continue
+		}
+		if key == "" {
+			key = field.Name
+		}
+
+		fieldSchema := g.schemaForType(field.Type)
+		required := applySchemaValidateTag(fieldSchema, field.Tag.Get("validate"))
+
+		if description := typeComments.fields[field.Name]; description != "" {
+			if fieldSchema.Ref != "" {
+				// Siblings of $ref are ignored in draft-07
+				fieldSchema = &JSONSchema{
+					Description: description,
+					AllOf:       []*JSONSchema{fieldSchema},
+				}
+			} else {
+				fieldSchema.Description = description
+			}
+		}
+
+		// Listener entries can be inherited from the defaults
+		if required && t != reflect.TypeOf(ListenerConfig{}) {
+			schema.Required = append(schema.Required, key)
+		}
+
+		schema.Properties[key] = fieldSchema
+	}
+
+	return name
+}
+
+// Applies the validation rules to the schema, and returns whether the field is required
+func applySchemaValidateTag(schema *JSONSchema, tag string) bool {
+	if tag == "" || tag == "-" {
+		return false
+	}
+
+	required := false
+	rules := strings.Split(tag, ",")
+	for idx, rule := range rules {
+		name, param, _ := strings.Cut(rule, "=")
+
+		switch name {
+		case "dive":
+			if schema.Items != nil {
+				applySchemaValidateTag(schema.Items, strings.Join(rules[idx+1:], ","))
+			} else if additional, ok := schema.AdditionalProperties.(*JSONSchema); ok {
+				applySchemaValidateTag(additional, strings.Join(rules[idx+1:], ","))
+			}
+			return required
+		case "required":
+			required = true
+		case "oneof":
+			for _, value := range strings.Fields(param) {
+				schema.Enum = append(schema.Enum, schemaEnumValue(schema, value))
+			}
+		case "min", "gte":
+			applySchemaBound(schema, param, true)
+		case "max", "lte":
+			applySchemaBound(schema, param, false)
+		case "startswith":
+			schema.Pattern = "^" + regexp.QuoteMeta(param)
+		case "url":
+			schema.Format = "uri"
+		default:
+			for _, value := range schemaValidatorEnums[name] {
+				schema.Enum = append(schema.Enum, value)
+			}
+		}
+	}
+
+	return required
+}
+
+func schemaEnumValue(schema *JSONSchema, value string) interface{} {
+	if schema.Type == "integer" {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+	}
+	return value
+}
+
+func applySchemaBound(schema *JSONSchema, param string, isMin bool) {
+	value, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return
+	}
+	intValue := int(value)
+
+	switch {
+	case schema.Items != nil:
+		if isMin {
+			schema.MinItems = &intValue
+		} else {
+			schema.MaxItems = &intValue
+		}
+	case schema.Type == "string":
+		if isMin {
+			schema.MinLength = &intValue
+		} else {
+			schema.MaxLength = &intValue
+		}
+	default:
+		if isMin {
+			schema.Minimum = &value
+		} else {
+			schema.Maximum = &value
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package pkg
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateConfigJSONSchema(t *testing.T) {
+	schema, err := GenerateConfigJSONSchema()
+	require.NoError(t, err)
+	require.Equal(t, jsonSchemaVersion, schema.Schema)
+
+	// Keys and docs
+	require.Contains(t, schema.Properties, "listeners")
+	require.Contains(t, schema.Properties["port"].Description, "HTTP port")
+	require.Equal(t, 65535.0, *schema.Properties["port"].Maximum)
+
+	listener := schema.Definitions["ListenerConfig"]
+	require.NotNil(t, listener)
+	// Listener entries can be inherited from the defaults
+	require.Empty(t, listener.Required)
+	require.Equal(t, "string", listener.Properties["command"].Type)
+	require.Equal(t, []interface{}{"all", "args", "command", "env", "output", "storage"}, listener.Properties["return"].Items.Enum)
+	require.Equal(t, "#/definitions/ListenerConfig", listener.Properties["errorHandler"].AllOf[0].Ref)
+
+	require.Equal(t, []string{"id"}, schema.Definitions["PluginScheduleConfig"].Required)
+	require.Equal(t, []string{"string", "integer"}, schema.Definitions["PluginScheduleConfig"].Properties["scanInterval"].Type)
+
+	// Every plugin needs to be documented
+	plugins := schema.Definitions["PluginEntryConfig"]
+	entryType := reflect.TypeOf(PluginEntryConfig{})
+	require.Len(t, plugins.Properties, entryType.NumField())
+	for key, property := range plugins.Properties {
+		require.NotEmpty(t, property.Description, "plugin %s is not documented", key)
+		require.NotEmpty(t, property.AllOf, "plugin %s has no config", key)
+	}
+
+	_, err = json.Marshal(schema)
+	require.NoError(t, err)
+}
+
+func TestGenerateDefaultsJSONSchema(t *testing.T) {
+	schema, err := GenerateDefaultsJSONSchema()
+	require.NoError(t, err)
+	require.Contains(t, schema.Properties, "command")
+	require.Contains(t, schema.Properties, "plugins")
+	require.NotContains(t, schema.Properties, "listeners")
+}
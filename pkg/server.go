@@ -0,0 +1,606 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"qvalet/pkg/utils"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// How long to wait for file changes to settle before reloading
+const serverReloadDebounce = 500 * time.Millisecond
+
+type ServerOptions struct {
+	// Configuration files to load
+	ConfigFilenames []string
+
+	// Optional defaults configuration file
+	DefaultsFilename string
+
+	// If true, enable the debug flag on all configs
+	Debug bool
+}
+
+type ReloadStatus struct {
+	Time    time.Time `json:"time"`
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Server holds the HTTP handlers of all listen addresses, and lets us reload the configuration
+// at runtime: the new configuration is fully mounted in new engines, and handlers
+// are swapped atomically only if everything succeeded.
+type Server struct {
+	options ServerOptions
+
+	// Addresses, TLS and socket configs cannot change without a restart
+	handlers          map[string]*swappableHandler
+	tlsConfigs        map[string]*TLSConfig
+	unixSocketConfigs map[string]*UnixSocketConfig
+
+	// Addresses served via Unix sockets, including the systemd ones, which
+	// are known only once listening
+	unixSockets sync.Map
+
+	// Serializes reloads, and guards the fields below
+	lock          sync.Mutex
+	mountResults  []*MountRoutesResult
+	loggingConfig *LoggingConfig
+	filesHash     []byte
+	watcher       *fsnotify.Watcher
+	// Include patterns of the running config, to watch the included files too
+	includePatterns []string
+	// Maps address -> feature of the running config which needs the client IP
+	clientIPFeatures map[string]string
+
+	lastReload atomic.Value
+}
+
+type serverBuild struct {
+	server *Server
+
+	configsByAddress map[string][]*Config
+	engines          map[string]*gin.Engine
+	mountResults     []*MountRoutesResult
+	loggingConfig    *LoggingConfig
+	includePatterns  []string
+	clientIPFeatures map[string]string
+
+	// Maps address + route -> config of the admin and metrics routes, which configs
+	// sharing an address may all define, but can be mounted only once
+	sharedRoutes map[string]interface{}
+}
+
+type swappableHandler struct {
+	handler atomic.Value
+}
+
+func (h *swappableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.handler.Load().(http.Handler).ServeHTTP(w, r)
+}
+
+// NewServer loads the configuration, mounts all routes and starts all plugins
+func NewServer(options ServerOptions) (*Server, error) {
+	// Stdin can only be read once, so keep it around for reloads
+	options.ConfigFilenames = append([]string{}, options.ConfigFilenames...)
+	for idx, filename := range options.ConfigFilenames {
+		if filename == "-" {
+			tmpFilename, err := StdinConfigToTempFile("config")
+			if err != nil {
+				return nil, err
+			}
+			options.ConfigFilenames[idx] = tmpFilename
+		}
+	}
+
+	s := &Server{
+		options:           options,
+		handlers:          make(map[string]*swappableHandler),
+		tlsConfigs:        make(map[string]*TLSConfig),
+		unixSocketConfigs: make(map[string]*UnixSocketConfig),
+	}
+
+	build, err := s.build(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	filesHash, err := hashFiles(s.watchedFiles(build.includePatterns))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ConfigureLogging(build.loggingConfig); err != nil {
+		return nil, err
+	}
+
+	if err := startMountResultsPlugins(build.mountResults, nil); err != nil {
+		return nil, err
+	}
+
+	for address, engine := range build.engines {
+		handler := &swappableHandler{}
+		handler.handler.Store(http.Handler(engine))
+		s.handlers[address] = handler
+		s.tlsConfigs[address] = GetTLSConfig(build.configsByAddress[address])
+		s.unixSocketConfigs[address] = getUnixSocketConfig(build.configsByAddress[address])
+	}
+
+	s.mountResults = build.mountResults
+	s.loggingConfig = build.loggingConfig
+	s.filesHash = filesHash
+	s.includePatterns = build.includePatterns
+	s.clientIPFeatures = build.clientIPFeatures
+	s.lastReload.Store(&ReloadStatus{Time: time.Now(), Success: true})
+
+	return s, nil
+}
+
+// Addresses returns all the addresses qValet needs to listen on, sorted.
+// See [Config.ListenAddress] for their format.
+func (s *Server) Addresses() []string {
+	var addresses []string
+	for address := range s.handlers {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+func (s *Server) Handler(address string) http.Handler {
+	return s.handlers[address]
+}
+
+func (s *Server) TLSConfig(address string) *TLSConfig {
+	return s.tlsConfigs[address]
+}
+
+// Listen opens the listener for the address, which needs to be served with [Server.Handler]
+func (s *Server) Listen(address string) (net.Listener, error) {
+	listener, err := Listen(address, s.unixSocketConfigs[address])
+	if err != nil {
+		return nil, err
+	}
+
+	// systemd sockets may turn out to be Unix sockets
+	if listener.Addr().Network() == "unix" {
+		s.unixSockets.Store(address, true)
+
+		s.lock.Lock()
+		feature := s.clientIPFeatures[address]
+		s.lock.Unlock()
+
+		if feature != "" {
+			_ = listener.Close()
+			return nil, s.checkClientIPAvailable(address, feature)
+		}
+	}
+
+	return listener, nil
+}
+
+// checkClientIPAvailable fails if the address is served via a Unix socket, where
+// the feature cannot work, because requests have no client IP
+func (s *Server) checkClientIPAvailable(address string, feature string) error {
+	_, unixSocket := s.unixSockets.Load(address)
+	if unixSocket || strings.HasPrefix(address, listenAddressUnixPrefix) {
+		return errors.Errorf("%s needs the client IP, which is not available on socket %s", feature, address)
+	}
+	return nil
+}
+
+func (s *Server) MountResults() []*MountRoutesResult {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.mountResults
+}
+
+func (s *Server) LastReload() *ReloadStatus {
+	return s.lastReload.Load().(*ReloadStatus)
+}
+
+func (s *Server) build(previous []*MountRoutesResult) (build *serverBuild, err error) {
+	// gin panics on invalid routes, e.g. conflicts, which must not take down a running server
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("failed to mount routes: %v", r)
+		}
+	}()
+
+	configs, err := loadConfigs(s.options)
+	if err != nil {
+		return nil, err
+	}
+
+	configsByAddress, err := groupConfigsByAddress(configs...)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to merge configs")
+	}
+
+	if err := checkRouteConflicts(configsByAddress); err != nil {
+		return nil, err
+	}
+
+	loggingConfig, err := GetLoggingConfig(configs)
+	if err != nil {
+		return nil, err
+	}
+
+	build = &serverBuild{
+		server:           s,
+		configsByAddress: configsByAddress,
+		engines:          make(map[string]*gin.Engine),
+		loggingConfig:    loggingConfig,
+		sharedRoutes:     make(map[string]interface{}),
+		clientIPFeatures: make(map[string]string),
+	}
+
+	for _, config := range configs {
+		build.includePatterns = append(build.includePatterns, config.includePatterns...)
+	}
+
+	for address, configs := range configsByAddress {
+		router := build.engine(address)
+		if err := router.SetTrustedProxies(configs[0].TrustedProxies); err != nil {
+			return nil, errors.WithMessagef(err, "failed to set trusted proxies for address %s", address)
+		}
+
+		for _, config := range configs {
+			mountResult, err := RemountRoutes(router, config, address+"_", previous)
+			if err != nil {
+				return nil, errors.WithMessage(err, "failed to mount routes")
+			}
+
+			if feature := clientIPFeature(config, mountResult); feature != "" {
+				if err := s.checkClientIPAvailable(address, feature); err != nil {
+					return nil, err
+				}
+				build.clientIPFeatures[address] = feature
+			}
+
+			if config.Admin != nil {
+				mount, err := build.mountSharedRoute(address, config.Admin.route(), config.Admin)
+				if err != nil {
+					return nil, err
+				}
+				if mount {
+					mountAdminRoutes(router, config, s)
+				}
+			}
+
+			// Metrics can be served on a dedicated port
+			if config.Metrics != nil {
+				metricsAddress := address
+				if config.Metrics.Port != nil {
+					metricsAddress = tcpListenAddress(*config.Metrics.Port)
+				}
+				mount, err := build.mountSharedRoute(metricsAddress, config.Metrics.route(), config.Metrics)
+				if err != nil {
+					return nil, err
+				}
+				if mount {
+					mountMetricsRoutes(build.engine(metricsAddress), config)
+				}
+			}
+
+			build.mountResults = append(build.mountResults, mountResult)
+		}
+	}
+
+	return build, nil
+}
+
+// mountSharedRoute returns true if the admin or metrics route has not been mounted
+// on the address yet. Configs sharing the address can define the same route again,
+// as long as they agree on its config.
+func (b *serverBuild) mountSharedRoute(address string, route string, config interface{}) (bool, error) {
+	key := address + " " + route
+	mounted, found := b.sharedRoutes[key]
+	if !found {
+		b.sharedRoutes[key] = config
+		return true, nil
+	}
+	if !reflect.DeepEqual(mounted, config) {
+		return false, errors.Errorf("all configs using address %s must share the same config for route %s", address, route)
+	}
+	return false, nil
+}
+
+// loadConfigs loads all the config files, merging the defaults into each of them
+func loadConfigs(options ServerOptions) ([]*Config, error) {
+	var defaults *ListenerConfig
+	if options.DefaultsFilename != "" {
+		var err error
+		defaults, err = LoadDefaults(options.DefaultsFilename)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to load defaults from file %s", options.DefaultsFilename)
+		}
+	}
+
+	var configs []*Config
+	for _, filename := range options.ConfigFilenames {
+		config, err := LoadConfig(filename)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to load config from file %s", filename)
+		}
+
+		if options.Debug {
+			config.Debug = true
+		}
+
+		if defaults != nil {
+			newDefaults, err := MergeListenerConfig(defaults, &config.Defaults)
+			if err != nil {
+				return nil, errors.WithMessage(err, "failed to merge defaults config")
+			}
+			config.Defaults = *newDefaults
+		}
+
+		if err := utils.Validate.Struct(config); err != nil {
+			return nil, errors.WithMessage(err, "failed to validate config")
+		}
+
+		configs = append(configs, config)
+	}
+
+	return configs, nil
+}
+
+// engine returns the gin engine serving the address, creating it if needed
+func (b *serverBuild) engine(address string) *gin.Engine {
+	if router, found := b.engines[address]; found {
+		return router
+	}
+
+	router := gin.New()
+	// Client IPs come from the connection, unless trusted proxies are configured
+	_ = router.SetTrustedProxies(nil)
+	router.Use(gin.Recovery())
+	router.Use(utils.GetGinRequestIdHandler())
+	router.Use(utils.GetGinLoggerHandler())
+	router.Use(gin.ErrorLogger())
+
+	router.GET("/healthz", func(context *gin.Context) {
+		context.Set(utils.GinContextDoNotLogEntry, true)
+		context.AbortWithStatus(http.StatusOK)
+	})
+	router.GET("/readyz", getGinReadinessHandler(b.server))
+
+	b.engines[address] = router
+	return router
+}
+
+// Reload loads the configuration again, and swaps the HTTP handlers only if the
+// new configuration could be fully mounted and its plugins started. Otherwise,
+// the previous configuration keeps running.
+// startMountResultsPlugins starts the plugins of all the mount results. If any of them fails
+// to start, the ones already started are stopped again, except the ones still used by the
+// running mount results.
+func startMountResultsPlugins(results []*MountRoutesResult, running []*MountRoutesResult) error {
+	for _, r := range results {
+		if err := r.PluginsStart(); err != nil {
+			for _, r := range results {
+				r.PluginsStopExcept(running)
+			}
+			return errors.WithMessage(err, "failed to start plugins")
+		}
+	}
+	return nil
+}
+
+func (s *Server) Reload() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.reload()
+
+	status := &ReloadStatus{
+		Time:    time.Now(),
+		Success: err == nil,
+	}
+	if err != nil {
+		status.Error = err.Error()
+		logrus.WithError(err).Error("failed to reload config, keeping the previous one")
+	} else {
+		logrus.Info("config reloaded")
+	}
+	s.lastReload.Store(status)
+
+	return err
+}
+
+func (s *Server) reload() error {
+	build, err := s.build(s.mountResults)
+	if err != nil {
+		return err
+	}
+
+	filesHash, err := hashFiles(s.watchedFiles(build.includePatterns))
+	if err != nil {
+		return err
+	}
+
+	if len(build.engines) != len(s.handlers) {
+		return errors.New("adding or removing listen addresses requires a restart")
+	}
+	for address := range build.engines {
+		if _, found := s.handlers[address]; !found {
+			return errors.New("adding or removing listen addresses requires a restart")
+		}
+		if !reflect.DeepEqual(GetTLSConfig(build.configsByAddress[address]), s.tlsConfigs[address]) {
+			return errors.Errorf("changing the TLS config of %s requires a restart", address)
+		}
+		if !reflect.DeepEqual(getUnixSocketConfig(build.configsByAddress[address]), s.unixSocketConfigs[address]) {
+			return errors.Errorf("changing the socket config of %s requires a restart", address)
+		}
+	}
+
+	if err := ConfigureLogging(build.loggingConfig); err != nil {
+		return err
+	}
+
+	if err := startMountResultsPlugins(build.mountResults, s.mountResults); err != nil {
+		_ = ConfigureLogging(s.loggingConfig)
+		return err
+	}
+
+	for address, engine := range build.engines {
+		s.handlers[address].handler.Store(http.Handler(engine))
+	}
+
+	// In-flight requests of the previous config keep running until completion
+	for _, r := range s.mountResults {
+		r.PluginsStopExcept(build.mountResults)
+	}
+
+	s.mountResults = build.mountResults
+	s.loggingConfig = build.loggingConfig
+	s.filesHash = filesHash
+	s.includePatterns = build.includePatterns
+	s.clientIPFeatures = build.clientIPFeatures
+
+	// The new config may include files from other directories
+	if s.watcher != nil {
+		if err := s.watchDirectories(s.watcher, s.includePatterns); err != nil {
+			logrus.WithError(err).Warn("failed to watch the included config files")
+		}
+	}
+
+	return nil
+}
+
+// watchedFiles returns the config and defaults files, and the files currently
+// matching the include patterns
+func (s *Server) watchedFiles(includePatterns []string) []string {
+	files := append([]string{}, s.options.ConfigFilenames...)
+	if s.options.DefaultsFilename != "" {
+		files = append(files, s.options.DefaultsFilename)
+	}
+	for _, pattern := range includePatterns {
+		matches, _ := filepath.Glob(pattern)
+		files = append(files, matches...)
+	}
+	return files
+}
+
+func hashFiles(files []string) ([]byte, error) {
+	hash := sha256.New()
+	for _, filename := range files {
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to read file %s", filename)
+		}
+		hash.Write([]byte(filename))
+		hash.Write(content)
+	}
+	return hash.Sum(nil), nil
+}
+
+// Watch reloads the configuration whenever the config or defaults files change
+func (s *Server) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.WithMessage(err, "failed to create files watcher")
+	}
+
+	s.lock.Lock()
+	err = s.watchDirectories(watcher, s.includePatterns)
+	if err == nil {
+		s.watcher = watcher
+	}
+	s.lock.Unlock()
+
+	if err != nil {
+		_ = watcher.Close()
+		return err
+	}
+
+	go s.watchLoop(watcher)
+	return nil
+}
+
+// watchDirectories adds the directories of the watched files to the watcher.
+// We watch the parent directories, so that we can follow files replaced via
+// renames, e.g. by editors or by Kubernetes ConfigMap updates.
+func (s *Server) watchDirectories(watcher *fsnotify.Watcher, includePatterns []string) error {
+	dirs := make(map[string]bool)
+	for _, filename := range s.watchedFiles(includePatterns) {
+		dirs[filepath.Dir(filename)] = true
+	}
+	// Files added later to included directories trigger a reload too
+	for _, pattern := range includePatterns {
+		dir := filepath.Dir(pattern)
+		if _, err := os.Stat(dir); err == nil && !strings.ContainsAny(dir, "*?[") {
+			dirs[dir] = true
+		}
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			return errors.WithMessagef(err, "failed to watch directory %s", dir)
+		}
+	}
+	return nil
+}
+
+func (s *Server) watchLoop(watcher *fsnotify.Watcher) {
+	var debounce <-chan time.Time
+
+	for {
+		select {
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			debounce = time.After(serverReloadDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.WithError(err).Warn("config files watcher error")
+		case <-debounce:
+			debounce = nil
+
+			// Directories may contain other files, so only reload on actual changes
+			s.lock.Lock()
+			filesHash, err := hashFiles(s.watchedFiles(s.includePatterns))
+			changed := err == nil && !bytes.Equal(filesHash, s.filesHash)
+			s.lock.Unlock()
+
+			if err != nil {
+				logrus.WithError(err).Warn("failed to read config files")
+				continue
+			}
+
+			if changed {
+				logrus.Info("config files changed, reloading")
+				_ = s.Reload()
+			}
+		}
+	}
+}
+
+// Close stops watching the config files
+func (s *Server) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.watcher != nil {
+		_ = s.watcher.Close()
+		s.watcher = nil
+	}
+}
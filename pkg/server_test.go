@@ -0,0 +1,487 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestServerConfig(t *testing.T, filename string, content string) {
+	require.NoError(t, os.WriteFile(filename, []byte(content), 0600))
+}
+
+func serveTestRequest(s *Server, address string, path string) int {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	s.Handler(address).ServeHTTP(w, req)
+	return w.Code
+}
+
+// testServer serves requests in-process, without listening on any port
+type testServer struct {
+	*Server
+	address string
+}
+
+// newTestServer loads the config, served on its first address, and stops
+// the plugins at the end of the test
+func newTestServer(t *testing.T, config string) *testServer {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestServerConfig(t, filename, config)
+
+	s, err := NewServer(ServerOptions{ConfigFilenames: []string{filename}})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		for _, r := range s.MountResults() {
+			r.PluginsStop()
+		}
+	})
+
+	return &testServer{Server: s, address: s.Addresses()[0]}
+}
+
+func (s *testServer) serve(req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.Handler(s.address).ServeHTTP(w, req)
+	return w
+}
+
+func (s *testServer) get(path string) *httptest.ResponseRecorder {
+	return s.serve(httptest.NewRequest(http.MethodGet, path, nil))
+}
+
+// As for the examples, database tests use the database at the host defined by this env
+// var, which overrides the host of the config defaults, and are skipped if it is not set
+const testDatabaseHostEnv = "QV_DEFAULTS_DATABASE_HOST"
+
+// testDatabaseDefaults returns the config defaults entry, which lets all listeners use
+// the test database
+func testDatabaseDefaults(t *testing.T) string {
+	if os.Getenv(testDatabaseHostEnv) == "" {
+		t.Skipf("%s is not set, skipping database test", testDatabaseHostEnv)
+	}
+	return `
+defaults:
+  database:
+    host: localhost
+    dbName: postgres
+    username: postgres
+    password: password
+    options:
+      sslmode: disable
+`
+}
+
+// testDatabaseId returns an id which is unique across test runs, so that rows
+// left behind by previous runs never interfere
+func testDatabaseId(name string) string {
+	return fmt.Sprintf("%s-%d", name, time.Now().UnixNano())
+}
+
+func TestServerReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestServerConfig(t, filename, `
+port: 17055
+admin:
+  route: /admin
+  auth:
+    - apiKeys: [ adminKey ]
+      queryAuth: true
+listeners:
+  /first:
+    command: "true"
+`)
+
+	s, err := NewServer(ServerOptions{ConfigFilenames: []string{filename}})
+	require.NoError(t, err)
+	require.Equal(t, []string{":17055"}, s.Addresses())
+	require.Equal(t, http.StatusOK, serveTestRequest(s, ":17055", "/first"))
+	require.Equal(t, http.StatusNotFound, serveTestRequest(s, ":17055", "/second"))
+
+	writeTestServerConfig(t, filename, `
+port: 17055
+admin:
+  route: /admin
+  auth:
+    - apiKeys: [ adminKey ]
+      queryAuth: true
+listeners:
+  /second:
+    command: "true"
+`)
+	require.NoError(t, s.Reload())
+	require.True(t, s.LastReload().Success)
+	require.Equal(t, http.StatusNotFound, serveTestRequest(s, ":17055", "/first"))
+	require.Equal(t, http.StatusOK, serveTestRequest(s, ":17055", "/second"))
+
+	// Invalid configs keep the previous one running
+	writeTestServerConfig(t, filename, `
+port: 17055
+listeners:
+  /third:
+    methods: [ WRONG ]
+    command: "true"
+`)
+	require.Error(t, s.Reload())
+	require.False(t, s.LastReload().Success)
+	require.NotEmpty(t, s.LastReload().Error)
+	require.Equal(t, http.StatusOK, serveTestRequest(s, ":17055", "/second"))
+	require.Equal(t, http.StatusOK, serveTestRequest(s, ":17055", "/admin/reload?__qvApiKey=adminKey"))
+
+	// Ports cannot change without a restart
+	writeTestServerConfig(t, filename, `
+port: 17056
+listeners:
+  /second:
+    command: "true"
+`)
+	require.Error(t, s.Reload())
+	require.Equal(t, http.StatusOK, serveTestRequest(s, ":17055", "/second"))
+}
+
+func TestServerWatchNewIncludes(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "config.yaml")
+	writeTestServerConfig(t, filename, `
+port: 17067
+listeners:
+  /first:
+    command: "true"
+`)
+
+	s, err := NewServer(ServerOptions{ConfigFilenames: []string{filename}})
+	require.NoError(t, err)
+	require.NoError(t, s.Watch())
+	defer s.Close()
+
+	// Directories of include patterns added by a reload are watched too
+	includedDir := filepath.Join(dir, "included")
+	require.NoError(t, os.Mkdir(includedDir, 0700))
+	writeTestServerConfig(t, filename, `
+port: 17067
+include: [ included/*.yaml ]
+listeners:
+  /first:
+    command: "true"
+`)
+	require.NoError(t, s.Reload())
+
+	writeTestServerConfig(t, filepath.Join(includedDir, "second.yaml"), `
+listeners:
+  /second:
+    command: "true"
+`)
+	require.Eventually(t, func() bool {
+		return serveTestRequest(s, ":17067", "/second") == http.StatusOK
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+type testLifecyclePlugin struct {
+	PluginBase
+	started  int
+	stopped  int
+	startErr error
+}
+
+func (p *testLifecyclePlugin) Clone(_ *CompiledListener) (PluginInterface, error) {
+	return p, nil
+}
+
+func (p *testLifecyclePlugin) OnStart() error {
+	if p.startErr != nil {
+		return p.startErr
+	}
+	p.started++
+	return nil
+}
+
+func (p *testLifecyclePlugin) OnStop() {
+	p.stopped++
+}
+
+func TestReuseLifecyclePlugins(t *testing.T) {
+	oldPlugin := &testLifecyclePlugin{PluginBase: NewPluginBase("test")}
+	oldListener := &CompiledListener{plugins: []PluginInterface{oldPlugin}}
+	oldResult := &MountRoutesResult{listenersMap: map[string]*CompiledListener{"a": oldListener}}
+	require.NoError(t, oldResult.PluginsStart())
+	require.Equal(t, 1, oldPlugin.started)
+
+	newPlugin := &testLifecyclePlugin{PluginBase: NewPluginBase("test")}
+	newListener := &CompiledListener{plugins: []PluginInterface{newPlugin}}
+	reused := newListener.reuseLifecyclePlugins(oldListener)
+	require.Equal(t, []PluginInterface{oldPlugin}, reused)
+
+	newResult := &MountRoutesResult{listenersMap: map[string]*CompiledListener{"a": newListener}, reusedPlugins: reused}
+	require.NoError(t, newResult.PluginsStart())
+
+	// The running plugin is not started again, nor stopped by the previous mount
+	oldResult.PluginsStopExcept([]*MountRoutesResult{newResult})
+	require.Equal(t, 1, oldPlugin.started)
+	require.Equal(t, 0, oldPlugin.stopped)
+	require.Equal(t, 0, newPlugin.started)
+
+	newResult.PluginsStop()
+	require.Equal(t, 1, oldPlugin.stopped)
+}
+
+func TestPluginsStopSkipsNotStarted(t *testing.T) {
+	failing := &testLifecyclePlugin{PluginBase: NewPluginBase("test"), startErr: errors.New("failed")}
+	other := &testLifecyclePlugin{PluginBase: NewPluginBase("test")}
+	result := &MountRoutesResult{listenersMap: map[string]*CompiledListener{
+		"a": {plugins: []PluginInterface{failing, other}},
+	}}
+	require.Error(t, result.PluginsStart())
+
+	// Only plugins which actually started are stopped
+	result.PluginsStop()
+	require.Equal(t, 0, failing.stopped)
+	require.Equal(t, 0, other.stopped)
+}
+
+func TestStartMountResultsPluginsFailure(t *testing.T) {
+	started := &testLifecyclePlugin{PluginBase: NewPluginBase("test")}
+	failing := &testLifecyclePlugin{PluginBase: NewPluginBase("test"), startErr: errors.New("failed")}
+	results := []*MountRoutesResult{
+		{listenersMap: map[string]*CompiledListener{"a": {plugins: []PluginInterface{started}}}},
+		{listenersMap: map[string]*CompiledListener{"b": {plugins: []PluginInterface{failing}}}},
+	}
+
+	// Plugins of other mount results, which already started, are stopped again
+	require.Error(t, startMountResultsPlugins(results, nil))
+	require.Equal(t, 1, started.started)
+	require.Equal(t, 1, started.stopped)
+	require.Equal(t, 0, failing.stopped)
+}
+
+func TestServerMetrics(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestServerConfig(t, filename, `
+port: 17057
+metrics:
+  port: 17058
+  auth:
+    - apiKeys: [ myKey ]
+      queryAuth: true
+listeners:
+  /metrics/ok:
+    command: "true"
+  /metrics/fail:
+    command: "false"
+  /metrics/skip:
+    trigger: "false"
+    command: "true"
+  /metrics/auth:
+    auth:
+      - apiKeys: [ otherKey ]
+    command: "true"
+`)
+
+	s, err := NewServer(ServerOptions{ConfigFilenames: []string{filename}})
+	require.NoError(t, err)
+	require.Equal(t, []string{":17057", ":17058"}, s.Addresses())
+
+	require.Equal(t, http.StatusOK, serveTestRequest(s, ":17057", "/metrics/ok"))
+	require.Equal(t, http.StatusInternalServerError, serveTestRequest(s, ":17057", "/metrics/fail"))
+	require.Equal(t, http.StatusOK, serveTestRequest(s, ":17057", "/metrics/skip"))
+	require.Equal(t, http.StatusUnauthorized, serveTestRequest(s, ":17057", "/metrics/auth"))
+
+	// Metrics are served only on their own port, with their own auth
+	require.Equal(t, http.StatusNotFound, serveTestRequest(s, ":17057", "/metrics"))
+	require.Equal(t, http.StatusUnauthorized, serveTestRequest(s, ":17058", "/metrics"))
+
+	w := httptest.NewRecorder()
+	s.Handler(":17058").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics?__qvApiKey=myKey", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	body := w.Body.String()
+	require.Contains(t, body, `qvalet_executions_total{listener="/metrics/ok",outcome="success"} 1`)
+	require.Contains(t, body, `qvalet_executions_total{listener="/metrics/fail",outcome="failure"} 1`)
+	require.Contains(t, body, `qvalet_executions_total{listener="/metrics/skip",outcome="not_triggered"} 1`)
+	require.Contains(t, body, `qvalet_executions_total{listener="/metrics/auth",outcome="auth_rejected"} 1`)
+	require.Contains(t, body, `qvalet_execution_duration_seconds_count{listener="/metrics/ok"} 1`)
+	require.Contains(t, body, `qvalet_executions_in_flight{listener="/metrics/ok"} 0`)
+}
+
+func TestServerSharedAddressRoutes(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.yaml")
+	second := filepath.Join(dir, "second.yaml")
+	for idx, filename := range []string{first, second} {
+		writeTestServerConfig(t, filename, fmt.Sprintf(`
+port: 17068
+admin:
+  route: /admin
+  auth:
+    - apiKeys: [ adminKey ]
+      queryAuth: true
+metrics:
+  route: /metrics
+listeners:
+  /shared-%d:
+    command: "true"
+`, idx))
+	}
+
+	// Configs sharing the address mount the admin and metrics routes once
+	s, err := NewServer(ServerOptions{ConfigFilenames: []string{first, second}})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, serveTestRequest(s, ":17068", "/metrics"))
+	require.Equal(t, http.StatusOK, serveTestRequest(s, ":17068", "/admin/reload?__qvApiKey=adminKey"))
+
+	// They cannot disagree on their config
+	writeTestServerConfig(t, second, `
+port: 17068
+metrics:
+  route: /metrics
+  auth:
+    - apiKeys: [ myKey ]
+listeners:
+  /shared-1:
+    command: "true"
+`)
+	_, err = NewServer(ServerOptions{ConfigFilenames: []string{first, second}})
+	require.Error(t, err)
+}
+
+func TestServerAdminAPI(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "config.yaml")
+	writeTestServerConfig(t, filename, `
+port: 17059
+admin:
+  route: /admin
+  auth:
+    - apiKeys: [ adminKey ]
+      queryAuth: true
+listeners:
+  /admin-test:
+    methods: [ GET ]
+    command: "true"
+    env:
+      MY_TOKEN: secret
+    redact:
+      env: [ "*_TOKEN" ]
+    storage:
+      conn: fs://`+dir+`/storage/
+      store: [ args ]
+    errorHandler:
+      command: "true"
+      env:
+        MY_TOKEN: nestedSecret
+`)
+
+	s, err := NewServer(ServerOptions{ConfigFilenames: []string{filename}})
+	require.NoError(t, err)
+
+	adminRequest := func(method string, path string, target interface{}) int {
+		separator := "?"
+		if strings.Contains(path, "?") {
+			separator = "&"
+		}
+		w := httptest.NewRecorder()
+		s.Handler(":17059").ServeHTTP(w, httptest.NewRequest(method, path+separator+"__qvApiKey=adminKey", nil))
+		if target != nil {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), target))
+		}
+		return w.Code
+	}
+
+	// The admin API always requires authentication
+	require.Equal(t, http.StatusUnauthorized, serveTestRequest(s, ":17059", "/admin/listeners"))
+
+	var listeners []*adminListenerInfo
+	require.Equal(t, http.StatusOK, adminRequest(http.MethodGet, "/admin/listeners", &listeners))
+	require.Len(t, listeners, 1)
+	require.Equal(t, ":17059_/admin-test_GET", listeners[0].Id)
+	require.Equal(t, []string{http.MethodGet}, listeners[0].Methods)
+	require.False(t, listeners[0].Disabled)
+	require.NotContains(t, fmt.Sprint(listeners[0].Config), "secret")
+	require.NotContains(t, fmt.Sprint(listeners[0].Config), "nestedSecret")
+
+	// Secrets are masked in nested configs too
+	nested := map[string]interface{}{
+		"ErrorHandler": map[string]interface{}{
+			"Database": map[string]interface{}{"Password": "dbSecret"},
+			"Storage":  map[string]interface{}{"Conn": "s3://bucket/?credential=connSecret"},
+		},
+	}
+	adminRedactConfigValue(newRedactor(nil, nil), nested)
+	require.NotContains(t, fmt.Sprint(nested), "dbSecret")
+	require.NotContains(t, fmt.Sprint(nested), "connSecret")
+
+	var storage []*adminStorageInfo
+	require.Equal(t, http.StatusOK, adminRequest(http.MethodGet, "/admin/storage", &storage))
+	require.Len(t, storage, 1)
+	require.True(t, storage[0].LastWrite.Success)
+
+	// Disabled listeners stay disabled across reloads
+	id := url.QueryEscape(listeners[0].Id)
+	require.Equal(t, http.StatusOK, adminRequest(http.MethodPost, "/admin/listeners/disable?id="+id, nil))
+	require.Equal(t, http.StatusServiceUnavailable, serveTestRequest(s, ":17059", "/admin-test"))
+	require.NoError(t, s.Reload())
+	require.Equal(t, http.StatusServiceUnavailable, serveTestRequest(s, ":17059", "/admin-test"))
+
+	require.Equal(t, http.StatusOK, adminRequest(http.MethodPost, "/admin/listeners/enable?id="+id, nil))
+	require.Equal(t, http.StatusOK, serveTestRequest(s, ":17059", "/admin-test"))
+
+	require.Equal(t, http.StatusNotFound, adminRequest(http.MethodPost, "/admin/listeners/enable?id=missing", nil))
+
+	// The admin API cannot be enabled without authentication
+	writeTestServerConfig(t, filename, `
+port: 17059
+admin:
+  route: /admin
+listeners:
+  /admin-test:
+    command: "true"
+`)
+	_, err = NewServer(ServerOptions{ConfigFilenames: []string{filename}})
+	require.ErrorContains(t, err, "Config.Admin.Auth")
+}
+
+func TestServerReadiness(t *testing.T) {
+	dir := t.TempDir()
+	storageDir := filepath.Join(dir, "storage")
+	filename := filepath.Join(dir, "config.yaml")
+	writeTestServerConfig(t, filename, `
+port: 17060
+listeners:
+  /readiness-test:
+    command: "true"
+    storage:
+      conn: fs://`+storageDir+`/
+      store: [ args ]
+`)
+
+	s, err := NewServer(ServerOptions{ConfigFilenames: []string{filename}})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, serveTestRequest(s, ":17060", "/readyz"))
+
+	// Readiness checks never write to the storage
+	entries, err := os.ReadDir(storageDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	// Storage backends which reject writes make the server not ready
+	require.NoError(t, os.RemoveAll(storageDir))
+	require.NoError(t, os.WriteFile(storageDir, nil, 0600))
+
+	report := s.Readiness(context.Background())
+	require.False(t, report.Ready)
+	require.Len(t, report.Components, 1)
+	require.Equal(t, readinessComponentStorage, report.Components[0].Type)
+	require.NotEmpty(t, report.Components[0].Error)
+	require.Equal(t, http.StatusServiceUnavailable, serveTestRequest(s, ":17060", "/readyz"))
+	require.Equal(t, http.StatusOK, serveTestRequest(s, ":17060", "/healthz"))
+}
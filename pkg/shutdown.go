@@ -0,0 +1,104 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// Keeps track of all running executions, including the ones not bound to
+// an HTTP request (e.g. scheduled tasks), so that we can drain them on shutdown.
+// The drained channel is closed whenever no execution is running, and replaced
+// when a new execution starts, so that waiting and starting new executions can
+// happen at the same time.
+var runningExecutionsLock sync.Mutex
+var runningExecutionsCount int64
+var runningExecutionsDrained = newClosedChannel()
+
+// Maps pid -> *exec.Cmd of all running commands
+var runningCommands = new(sync.Map)
+
+func newClosedChannel() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+func trackExecution() func() {
+	runningExecutionsLock.Lock()
+	if runningExecutionsCount == 0 {
+		runningExecutionsDrained = make(chan struct{})
+	}
+	runningExecutionsCount++
+	runningExecutionsLock.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			runningExecutionsLock.Lock()
+			defer runningExecutionsLock.Unlock()
+
+			runningExecutionsCount--
+			if runningExecutionsCount == 0 {
+				close(runningExecutionsDrained)
+			}
+		})
+	}
+}
+
+// RunningExecutionsCount returns how many listener executions are in progress
+func RunningExecutionsCount() int64 {
+	runningExecutionsLock.Lock()
+	defer runningExecutionsLock.Unlock()
+	return runningExecutionsCount
+}
+
+// WaitForExecutions waits for all running executions to complete. Returns
+// false if the context expired before that.
+func WaitForExecutions(ctx context.Context) bool {
+	for {
+		runningExecutionsLock.Lock()
+		drained := runningExecutionsDrained
+		runningExecutionsLock.Unlock()
+
+		select {
+		case <-drained:
+			// New executions may have started in the meantime, e.g. flushed by plugins
+			if RunningExecutionsCount() == 0 {
+				return true
+			}
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// SignalRunningCommands forwards the signal to the process groups of all running commands
+func SignalRunningCommands(sig os.Signal) {
+	runningCommands.Range(func(pid, _ interface{}) bool {
+		signalProcessGroup(pid.(int), sig)
+		return true
+	})
+}
+
+// runCommand works like cmd.CombinedOutput, but keeps track of the running
+// command, so that shutdown signals can be forwarded to it
+func runCommand(cmd *exec.Cmd) ([]byte, error) {
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	setCommandProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	pid := cmd.Process.Pid
+	runningCommands.Store(pid, cmd)
+	defer runningCommands.Delete(pid)
+
+	err := cmd.Wait()
+	return out.Bytes(), err
+}
@@ -0,0 +1,76 @@
+//go:build !windows
+
+package pkg
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdownDrainAndSignal(t *testing.T) {
+	done := make(chan error)
+	go func() {
+		defer trackExecution()()
+		// The child sleep process needs to be signaled too, via the process group
+		_, err := runCommand(exec.Command("sh", "-c", "sleep 30; echo done"))
+		done <- err
+	}()
+
+	require.Eventually(t, func() bool {
+		found := false
+		runningCommands.Range(func(_, _ interface{}) bool {
+			found = true
+			return false
+		})
+		return found
+	}, 5*time.Second, 10*time.Millisecond)
+	require.EqualValues(t, 1, RunningExecutionsCount())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.False(t, WaitForExecutions(ctx))
+
+	SignalRunningCommands(syscall.SIGTERM)
+
+	select {
+	case err := <-done:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("command was not signaled")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.True(t, WaitForExecutions(ctx))
+	require.EqualValues(t, 0, RunningExecutionsCount())
+}
+
+func TestShutdownExecutionsStartedWhileWaiting(t *testing.T) {
+	release := trackExecution()
+
+	waited := make(chan bool)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		waited <- WaitForExecutions(ctx)
+	}()
+
+	// e.g. executions flushed by plugins on shutdown
+	releaseFlushed := trackExecution()
+	release()
+
+	select {
+	case <-waited:
+		t.Fatal("stopped waiting while an execution was still running")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	releaseFlushed()
+	require.True(t, <-waited)
+	require.EqualValues(t, 0, RunningExecutionsCount())
+}
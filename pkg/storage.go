@@ -2,8 +2,11 @@ package pkg
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"qvalet/pkg/utils"
@@ -16,6 +19,7 @@ import (
 	"github.com/beyondstorage/go-storage/v4/services"
 	"github.com/beyondstorage/go-storage/v4/types"
 	"github.com/go-playground/validator/v10"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
 	_ "github.com/beyondstorage/go-service-azblob/v2"
@@ -97,6 +101,89 @@ func GetStoragerFromString(connectionString string) (types.Storager, error) {
 	return services.NewStoragerFromString(connectionString)
 }
 
+type StorageWriteStatus struct {
+	Time    time.Time `json:"time"`
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Maps storage conn -> *StorageWriteStatus of the last write, exposed via the admin API
+var storageWriteStatuses = new(sync.Map)
+
+func recordStorageWrite(conn string, err error) {
+	status := &StorageWriteStatus{
+		Time:    time.Now(),
+		Success: err == nil,
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	storageWriteStatuses.Store(conn, status)
+}
+
+func GetStorageWriteStatus(conn string) *StorageWriteStatus {
+	if status, found := storageWriteStatuses.Load(conn); found {
+		return status.(*StorageWriteStatus)
+	}
+	return nil
+}
+
+// Connection strings carry credentials in their query, e.g. `s3://bucket?credential=hmac:key:secret`
+func storageLogSafeConn(conn string) string {
+	if idx := strings.Index(conn, "?"); idx >= 0 {
+		return conn[:idx]
+	}
+	return conn
+}
+
+// Path checked by readiness probes, which never needs to exist
+const storageReadinessPath = "_qvalet_readiness"
+
+// checkStorageReachable is a cheap check, bounded by the context, which verifies
+// the storage backend responds, without writing anything
+func checkStorageReachable(ctx context.Context, storager types.Storager) error {
+	result := make(chan error, 1)
+	go func() {
+		_, err := storager.StatWithContext(ctx, storageReadinessPath)
+		if errors.Is(err, services.ErrObjectNotExist) {
+			err = nil
+		}
+		result <- err
+	}()
+
+	// Not all backends honor the context
+	select {
+	case err := <-result:
+		return errors.WithMessage(err, "failed to reach storage")
+	case <-ctx.Done():
+		return errors.WithMessage(ctx.Err(), "failed to reach storage")
+	}
+}
+
+// checkStorageWritable writes, and then removes, a small file
+func checkStorageWritable(storager types.Storager, conn string, route string, log logrus.FieldLogger) error {
+	routePrefix := regexListenerRouteCleaner.ReplaceAllString(route, "_")
+	nowNano := time.Now().UnixNano()
+	rand, _ := goutils.RandomAlphaNumeric(8)
+	p := fmt.Sprintf("%s-testwrite-%d-%s", routePrefix, nowNano, rand)
+
+	b := []byte(fmt.Sprintf("%d", nowNano))
+	_, err := storager.Write(p, bytes.NewBuffer(b), int64(len(b)))
+	recordStorageWrite(conn, err)
+	if err != nil {
+		return errors.WithMessage(err, "failed to check if storage is writable")
+	}
+
+	log.WithField("path", p).Debug("written check writable file")
+
+	// Clean up if possible
+	if err := storager.Delete(p); err != nil {
+		log.WithError(err).Debug("failed to remove check writable storage file")
+	}
+
+	return nil
+}
+
 type StorageEntry struct {
 	Path string `json:"path"`
 	Size int64  `json:"size"`
@@ -126,6 +213,9 @@ func storePayload(
 
 	var b []byte
 
+	// Every entry should already be redacted, but secrets may still be hiding anywhere in the payload
+	toStore = listener.redactor.Value(toStore).(map[string]interface{})
+
 	if listener.config.Storage.AsYAML {
 		_b, err := yaml.Marshal(toStore)
 		if err != nil {
@@ -142,7 +232,9 @@ func storePayload(
 
 	size := int64(len(b))
 	_, err := listener.storager.Write(path, bytes.NewBuffer(b), size)
+	recordStorageWrite(listener.config.Storage.Conn, err)
 	if err != nil {
+		metricsStorageWriteFailures.Inc(refRoute)
 		log.WithError(err).Error("failed to store payload")
 		return nil
 	}
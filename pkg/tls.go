@@ -0,0 +1,232 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	"qvalet/pkg/utils"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// How frequently certificate files are checked for changes
+const tlsReloadCheckInterval = 5 * time.Second
+
+const tlsDefaultMinVersion = "1.2"
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// @formatter:off
+/// [tls-docs]
+type TLSConfig struct {
+	// Path of the PEM-encoded certificate (chain).
+	// Certificates are reloaded whenever the files change, e.g. when rotated by cert-manager.
+	CertFile string `mapstructure:"certFile" validate:"required"`
+
+	// Path of the PEM-encoded private key
+	KeyFile string `mapstructure:"keyFile" validate:"required"`
+
+	// Minimum TLS version to accept, one of `1.0`, `1.1`, `1.2`, `1.3`.
+	// Defaults to [tlsDefaultMinVersion]
+	MinVersion string `mapstructure:"minVersion" validate:"omitempty,tlsVersion"`
+
+	// If provided, clients will need to present a certificate signed by
+	// one of the CAs in this PEM-encoded file
+	ClientCAFile string `mapstructure:"clientCAFile"`
+
+	// If true, client certificates will be verified only when provided
+	ClientCAOptional bool `mapstructure:"clientCAOptional"`
+}
+
+/// [tls-docs]
+// @formatter:on
+
+func init() {
+	if err := utils.Validate.RegisterValidation("tlsVersion", func(fl validator.FieldLevel) bool {
+		_, found := tlsVersions[fl.Field().String()]
+		return found
+	}); err != nil {
+		logrus.Fatal("failed to register tlsVersion validator")
+	}
+}
+
+// NewServerTLSConfig loads the certificates, and returns a TLS configuration
+// which keeps the certificates up-to-date with the files on disk
+func (config *TLSConfig) NewServerTLSConfig() (*tls.Config, error) {
+	reloader := &tlsCertReloader{config: config}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+
+	minVersion := config.MinVersion
+	if minVersion == "" {
+		minVersion = tlsDefaultMinVersion
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tlsVersions[minVersion],
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if config.ClientCAFile != "" {
+		// Client CAs can rotate too, so we provide a new config on every handshake
+		tlsConfig.GetConfigForClient = func(_ *tls.ClientHelloInfo) (*tls.Config, error) {
+			clientConfig := tlsConfig.Clone()
+			clientConfig.GetConfigForClient = nil
+			clientConfig.ClientCAs = reloader.getClientCAs()
+			clientConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			if config.ClientCAOptional {
+				clientConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return clientConfig, nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+type tlsCertReloader struct {
+	config *TLSConfig
+
+	lock        sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+
+	// Modification times of the files, to detect changes
+	modTimes  map[string]time.Time
+	lastCheck time.Time
+}
+
+func (r *tlsCertReloader) files() []string {
+	files := []string{r.config.CertFile, r.config.KeyFile}
+	if r.config.ClientCAFile != "" {
+		files = append(files, r.config.ClientCAFile)
+	}
+	return files
+}
+
+func (r *tlsCertReloader) getModTimes() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to stat file %s", file)
+		}
+		modTimes[file] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+func (r *tlsCertReloader) reload() error {
+	modTimes, err := r.getModTimes()
+	if err != nil {
+		return err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return errors.WithMessage(err, "failed to load TLS certificate")
+	}
+
+	var clientCAs *x509.CertPool
+	if r.config.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return errors.WithMessage(err, "failed to read client CA file")
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return errors.New("failed to parse client CA file")
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.certificate = &certificate
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	r.lastCheck = time.Now()
+
+	return nil
+}
+
+// checkReload reloads the certificates if any of the files changed. On failure,
+// the previous certificates are kept, so that a partially-written rotation
+// does not break the server.
+func (r *tlsCertReloader) checkReload() {
+	r.lock.RLock()
+	lastCheck := r.lastCheck
+	previousModTimes := r.modTimes
+	r.lock.RUnlock()
+
+	if time.Since(lastCheck) < tlsReloadCheckInterval {
+		return
+	}
+
+	log := logrus.WithField("certFile", r.config.CertFile)
+
+	modTimes, err := r.getModTimes()
+	if err == nil {
+		changed := false
+		for file, modTime := range modTimes {
+			if !modTime.Equal(previousModTimes[file]) {
+				changed = true
+				break
+			}
+		}
+
+		if !changed {
+			r.lock.Lock()
+			r.lastCheck = time.Now()
+			r.lock.Unlock()
+			return
+		}
+
+		err = r.reload()
+		if err == nil {
+			log.Info("reloaded TLS certificates")
+			return
+		}
+	}
+
+	r.lock.Lock()
+	r.lastCheck = time.Now()
+	r.lock.Unlock()
+	log.WithError(err).Error("failed to reload TLS certificates, keeping the previous ones")
+}
+
+func (r *tlsCertReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.checkReload()
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.certificate, nil
+}
+
+func (r *tlsCertReloader) getClientCAs() *x509.CertPool {
+	r.checkReload()
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.clientCAs
+}
+
+// GetTLSConfig returns the TLS config shared by configs listening on the same port, if any
+func GetTLSConfig(configs []*Config) *TLSConfig {
+	for _, config := range configs {
+		if config.TLS != nil {
+			return config.TLS
+		}
+	}
+	return nil
+}
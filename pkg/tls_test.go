@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestCertificate(t *testing.T, certFile string, keyFile string, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+}
+
+func getTestCertificateName(t *testing.T, reloader *tlsCertReloader) string {
+	certificate, err := reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+	require.NoError(t, err)
+	return parsed.Subject.CommonName
+}
+
+func TestTLSCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+
+	writeTestCertificate(t, certFile, keyFile, "first")
+
+	reloader := &tlsCertReloader{config: &TLSConfig{CertFile: certFile, KeyFile: keyFile}}
+	require.NoError(t, reloader.reload())
+	require.Equal(t, "first", getTestCertificateName(t, reloader))
+
+	// Rotate the certificate, and pretend the check interval elapsed
+	writeTestCertificate(t, certFile, keyFile, "second")
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+	require.NoError(t, os.Chtimes(keyFile, future, future))
+
+	// Changes are not checked before the interval elapsed
+	require.Equal(t, "first", getTestCertificateName(t, reloader))
+
+	reloader.lastCheck = time.Time{}
+	require.Equal(t, "second", getTestCertificateName(t, reloader))
+
+	// A broken rotation keeps the previous certificate
+	require.NoError(t, os.WriteFile(keyFile, []byte("broken"), 0600))
+	past := time.Now().Add(-time.Minute)
+	require.NoError(t, os.Chtimes(keyFile, past, past))
+	reloader.lastCheck = time.Time{}
+	require.Equal(t, "second", getTestCertificateName(t, reloader))
+}
+
+func TestNewServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeTestCertificate(t, certFile, keyFile, "test")
+
+	tlsConfig, err := (&TLSConfig{CertFile: certFile, KeyFile: keyFile}).NewServerTLSConfig()
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS12), tlsConfig.MinVersion)
+	require.Nil(t, tlsConfig.GetConfigForClient)
+
+	tlsConfig, err = (&TLSConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.3", ClientCAFile: certFile}).NewServerTLSConfig()
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS13), tlsConfig.MinVersion)
+
+	clientConfig, err := tlsConfig.GetConfigForClient(nil)
+	require.NoError(t, err)
+	require.Equal(t, tls.RequireAndVerifyClientCert, clientConfig.ClientAuth)
+	require.NotNil(t, clientConfig.ClientCAs)
+
+	_, err = (&TLSConfig{CertFile: "/nonexistent.crt", KeyFile: "/nonexistent.key"}).NewServerTLSConfig()
+	require.Error(t, err)
+}
@@ -1,8 +1,13 @@
 package pkg
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"unsafe"
+
+	"github.com/pkg/errors"
 )
 
 func SanitizeInterfaceToMapString(intf interface{}) interface{} {
@@ -32,6 +37,18 @@ func SanitizeInterfaceToMapString(intf interface{}) interface{} {
 	return intf
 }
 
+// configFingerprint identifies a config by its content, so that identical configs
+// are recognized across reloads. Secrets are hashed by their own JSON marshaller.
+func configFingerprint(config interface{}) (string, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to marshal config")
+	}
+
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
 func stringPtr(value string) *string {
 	return &value
 }
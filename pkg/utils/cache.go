@@ -5,53 +5,78 @@ import (
 	"time"
 )
 
+// How frequently expired entries are removed, even if never read again
+const cacheSweepInterval = 1 * time.Minute
+
 type Cache struct {
 	data   map[string]interface{}
 	expiry map[string]time.Time
 	lock   sync.RWMutex
 
+	// If greater than zero, the maximum number of entries. Once reached,
+	// expired entries are removed first, then arbitrary ones.
+	maxEntries int
+	lastSweep  time.Time
+	// If set, invoked for every entry removed because there are too many
+	evictHandler func(key string, value interface{})
+
 	// Utility lock for external handling of cache
 	sharedLock sync.Mutex
 }
 
 func NewCache() *Cache {
+	return NewCacheWithMaxEntries(0)
+}
+
+func NewCacheWithMaxEntries(maxEntries int) *Cache {
 	cache := Cache{}
 	cache.data = make(map[string]interface{})
 	cache.expiry = make(map[string]time.Time)
 	cache.lock = sync.RWMutex{}
 	cache.sharedLock = sync.Mutex{}
+	cache.maxEntries = maxEntries
+	cache.lastSweep = time.Now()
 	return &cache
 }
 
+// SetEvictHandler sets the function invoked, while holding the cache lock, for every
+// entry which is removed because the maximum number of entries has been reached
+func (cache *Cache) SetEvictHandler(handler func(key string, value interface{})) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.evictHandler = handler
+}
+
 func (cache *Cache) Get(key string) interface{} {
 	cache.lock.RLock()
-	defer cache.lock.RUnlock()
+	expiry, hasExpiry := cache.expiry[key]
+	cachedValue, exists := cache.data[key]
+	cache.lock.RUnlock()
+
+	if !exists {
+		return nil
+	}
 
-	if expiry, found := cache.expiry[key]; found {
-		if expiry.Before(time.Now()) {
+	if hasExpiry && expiry.Before(time.Now()) {
+		cache.lock.Lock()
+		// The entry may have been replaced in the meantime
+		if current, found := cache.expiry[key]; found && current.Equal(expiry) {
 			delete(cache.data, key)
 			delete(cache.expiry, key)
 		}
-	}
-
-	cachedValue, exists := cache.data[key]
-	if !exists {
+		cache.lock.Unlock()
 		return nil
 	}
+
 	return cachedValue
 }
 
 func (cache *Cache) Keys() []string {
-	cache.lock.RLock()
-	defer cache.lock.RUnlock()
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
 
-	now := time.Now()
-	for key, value := range cache.expiry {
-		if value.Before(now) {
-			delete(cache.data, key)
-			delete(cache.expiry, key)
-		}
-	}
+	cache.sweep(time.Now())
 
 	var keys []string
 
@@ -62,11 +87,20 @@ func (cache *Cache) Keys() []string {
 	return keys
 }
 
+func (cache *Cache) Len() int {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+
+	return len(cache.data)
+}
+
 func (cache *Cache) Set(key string, value interface{}) {
 	cache.lock.Lock()
 	defer cache.lock.Unlock()
 
 	cache.data[key] = value
+	delete(cache.expiry, key)
+	cache.afterSet(key, time.Now())
 }
 
 func (cache *Cache) SetWithExpiry(key string, value interface{}, t time.Time) {
@@ -75,14 +109,17 @@ func (cache *Cache) SetWithExpiry(key string, value interface{}, t time.Time) {
 
 	cache.data[key] = value
 	cache.expiry[key] = t
+	cache.afterSet(key, time.Now())
 }
 
 func (cache *Cache) SetWithDuration(key string, value interface{}, d time.Duration) {
 	cache.lock.Lock()
 	defer cache.lock.Unlock()
 
+	now := time.Now()
 	cache.data[key] = value
-	cache.expiry[key] = time.Now().Add(d)
+	cache.expiry[key] = now.Add(d)
+	cache.afterSet(key, now)
 }
 
 func (cache *Cache) Delete(key string) {
@@ -101,6 +138,43 @@ func (cache *Cache) DeleteAll() {
 	cache.expiry = make(map[string]time.Time)
 }
 
+// afterSet keeps the cache bounded, removing expired entries periodically, and
+// arbitrary ones if there are too many. Must be called while holding the write lock.
+func (cache *Cache) afterSet(key string, now time.Time) {
+	tooMany := cache.maxEntries > 0 && len(cache.data) > cache.maxEntries
+	if tooMany || now.Sub(cache.lastSweep) >= cacheSweepInterval {
+		cache.sweep(now)
+	}
+
+	if cache.maxEntries <= 0 {
+		return
+	}
+	for k := range cache.data {
+		if len(cache.data) <= cache.maxEntries {
+			break
+		}
+		if k == key {
+			continue
+		}
+		if cache.evictHandler != nil {
+			cache.evictHandler(k, cache.data[k])
+		}
+		delete(cache.data, k)
+		delete(cache.expiry, k)
+	}
+}
+
+// sweep removes all expired entries. Must be called while holding the write lock.
+func (cache *Cache) sweep(now time.Time) {
+	cache.lastSweep = now
+	for key, value := range cache.expiry {
+		if value.Before(now) {
+			delete(cache.data, key)
+			delete(cache.expiry, key)
+		}
+	}
+}
+
 func (cache *Cache) Lock() {
 	cache.sharedLock.Lock()
 }
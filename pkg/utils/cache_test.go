@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheSweepsExpiredEntries(t *testing.T) {
+	cache := NewCache()
+	cache.SetWithExpiry("expired", true, time.Now().Add(-time.Second))
+	cache.SetWithDuration("valid", true, time.Hour)
+	require.Equal(t, 2, cache.Len())
+
+	// Expired entries are removed periodically, even if never read again
+	cache.lastSweep = time.Now().Add(-cacheSweepInterval)
+	cache.Set("other", true)
+	require.Equal(t, 2, cache.Len())
+	require.Nil(t, cache.Get("expired"))
+	require.NotNil(t, cache.Get("valid"))
+}
+
+func TestCacheMaxEntries(t *testing.T) {
+	cache := NewCacheWithMaxEntries(10)
+	for i := 0; i < 100; i++ {
+		cache.SetWithDuration(strconv.Itoa(i), i, time.Hour)
+		require.LessOrEqual(t, cache.Len(), 10)
+	}
+
+	// The latest entry is always kept
+	require.Equal(t, 99, cache.Get("99"))
+
+	// Evicted entries are notified
+	var evicted []interface{}
+	cache.SetEvictHandler(func(_ string, value interface{}) {
+		evicted = append(evicted, value)
+	})
+	cache.Set("100", 100)
+	require.Len(t, evicted, 1)
+	require.NotEqual(t, 100, evicted[0])
+}
@@ -3,14 +3,19 @@ package utils
 import (
 	"fmt"
 	"net/http"
+	"regexp"
 	"time"
 
+	"github.com/Masterminds/goutils"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 )
 
 const (
 	GinContextDoNotLogEntry string = "GinContextDoNotLogEntry"
+	GinContextRequestId     string = "GinContextRequestId"
+
+	HeaderRequestId = "X-Request-Id"
 )
 
 type RequestError struct {
@@ -61,6 +66,23 @@ func WrapRequest(fn WrappedRequestFn) gin.HandlerFunc {
 	}
 }
 
+var regexValidRequestId = regexp.MustCompile(`^[\w\-.:]{1,128}$`)
+
+// GetGinRequestIdHandler reuses the request id provided by upstream proxies, or
+// generates a new one, so that all log lines of a request can be correlated
+func GetGinRequestIdHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestId := c.GetHeader(HeaderRequestId)
+		if !regexValidRequestId.MatchString(requestId) {
+			requestId, _ = goutils.RandomAlphaNumeric(16)
+		}
+
+		c.Set(GinContextRequestId, requestId)
+		c.Header(HeaderRequestId, requestId)
+		c.Next()
+	}
+}
+
 func GetGinLoggerHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
 
@@ -98,6 +120,7 @@ func GetGinLoggerHandler() gin.HandlerFunc {
 			"method":     method,
 			"comment":    comment,
 			"userAgent":  userAgent,
+			"requestId":  c.GetString(GinContextRequestId),
 		}).Info(fmt.Sprintf("[GIN] %3d | %13vms | %s %-7s | %s",
 			statusCode,
 			elapsedMS,
@@ -1,9 +1,7 @@
 package utils
 
 import (
-	"os"
 	"reflect"
-	"regexp"
 
 	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
@@ -35,28 +33,6 @@ func DecodeStructJSONToMap(input interface{}, output interface{}) error {
 	return nil
 }
 
-var stringFromEnvVarRegex = regexp.MustCompile(`^ENV{(\w+)}$`)
-
-type StringFromEnvVar struct {
-	wrapped string
-}
-
-func (s *StringFromEnvVar) Value() string {
-	return s.wrapped
-}
-
-func NewStringFromEnvVar(value string) *StringFromEnvVar {
-	if match := stringFromEnvVarRegex.FindStringSubmatch(value); match != nil {
-		return &StringFromEnvVar{
-			wrapped: os.Getenv(match[1]),
-		}
-	}
-
-	return &StringFromEnvVar{
-		wrapped: value,
-	}
-}
-
 func StringToStringFromEnvVarHookFunc() mapstructure.DecodeHookFunc {
 	return func(
 		f reflect.Type,
@@ -14,7 +14,7 @@ import (
 
 const (
 	payloadKeyArrayLength       = "__qvPayloadArrayLength"
-	keyArgsRequestKey           = "__qvRequest"
+	KeyArgsRequestKey           = "__qvRequest"
 	defaultFormMultipartMaxSize = 64 * 1024 * 1024
 )
 
@@ -33,6 +33,9 @@ type QVRequest struct {
 
 	// The guessed address of the client, e.g. `127.0.0.1:1234`
 	RemoteAddr string `json:"remoteAddr"`
+
+	// The client IP, which takes into account the trusted proxies headers, e.g. `127.0.0.1`
+	ClientIP string `json:"clientIP"`
 }
 
 /// [qv-request]
@@ -58,9 +61,10 @@ func ExtractArgsFromGinContext(c *gin.Context) (map[string]interface{}, error) {
 			c.Request.Host,
 			c.Request.Method,
 			c.Request.RemoteAddr,
+			c.ClientIP(),
 		}
 
-		args[keyArgsRequestKey] = qvRequest
+		args[KeyArgsRequestKey] = qvRequest
 	}
 
 	if c.Request.ContentLength > 0 {
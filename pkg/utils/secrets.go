@@ -0,0 +1,367 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	SecretResolverEnv       = "ENV"
+	SecretResolverFile      = "FILE"
+	SecretResolverEncrypted = "SECRET"
+
+	// Env var containing the path of the encrypted secrets file
+	EnvSecretsFile = "QV_SECRETS_FILE"
+	// Env var containing the base64-encoded 256-bit key used to decrypt the secrets file
+	EnvSecretsKey = "QV_SECRETS_KEY"
+)
+
+// A SecretResolver loads secrets from a specific source. Secrets are referenced
+// in the configuration with the `PREFIX{ref}` syntax, e.g. `FILE{/run/secrets/token}`.
+type SecretResolver interface {
+	// Returns the current value of the secret identified by ref.
+	// Invoked every time the secret is needed, so implementations
+	// should cache values where possible.
+	Resolve(ref string) (string, error)
+}
+
+var secretResolversLock sync.RWMutex
+var secretResolvers = map[string]SecretResolver{
+	SecretResolverEnv:       &envSecretResolver{},
+	SecretResolverFile:      &fileSecretResolver{cache: make(map[string]*fileSecretCacheEntry)},
+	SecretResolverEncrypted: &encryptedSecretResolver{file: &fileSecretResolver{cache: make(map[string]*fileSecretCacheEntry)}},
+}
+
+// Matches only the references to the registered resolvers, e.g. `^(ENV|FILE|SECRET){(.+)}$`,
+// so that other values which happen to look like references are kept as they are
+var stringFromEnvVarRegex = buildStringFromEnvVarRegex()
+
+// RegisterSecretResolver makes a new secret source available under the given prefix.
+// NOTE: resolvers need to be registered before the configuration is loaded.
+func RegisterSecretResolver(prefix string, resolver SecretResolver) {
+	secretResolversLock.Lock()
+	defer secretResolversLock.Unlock()
+	secretResolvers[prefix] = resolver
+	stringFromEnvVarRegex = buildStringFromEnvVarRegex()
+}
+
+// Must be called while holding the resolvers lock, or on initialization
+func buildStringFromEnvVarRegex() *regexp.Regexp {
+	var prefixes []string
+	for prefix := range secretResolvers {
+		prefixes = append(prefixes, regexp.QuoteMeta(prefix))
+	}
+	sort.Strings(prefixes)
+	return regexp.MustCompile(`^(` + strings.Join(prefixes, "|") + `){(.+)}$`)
+}
+
+func getSecretResolver(prefix string) SecretResolver {
+	secretResolversLock.RLock()
+	defer secretResolversLock.RUnlock()
+	return secretResolvers[prefix]
+}
+
+func matchSecretReference(value string) []string {
+	secretResolversLock.RLock()
+	defer secretResolversLock.RUnlock()
+	return stringFromEnvVarRegex.FindStringSubmatch(value)
+}
+
+// StringFromEnvVar is a configuration string which can either be a plain value,
+// or a reference to a secret, e.g. `ENV{MY_PASSWORD}` or `FILE{/path/to/secret}`.
+// Secrets are resolved lazily, every time Value is invoked, so rotated secrets
+// are picked up without having to restart qValet.
+type StringFromEnvVar struct {
+	wrapped string
+
+	resolverPrefix string
+	resolver       SecretResolver
+}
+
+func (s *StringFromEnvVar) Value() string {
+	if s.resolver == nil {
+		return s.wrapped
+	}
+
+	value, err := s.resolver.Resolve(s.wrapped)
+	if err != nil {
+		// NOTE: do not log the secret reference itself, it may be sensitive too
+		logrus.WithField("resolver", s.resolverPrefix).WithError(err).Error("failed to resolve secret")
+		return ""
+	}
+	return value
+}
+
+// Random key of the HMAC used to marshal secrets, different for every process, so that
+// the marshalled plain values, e.g. shown by the admin API, cannot be brute-forced offline
+var stringFromEnvVarHashKey = newStringFromEnvVarHashKey()
+
+func newStringFromEnvVarHashKey() []byte {
+	key := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		panic(errors.WithMessage(err, "failed to generate secrets hash key"))
+	}
+	return key
+}
+
+// MarshalJSON never exposes the secret or its reference, but keeps
+// marshalled configs comparable within the process, e.g. to detect
+// changes on reload
+func (s *StringFromEnvVar) MarshalJSON() ([]byte, error) {
+	mac := hmac.New(sha256.New, stringFromEnvVarHashKey)
+	mac.Write([]byte(s.resolverPrefix + "{" + s.wrapped + "}"))
+	return json.Marshal("hmac-sha256:" + hex.EncodeToString(mac.Sum(nil)))
+}
+
+func NewStringFromEnvVar(value string) *StringFromEnvVar {
+	if match := matchSecretReference(value); match != nil {
+		if resolver := getSecretResolver(match[1]); resolver != nil {
+			return &StringFromEnvVar{
+				wrapped:        match[2],
+				resolverPrefix: match[1],
+				resolver:       resolver,
+			}
+		}
+	}
+
+	return &StringFromEnvVar{
+		wrapped: value,
+	}
+}
+
+// --- ENV{NAME}
+
+type envSecretResolver struct{}
+
+func (r *envSecretResolver) Resolve(ref string) (string, error) {
+	return os.Getenv(ref), nil
+}
+
+// --- FILE{/path}
+
+type fileSecretCacheEntry struct {
+	modTime time.Time
+	size    int64
+	content []byte
+}
+
+// fileSecretResolver reads secrets from files, and re-reads them only when
+// they change, e.g. when Kubernetes rotates a mounted secret
+type fileSecretResolver struct {
+	lock  sync.Mutex
+	cache map[string]*fileSecretCacheEntry
+}
+
+func (r *fileSecretResolver) read(path string) ([]byte, error) {
+	entry, err := r.readEntry(path)
+	if err != nil {
+		return nil, err
+	}
+	return entry.content, nil
+}
+
+// readEntry returns the cached entry of the file, which is replaced only when the file changes
+func (r *fileSecretResolver) readEntry(path string) (*fileSecretCacheEntry, error) {
+	// NOTE: Stat follows symlinks, which is how Kubernetes swaps mounted secrets
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to stat secret file")
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if entry, found := r.cache[path]; found && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return entry, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to read secret file")
+	}
+
+	entry := &fileSecretCacheEntry{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		content: content,
+	}
+	r.cache[path] = entry
+
+	return entry, nil
+}
+
+func (r *fileSecretResolver) Resolve(ref string) (string, error) {
+	content, err := r.read(ref)
+	if err != nil {
+		return "", err
+	}
+
+	// Files often end with a new line, which is never part of the secret
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// --- SECRET{name}
+
+// encryptedSecretResolver loads secrets from a local YAML file, where every
+// value is encrypted with AES-256-GCM, e.g.
+//
+// myApiKey: <base64(nonce + ciphertext)>
+//
+// The file path and key are read from the [EnvSecretsFile] and [EnvSecretsKey] env vars.
+// The file is decrypted only once, and again only when the file or the key change.
+type encryptedSecretResolver struct {
+	file *fileSecretResolver
+
+	lock sync.Mutex
+	// The file entry and key which the decrypted secrets belong to
+	decryptedEntry *fileSecretCacheEntry
+	decryptedKey   string
+	decrypted      map[string]string
+}
+
+func (r *encryptedSecretResolver) Resolve(ref string) (string, error) {
+	path := os.Getenv(EnvSecretsFile)
+	if path == "" {
+		return "", errors.Errorf("no secrets file defined, please set %s", EnvSecretsFile)
+	}
+
+	entry, err := r.file.readEntry(path)
+	if err != nil {
+		return "", err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if entry != r.decryptedEntry || os.Getenv(EnvSecretsKey) != r.decryptedKey {
+		if err := r.decrypt(entry); err != nil {
+			return "", err
+		}
+	}
+
+	value, found := r.decrypted[ref]
+	if !found {
+		return "", errors.Errorf("secret %s not found", ref)
+	}
+	return value, nil
+}
+
+// decrypt decrypts all the secrets of the file. Must be called while holding the lock.
+func (r *encryptedSecretResolver) decrypt(entry *fileSecretCacheEntry) error {
+	keyStr := os.Getenv(EnvSecretsKey)
+	key, err := getSecretsKey()
+	if err != nil {
+		return err
+	}
+
+	secrets := make(map[string]string)
+	if err := yaml.Unmarshal(entry.content, &secrets); err != nil {
+		return errors.WithMessage(err, "failed to parse secrets file")
+	}
+
+	decrypted := make(map[string]string, len(secrets))
+	for name, encrypted := range secrets {
+		value, err := DecryptSecret(key, encrypted)
+		if err != nil {
+			return errors.WithMessagef(err, "failed to decrypt secret %s", name)
+		}
+		decrypted[name] = value
+	}
+
+	r.decryptedEntry = entry
+	r.decryptedKey = keyStr
+	r.decrypted = decrypted
+	return nil
+}
+
+func getSecretsKey() ([]byte, error) {
+	keyStr := os.Getenv(EnvSecretsKey)
+	if keyStr == "" {
+		return nil, errors.Errorf("no secrets key defined, please set %s", EnvSecretsKey)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(keyStr)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to decode secrets key")
+	}
+
+	if len(key) != 32 {
+		return nil, errors.New("secrets key must be 32 bytes long")
+	}
+
+	return key, nil
+}
+
+func newSecretsGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to initialize secrets cipher")
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptSecretWithEnvKey encrypts a value using the key provided in the [EnvSecretsKey] env var,
+// so that it can be stored in the secrets file
+func EncryptSecretWithEnvKey(value string) (string, error) {
+	key, err := getSecretsKey()
+	if err != nil {
+		return "", err
+	}
+	return EncryptSecret(key, value)
+}
+
+func EncryptSecret(key []byte, value string) (string, error) {
+	gcm, err := newSecretsGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", errors.WithMessage(err, "failed to generate nonce")
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(value), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func DecryptSecret(key []byte, encrypted string) (string, error) {
+	gcm, err := newSecretsGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encrypted))
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to decode secret")
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("invalid encrypted secret")
+	}
+
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to decrypt secret")
+	}
+
+	return string(plain), nil
+}
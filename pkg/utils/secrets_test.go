@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStringFromEnvVar(t *testing.T) {
+	t.Setenv("QV_TEST_SECRET", "fromEnv")
+
+	require.Equal(t, "plain", NewStringFromEnvVar("plain").Value())
+	require.Equal(t, "fromEnv", NewStringFromEnvVar("ENV{QV_TEST_SECRET}").Value())
+
+	// Unknown resolvers are treated as plain values
+	require.Equal(t, "UNKNOWN{hello}", NewStringFromEnvVar("UNKNOWN{hello}").Value())
+	require.Equal(t, "XENV{QV_TEST_SECRET}", NewStringFromEnvVar("XENV{QV_TEST_SECRET}").Value())
+
+	// Env vars are resolved lazily
+	secret := NewStringFromEnvVar("ENV{QV_TEST_SECRET}")
+	t.Setenv("QV_TEST_SECRET", "rotated")
+	require.Equal(t, "rotated", secret.Value())
+
+	// Marshalled values are comparable, but never expose the value or its plain hash
+	marshalled, err := json.Marshal(NewStringFromEnvVar("plain"))
+	require.NoError(t, err)
+	again, err := json.Marshal(NewStringFromEnvVar("plain"))
+	require.NoError(t, err)
+	require.Equal(t, string(marshalled), string(again))
+	plainHash := sha256.Sum256([]byte("{plain}"))
+	require.NotContains(t, string(marshalled), "plain")
+	require.NotContains(t, string(marshalled), hex.EncodeToString(plainHash[:]))
+}
+
+func TestStringFromEnvVarFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(path, []byte("first\n"), 0600))
+
+	secret := NewStringFromEnvVar(fmt.Sprintf("FILE{%s}", path))
+	require.Equal(t, "first", secret.Value())
+
+	// Rotate the secret
+	require.NoError(t, os.WriteFile(path, []byte("second-value\n"), 0600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+	require.Equal(t, "second-value", secret.Value())
+
+	// Missing files resolve to an empty value
+	require.Equal(t, "", NewStringFromEnvVar("FILE{/non/existing/file}").Value())
+}
+
+func TestStringFromEnvVarEncrypted(t *testing.T) {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	t.Setenv(EnvSecretsKey, base64.StdEncoding.EncodeToString(key))
+
+	encrypted, err := EncryptSecretWithEnvKey("mySecret")
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "secrets.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf("apiKey: %s\n", encrypted)), 0600))
+	t.Setenv(EnvSecretsFile, path)
+
+	require.Equal(t, "mySecret", NewStringFromEnvVar("SECRET{apiKey}").Value())
+	require.Equal(t, "", NewStringFromEnvVar("SECRET{missing}").Value())
+
+	// The file is decrypted only once
+	resolver := getSecretResolver(SecretResolverEncrypted).(*encryptedSecretResolver)
+	decrypted := reflect.ValueOf(resolver.decrypted).Pointer()
+	require.Equal(t, "mySecret", NewStringFromEnvVar("SECRET{apiKey}").Value())
+	require.Equal(t, decrypted, reflect.ValueOf(resolver.decrypted).Pointer())
+
+	// Wrong keys cannot decrypt the secret
+	_, err = DecryptSecret(make([]byte, 32), encrypted)
+	require.Error(t, err)
+}
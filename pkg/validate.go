@@ -0,0 +1,372 @@
+package pkg
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"qvalet/pkg/utils"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type ValidateOptions struct {
+	// Configuration files to validate
+	ConfigFilenames []string
+
+	// Optional defaults configuration file
+	DefaultsFilename string
+
+	// If true, also check that storage backends are writable and databases reachable
+	Connect bool
+}
+
+const (
+	// The configuration cannot be used
+	ValidationSeverityError = "error"
+	// The configuration can be loaded, but likely does not work as intended
+	ValidationSeverityWarning = "warning"
+)
+
+// ValidationProblem describes a single issue found in a config file
+type ValidationProblem struct {
+	// Either [ValidationSeverityError] or [ValidationSeverityWarning]
+	Severity string `json:"severity"`
+	File     string `json:"file"`
+	// Route of the listener the problem refers to, if any
+	Route string `json:"route,omitempty"`
+	// Path of the config field, e.g. `plugins[0].schedule.id`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+func (p *ValidationProblem) String() string {
+	location := p.File
+	if p.Route != "" {
+		location += fmt.Sprintf(" [%s]", p.Route)
+	}
+	if p.Field != "" {
+		location += " " + p.Field
+	}
+	return fmt.Sprintf("%s: %s: %s", location, p.Severity, p.Message)
+}
+
+// IsError returns true if the problem makes the configuration unusable
+func (p *ValidationProblem) IsError() bool {
+	return p.Severity != ValidationSeverityWarning
+}
+
+// CountValidationErrors returns how many problems are errors, as opposed to warnings
+func CountValidationErrors(problems []*ValidationProblem) int {
+	count := 0
+	for _, problem := range problems {
+		if problem.IsError() {
+			count++
+		}
+	}
+	return count
+}
+
+// Matches mapstructure decoding errors, e.g. `error decoding 'listeners[/hello].command': ...`
+var regexValidateDecodingKey = regexp.MustCompile(`'([^']+)'`)
+var regexValidateListenerKey = regexp.MustCompile(`^listeners\[(.+?)]\.?(.*)$`)
+
+type configValidator struct {
+	options  ValidateOptions
+	problems []*ValidationProblem
+}
+
+// ValidateConfigs checks the configuration files, without binding any port or
+// connecting to any database (unless required by the options), and returns all
+// the problems found
+func ValidateConfigs(options ValidateOptions) []*ValidationProblem {
+	v := &configValidator{options: options}
+
+	var defaults *ListenerConfig
+	if options.DefaultsFilename != "" {
+		var err error
+		defaults, err = LoadDefaults(options.DefaultsFilename)
+		if err != nil {
+			v.addDecodingError(options.DefaultsFilename, err)
+			return v.problems
+		}
+		if err := utils.Validate.Struct(defaults); err != nil {
+			v.addValidationError(options.DefaultsFilename, "", "", reflect.TypeOf(ListenerConfig{}), err)
+		}
+	}
+
+	var configs []*Config
+	configFilenames := make(map[*Config]string)
+	for _, filename := range options.ConfigFilenames {
+		config, ok := v.validateConfig(filename, defaults)
+		if ok {
+			configs = append(configs, config)
+			configFilenames[config] = filename
+		}
+	}
+
+	v.validateRoutes(configs, configFilenames)
+
+	if options.Connect {
+		v.validateConnections(configs, configFilenames)
+	}
+
+	return v.problems
+}
+
+func (v *configValidator) add(file string, route string, field string, message string) {
+	v.addWithSeverity(ValidationSeverityError, file, route, field, message)
+}
+
+func (v *configValidator) addWithSeverity(severity string, file string, route string, field string, message string) {
+	v.problems = append(v.problems, &ValidationProblem{
+		Severity: severity,
+		File:     file,
+		Route:    route,
+		Field:    field,
+		Message:  message,
+	})
+}
+
+// Reports every decoding error separately, with the listener route and field if possible
+func (v *configValidator) addDecodingError(file string, err error) {
+	decodingErr, ok := errors.Cause(err).(*mapstructure.Error)
+	if !ok {
+		v.add(file, "", "", err.Error())
+		return
+	}
+
+	for _, message := range decodingErr.Errors {
+		route := ""
+		field := ""
+		if match := regexValidateDecodingKey.FindStringSubmatch(message); match != nil {
+			field = match[1]
+			if match := regexValidateListenerKey.FindStringSubmatch(field); match != nil {
+				route = match[1]
+				field = match[2]
+			}
+		}
+		v.add(file, route, field, message)
+	}
+}
+
+// Reports every field validation error separately, using the config keys as field paths
+func (v *configValidator) addValidationError(file string, route string, fieldPrefix string, root reflect.Type, err error) {
+	validationErrs, ok := errors.Cause(err).(validator.ValidationErrors)
+	if !ok {
+		v.add(file, route, strings.TrimSuffix(fieldPrefix, "."), err.Error())
+		return
+	}
+
+	for _, fieldErr := range validationErrs {
+		message := fmt.Sprintf("failed on the '%s' validation", fieldErr.Tag())
+		if fieldErr.Param() != "" {
+			message = fmt.Sprintf("failed on the '%s=%s' validation", fieldErr.Tag(), fieldErr.Param())
+		}
+		v.add(file, route, fieldPrefix+validationFieldPath(root, fieldErr.StructNamespace()), message)
+	}
+}
+
+func (v *configValidator) validateConfig(filename string, defaults *ListenerConfig) (*Config, bool) {
+	config, err := LoadConfig(filename)
+	if err != nil {
+		v.addDecodingError(filename, err)
+		return nil, false
+	}
+
+	if defaults != nil {
+		newDefaults, err := MergeListenerConfig(defaults, &config.Defaults)
+		if err != nil {
+			v.add(filename, "", "defaults", errors.WithMessage(err, "failed to merge defaults config").Error())
+			return nil, false
+		}
+		config.Defaults = *newDefaults
+	}
+
+	ok := true
+	if err := utils.Validate.Struct(config); err != nil {
+		v.addValidationError(filename, "", "", reflect.TypeOf(Config{}), err)
+		ok = false
+	}
+
+	var routes []string
+	for route := range config.Listeners {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	var allPlugins []PluginInterface
+	for _, route := range routes {
+		// Listeners may come from included files
+		listener, valid := v.validateListener(config.listenerFile(route), route, "", &config.Defaults, config.Listeners[route])
+		if !valid {
+			ok = false
+			continue
+		}
+		allPlugins = append(allPlugins, listener.plugins...)
+	}
+
+	// Same checks as the ones performed when starting plugins, e.g. duplicate schedule ids
+	for _, plugin := range allPlugins {
+		if plugin, ok := plugin.(PluginConfigValidateCheckOtherPlugins); ok {
+			var otherPlugins []PluginInterface
+			for _, other := range allPlugins {
+				if other != plugin {
+					otherPlugins = append(otherPlugins, other)
+				}
+			}
+			if err := plugin.ValidateCheckOtherPlugins(otherPlugins); err != nil {
+				v.add(filename, "", "", errors.WithMessage(err, "failed to validate plugin against other plugins").Error())
+				ok = false
+			}
+		}
+	}
+
+	return config, ok
+}
+
+func (v *configValidator) validateListener(
+	filename string,
+	route string,
+	fieldPrefix string,
+	defaults *ListenerConfig,
+	listenerConfig *ListenerConfig,
+) (*CompiledListener, bool) {
+	merged, err := MergeListenerConfig(defaults, listenerConfig)
+	if err != nil {
+		v.add(filename, route, strings.TrimSuffix(fieldPrefix, "."), errors.WithMessage(err, "failed to merge listener config").Error())
+		return nil, false
+	}
+
+	ok := true
+	if err := utils.Validate.Struct(merged); err != nil {
+		v.addValidationError(filename, route, fieldPrefix, reflect.TypeOf(ListenerConfig{}), err)
+		ok = false
+	}
+
+	// Error handlers are not validated together with their listener
+	if merged.ErrorHandler != nil {
+		if _, valid := v.validateListener(filename, route, fieldPrefix+"errorHandler.", defaults, merged.ErrorHandler); !valid {
+			ok = false
+		}
+	}
+
+	if !ok || fieldPrefix != "" {
+		return nil, ok
+	}
+
+	// Catches everything else, e.g. plugins which cannot be initialized
+	listener, err := compileListener(defaults, listenerConfig, route, false, nil, true)
+	if err != nil {
+		v.add(filename, route, "", err.Error())
+		return nil, false
+	}
+
+	return listener, true
+}
+
+// Route conflicts across files make gin panic when mounting, so they are reported as
+// warnings, together with the files defining the conflicting listeners
+func (v *configValidator) validateRoutes(configs []*Config, configFilenames map[*Config]string) {
+	configsByAddress, err := groupConfigsByAddress(configs...)
+	if err != nil {
+		for _, config := range configs {
+			v.add(configFilenames[config], "", "", err.Error())
+		}
+		return
+	}
+
+	for _, conflict := range findRouteConflicts(configsByAddress) {
+		v.addWithSeverity(ValidationSeverityWarning, conflict.File, conflict.Route, "", conflict.Error())
+	}
+}
+
+func (v *configValidator) validateConnections(configs []*Config, configFilenames map[*Config]string) {
+	defer CloseAllDBConnections()
+
+	for _, config := range configs {
+		filename := configFilenames[config]
+
+		var routes []string
+		for route := range config.Listeners {
+			routes = append(routes, route)
+		}
+		sort.Strings(routes)
+
+		for _, route := range routes {
+			listenerConfig, err := MergeListenerConfig(&config.Defaults, config.Listeners[route])
+			if err != nil {
+				continue
+			}
+
+			if listenerConfig.Storage != nil {
+				storager, err := GetStoragerFromString(listenerConfig.Storage.Conn)
+				if err == nil {
+					err = checkStorageWritable(storager, listenerConfig.Storage.Conn, route, logrus.WithField(logFieldListener, route))
+				}
+				if err != nil {
+					v.add(filename, route, "storage", err.Error())
+				}
+			}
+
+			if listenerConfig.Database != nil {
+				if _, err := NewDB(listenerConfig.Database); err != nil {
+					v.add(filename, route, "database", err.Error())
+				}
+			}
+		}
+	}
+}
+
+// Converts the struct namespace of a validation error, e.g. `ListenerConfig.Plugins[0].Schedule.Id`,
+// into the path of the config keys, e.g. `plugins[0].schedule.id`
+func validationFieldPath(root reflect.Type, structNamespace string) string {
+	segments := strings.Split(structNamespace, ".")
+	// The first segment is the root type
+	if len(segments) > 0 {
+		segments = segments[1:]
+	}
+
+	current := root
+	var path []string
+	for _, segment := range segments {
+		name := segment
+		index := ""
+		if idx := strings.Index(segment, "["); idx >= 0 {
+			name = segment[:idx]
+			index = segment[idx:]
+		}
+
+		for current.Kind() == reflect.Ptr {
+			current = current.Elem()
+		}
+
+		key := name
+		if current.Kind() == reflect.Struct {
+			if field, found := current.FieldByName(name); found {
+				if tag := strings.Split(field.Tag.Get("mapstructure"), ",")[0]; tag != "" {
+					key = tag
+				}
+				current = field.Type
+				// Follow the elements of slices and maps, which are referenced by index
+				for index != "" && (current.Kind() == reflect.Ptr || current.Kind() == reflect.Slice || current.Kind() == reflect.Map) {
+					if current.Kind() == reflect.Ptr {
+						current = current.Elem()
+						continue
+					}
+					current = current.Elem()
+					break
+				}
+			}
+		}
+
+		path = append(path, key+index)
+	}
+
+	return strings.Join(path, ".")
+}
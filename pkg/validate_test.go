@@ -0,0 +1,120 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestValidateConfig(t *testing.T, dir string, name string, content string) string {
+	filename := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(filename, []byte(content), 0600))
+	return filename
+}
+
+func TestValidateConfigs(t *testing.T) {
+	dir := t.TempDir()
+
+	valid := writeTestValidateConfig(t, dir, "valid.yaml", `
+listeners:
+  /hello:
+    command: echo hello
+`)
+	require.Empty(t, ValidateConfigs(ValidateOptions{ConfigFilenames: []string{valid}}))
+
+	invalid := writeTestValidateConfig(t, dir, "invalid.yaml", `
+port: 7056
+listeners:
+  /template:
+    command: "{{ .name "
+  /methods:
+    command: "true"
+    methods: [ WRONG ]
+  /error-handler:
+    command: "true"
+    errorHandler:
+      command: "true"
+      plugins:
+        - schedule: {}
+`)
+	problems := ValidateConfigs(ValidateOptions{ConfigFilenames: []string{invalid}})
+	require.Len(t, problems, 1)
+	require.Equal(t, ValidationSeverityError, problems[0].Severity)
+	require.Equal(t, invalid, problems[0].File)
+	require.Equal(t, "/template", problems[0].Route)
+	require.Equal(t, "command", problems[0].Field)
+
+	invalid = writeTestValidateConfig(t, dir, "invalid.yaml", `
+port: 7056
+listeners:
+  /methods:
+    command: "true"
+    methods: [ WRONG ]
+  /error-handler:
+    command: "true"
+    errorHandler:
+      command: "true"
+      plugins:
+        - schedule: {}
+  /database:
+    command: "true"
+    plugins:
+      - schedule:
+          id: test
+`)
+	problems = ValidateConfigs(ValidateOptions{ConfigFilenames: []string{invalid}})
+	require.Len(t, problems, 3)
+	require.Equal(t, "/database", problems[0].Route)
+	require.Contains(t, problems[0].Message, "database is required")
+	require.Equal(t, "/error-handler", problems[1].Route)
+	require.Equal(t, "errorHandler.plugins[0].schedule.id", problems[1].Field)
+	require.Equal(t, "/methods", problems[2].Route)
+	require.Equal(t, "methods[0]", problems[2].Field)
+}
+
+func TestValidateConfigsRouteCollisions(t *testing.T) {
+	dir := t.TempDir()
+
+	first := writeTestValidateConfig(t, dir, "first.yaml", `
+listeners:
+  /hello:
+    command: "true"
+  /users/:id:
+    command: "true"
+`)
+	second := writeTestValidateConfig(t, dir, "second.yaml", `
+listeners:
+  /hello:
+    methods: [ POST ]
+    command: "true"
+  /users/:name:
+    command: "true"
+`)
+	// Same routes on different ports do not collide
+	other := writeTestValidateConfig(t, dir, "other.yaml", `
+port: 7056
+listeners:
+  /hello:
+    command: "true"
+`)
+
+	problems := ValidateConfigs(ValidateOptions{ConfigFilenames: []string{first, second, other}})
+	require.Len(t, problems, 2)
+	require.Equal(t, 0, CountValidationErrors(problems))
+	require.Equal(t, ValidationSeverityWarning, problems[0].Severity)
+	require.Equal(t, second, problems[0].File)
+	require.Equal(t, "/hello", problems[0].Route)
+	require.Contains(t, problems[0].Message, first)
+	require.Equal(t, second, problems[1].File)
+	require.Equal(t, "/users/:name", problems[1].Route)
+}
+
+func TestValidationFieldPath(t *testing.T) {
+	root := reflect.TypeOf(ListenerConfig{})
+	require.Equal(t, "plugins[0].httpResponse.headers", validationFieldPath(root, "ListenerConfig.Plugins[0].HTTPResponse.Headers"))
+	require.Equal(t, "storage.asYAML", validationFieldPath(root, "ListenerConfig.Storage.AsYAML"))
+	require.Equal(t, "tls.minVersion", validationFieldPath(reflect.TypeOf(Config{}), "Config.TLS.MinVersion"))
+}